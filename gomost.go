@@ -3,13 +3,18 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"text/tabwriter"
 
 	"github.com/landonia/golog"
 	"github.com/landonia/gomost/proxy"
+	yaml "gopkg.in/yaml.v2"
 )
 
 var (
@@ -44,6 +49,33 @@ func main() {
 		config.Addr = proxy.DefaultSSLAddr
 	}
 	config.Prod = *prod
+
+	// Check whether a command has been provided
+	switch cmd := flag.Arg(0); cmd {
+	case "", "run", "check":
+	case "print-config":
+		printConfig(config)
+		return
+	case "schema":
+		printSchema()
+		return
+	case "top":
+		runTop(config, flag.Args()[1:])
+		return
+	case "replay":
+		runReplay(flag.Args()[1:])
+		return
+	case "ca":
+		printLocalCA(config)
+		return
+	case "service":
+		if err := controlService(flag.Arg(1), *configPath); err != nil {
+			logger.Fatal("Could not %s service: %s", flag.Arg(1), err.Error())
+		}
+		return
+	default:
+		logger.Fatal("Unknown command: %s", cmd)
+	}
 	golog.LogLevel(config.LogLevel)
 
 	// initialise the server
@@ -52,6 +84,37 @@ func main() {
 		logger.Fatal("Could not start Gomost server: %s", err.Error())
 	}
 
+	// Print the routing table without serving any requests
+	if flag.Arg(0) == "run" {
+		runFlags := flag.NewFlagSet("run", flag.ExitOnError)
+		dryRun := runFlags.Bool("dry-run", false, "Print the resolved routing table and exit")
+		runFlags.Parse(flag.Args()[1:])
+		if *dryRun {
+			printRoutes(p)
+			return
+		}
+	}
+
+	// Probe the upstreams, certificates and ACME directories and exit
+	if flag.Arg(0) == "check" {
+		if !printCheck(p) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Only the server writes to the log file so that the output of the
+	// commands is still written to the terminal
+	if config.LogFile != "" {
+		if err := redirectLog(config.LogFile); err != nil {
+			logger.Fatal("Could not open log file: %s", err.Error())
+		}
+	}
+
+	// Allow the log level to be changed using a signal
+	notifyLogLevel(p, config.LogLevel)
+	notifyReopen(p, config.LogFile)
+
 	// Wait for a shutdown signal
 	go func() {
 		sigs := make(chan os.Signal, 1)
@@ -63,8 +126,83 @@ func main() {
 		}()
 	}()
 
+	// When started by the service manager the lifecycle is controlled by it
+	if isService() {
+		if err = runService(p); err != nil {
+			logger.Fatal("Error running Gomost service: %s", err.Error())
+		}
+		return
+	}
+
 	// Handle any requests
 	if err = p.Service(); err != nil {
 		logger.Fatal("Error shutting down Gomost server: %s", err.Error())
 	}
 }
+
+// printConfig will write the resolved configuration to stdout with any
+// secrets redacted
+func printConfig(config proxy.Configuration) {
+	b, err := yaml.Marshal(config.Redacted())
+	if err != nil {
+		logger.Fatal("Could not marshal configuration: %s", err.Error())
+	}
+	fmt.Print(string(b))
+}
+
+// printSchema will write the JSON Schema of the configuration to stdout
+func printSchema() {
+	b, err := proxy.Schema()
+	if err != nil {
+		logger.Fatal("Could not generate schema: %s", err.Error())
+	}
+	fmt.Println(string(b))
+}
+
+// printCheck will write the self-test results to stdout and return false if
+// any of the checks failed
+func printCheck(p *proxy.Proxy) bool {
+	counts := make(map[string]int)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STATUS\tCHECK\tTARGET\tDETAIL")
+	for _, r := range p.Check(context.Background()) {
+		counts[r.Status]++
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", strings.ToUpper(r.Status), r.Check, r.Target, r.Detail)
+	}
+	w.Flush()
+	fmt.Printf("\n%d passed, %d warnings, %d failed\n", counts[proxy.CheckPass], counts[proxy.CheckWarn], counts[proxy.CheckFail])
+	return counts[proxy.CheckFail] == 0
+}
+
+// printLocalCA will create the local CA if it does not exist and write the
+// instructions for trusting it to stdout
+func printLocalCA(config proxy.Configuration) {
+	certFile, err := proxy.InitLocalCA(config.SSL.LocalCA)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	fmt.Printf("The local CA certificate is %s\n\n", certFile)
+	fmt.Println("Trust it so that the certificates gomost issues are accepted:")
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "  macOS\tsudo security add-trusted-cert -d -r trustRoot -k /Library/Keychains/System.keychain %s\n", certFile)
+	fmt.Fprintf(w, "  Debian/Ubuntu\tsudo cp %s /usr/local/share/ca-certificates/gomost.crt && sudo update-ca-certificates\n", certFile)
+	fmt.Fprintf(w, "  Fedora/RHEL\tsudo cp %s /etc/pki/ca-trust/source/anchors/gomost.pem && sudo update-ca-trust\n", certFile)
+	fmt.Fprintf(w, "  Windows\tcertutil -addstore -f ROOT %s\n", certFile)
+	fmt.Fprintf(w, "  Firefox\tSettings > Privacy & Security > Certificates > View Certificates > Authorities > Import\n")
+	fmt.Fprintf(w, "  Node.js\texport NODE_EXTRA_CA_CERTS=%s\n", certFile)
+	fmt.Fprintf(w, "  curl\tcurl --cacert %s https://www.dev1.test\n", certFile)
+	w.Flush()
+	if !config.SSL.LocalCA.Enable {
+		fmt.Println("\nEnable the local CA within the configuration (ssl: localca: enable: true) to use it")
+	}
+}
+
+// printRoutes will write the resolved routing table to stdout
+func printRoutes(p *proxy.Proxy) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tMATCH\tPATH\tTARGET\tTLS")
+	for _, r := range p.Routes() {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", r.Host, r.Match, r.Path, r.Target, r.TLS)
+	}
+	w.Flush()
+}
@@ -0,0 +1,118 @@
+// Copyright 2016 Landonia Ltd. All rights reserved.
+
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// logFile is a file that lines are appended to which can be reopened so
+// that it can be rotated without losing any lines
+type logFile struct {
+	mu   sync.Mutex
+	path string
+	w    io.WriteCloser
+}
+
+// openLogFile will open the log file for appending
+func openLogFile(path string) (*logFile, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &logFile{path: path, w: f}, nil
+}
+
+// write will append the line to the file
+func (lf *logFile) write(line string) {
+	lf.mu.Lock()
+	lf.w.Write([]byte(line))
+	lf.mu.Unlock()
+}
+
+// reopen will open the file again and close the previous file
+func (lf *logFile) reopen() error {
+	f, err := os.OpenFile(lf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("Could not reopen %s: %s", lf.path, err.Error())
+	}
+	lf.mu.Lock()
+	old := lf.w
+	lf.w = f
+	lf.mu.Unlock()
+	return old.Close()
+}
+
+// close will close the file
+func (lf *logFile) close() error {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	return lf.w.Close()
+}
+
+// accessLog will write a line in the combined log format for every request
+// followed by the TLS fingerprints of the client when available
+type accessLog struct {
+	*logFile
+	gm *Proxy
+}
+
+// newAccessLog will open the access log file for appending
+func newAccessLog(gm *Proxy, path string) (*accessLog, error) {
+	lf, err := openLogFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open access log: %s", err.Error())
+	}
+	return &accessLog{logFile: lf, gm: gm}, nil
+}
+
+// middleware will log the request once it has completed
+func (al *accessLog) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: resp, status: http.StatusOK}
+		next.ServeHTTP(rec, req)
+		ja3, ja4 := al.gm.Fingerprint(req)
+		al.write(fmt.Sprintf("%s - - [%s] %q %d %d %q %q ja3=%q ja4=%q\n",
+			requestRemoteIP(req), start.Format("02/Jan/2006:15:04:05 -0700"),
+			req.Method+" "+req.RequestURI+" "+req.Proto, rec.status, rec.bytes,
+			req.Referer(), req.UserAgent(), ja3, ja4))
+	})
+}
+
+// statusRecorder records the status and the bytes written for a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+// WriteHeader will record the status
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Write will record the bytes written
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Flush will flush the underlying writer if supported
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap will return the underlying writer
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
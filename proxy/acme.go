@@ -0,0 +1,225 @@
+// Copyright 2016 Landonia Ltd. All rights reserved.
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	// DefaultCertCacheDir is the directory used to cache the certificates
+	DefaultCertCacheDir = "./certcache"
+)
+
+// acmeManager will select the ACME account (autocert manager) to use for
+// the requested host
+type acmeManager struct {
+	fallback *autocert.Manager            // The manager for the default account
+	managers map[string]*autocert.Manager // The managers for each configured host
+	follower *followerCerts               // Used when a cluster node is not the leader
+	events   *Events                      // The bus the certificate events are published on
+	mu       sync.Mutex                   // Guards the serials
+	serials  map[string]string            // The serial of the certificate last served for each host
+}
+
+// newACMEManager will create the managers for the default account and each
+// of the configured host accounts. If a shared cache is provided it is used
+// unless a cache backend has been specifically configured.
+func newACMEManager(config ACMEConfig, shared autocert.Cache) (*acmeManager, error) {
+	cache := shared
+	if cache == nil || config.Cache.Type != "" {
+		var err error
+		if cache, err = newCertCache(config); err != nil {
+			return nil, err
+		}
+	}
+	fallback, err := newAutocertManager(config.Email, config.Directory, config.EAB)
+	if err != nil {
+		return nil, err
+	}
+	fallback.Cache = cache
+	am := &acmeManager{
+		fallback: fallback,
+		managers: make(map[string]*autocert.Manager),
+		serials:  make(map[string]string),
+	}
+	names := make(map[string]bool)
+	for _, account := range config.Accounts {
+		if account.Name == "" {
+			return nil, fmt.Errorf("The ACME account name cannot be empty")
+		}
+		if names[account.Name] {
+			return nil, fmt.Errorf("Duplicate ACME account name: %s", account.Name)
+		}
+		names[account.Name] = true
+
+		// Each account is stored under its own prefix so that the account
+		// keys and certificates are kept separate within the cache
+		m, err := newAutocertManager(account.Email, account.Directory, account.EAB)
+		if err != nil {
+			return nil, fmt.Errorf("ACME account %s: %s", account.Name, err.Error())
+		}
+		m.Cache = &prefixCache{prefix: account.Name + "+", cache: cache}
+		m.HostPolicy = autocert.HostWhitelist(account.Hosts...)
+		for _, host := range account.Hosts {
+			host = strings.ToLower(host)
+			if _, exists := am.managers[host]; exists {
+				return nil, fmt.Errorf("Host %s is assigned to more than one ACME account", host)
+			}
+			am.managers[host] = m
+		}
+	}
+	return am, nil
+}
+
+// newAutocertManager will create a manager for the account using the CA
+// directory and external account binding when provided
+func newAutocertManager(email, directory string, eab EABConfig) (*autocert.Manager, error) {
+	m := &autocert.Manager{
+		Prompt: autocert.AcceptTOS,
+		Email:  email,
+	}
+	if directory != "" {
+		m.Client = &acme.Client{DirectoryURL: directory}
+	}
+	if eab.KeyID != "" || eab.HMACKey != "" {
+		if eab.KeyID == "" || eab.HMACKey == "" {
+			return nil, fmt.Errorf("Both the EAB keyid and hmackey must be provided")
+		}
+		key, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(eab.HMACKey, "="))
+		if err != nil {
+			return nil, fmt.Errorf("Could not decode the EAB hmackey: %s", err.Error())
+		}
+		m.ExternalAccountBinding = &acme.ExternalAccountBinding{
+			KID: eab.KeyID,
+			Key: key,
+		}
+	}
+	return m, nil
+}
+
+// manager will return the manager responsible for the host
+func (am *acmeManager) manager(host string) *autocert.Manager {
+	if m, exists := am.managers[strings.ToLower(host)]; exists {
+		return m
+	}
+	return am.fallback
+}
+
+// httpHandler will return the handler that answers the HTTP-01 challenges
+// for each of the accounts. As the tokens are stored within the cache any
+// instance sharing the cache can answer the challenge.
+func (am *acmeManager) httpHandler(fallback http.Handler) http.Handler {
+	handlers := map[*autocert.Manager]http.Handler{
+		am.fallback: am.fallback.HTTPHandler(fallback),
+	}
+	for _, m := range am.managers {
+		if _, exists := handlers[m]; !exists {
+			handlers[m] = m.HTTPHandler(fallback)
+		}
+	}
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		handlers[am.manager(requestHost(req))].ServeHTTP(resp, req)
+	})
+}
+
+// GetCertificate will return the certificate from the account responsible
+// for the requested server name
+func (am *acmeManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if am.follower != nil && !am.follower.c.isLeader() && !isALPNChallenge(hello) {
+		return am.follower.GetCertificate(hello)
+	}
+	cert, err := am.manager(hello.ServerName).GetCertificate(hello)
+	if !isALPNChallenge(hello) {
+		am.observe(hello.ServerName, cert, err)
+	}
+	return cert, err
+}
+
+// observe will publish an event when a new certificate is served for the
+// host or a certificate could not be obtained
+func (am *acmeManager) observe(host string, cert *tls.Certificate, err error) {
+	if am.events == nil {
+		return
+	} else if err != nil {
+		am.events.Publish(Event{Type: EventCertFailed, Host: host, Error: err.Error()})
+		return
+	} else if cert == nil || cert.Leaf == nil {
+		return
+	}
+	serial := cert.Leaf.SerialNumber.String()
+	am.mu.Lock()
+	previous, exists := am.serials[host]
+	am.serials[host] = serial
+	am.mu.Unlock()
+	if previous != serial {
+		detail := "issued"
+		if exists {
+			detail = "renewed"
+		}
+		am.events.Publish(Event{Type: EventCertRenewed, Host: host, Detail: detail + " until " + cert.Leaf.NotAfter.UTC().Format(time.RFC3339)})
+	}
+}
+
+// followCluster will only allow certificates to be requested when the node
+// is the leader of the cluster
+func (am *acmeManager) followCluster(c *cluster) {
+	am.follower = &followerCerts{am: am, c: c, certs: make(map[string]*followerCert)}
+}
+
+// isALPNChallenge will return true if the hello is a TLS-ALPN-01 challenge
+func isALPNChallenge(hello *tls.ClientHelloInfo) bool {
+	return len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto
+}
+
+// tlsConfig will return the tls.Config for the automatic certificates
+func (am *acmeManager) tlsConfig() *tls.Config {
+
+	// Advertising the ACME protocol allows the TLS-ALPN-01 challenge to be
+	// answered on this listener so port 80 does not have to be reachable
+	return &tls.Config{
+		GetCertificate: am.GetCertificate,
+		NextProtos:     []string{"http/1.1", acme.ALPNProto},
+	}
+}
+
+// prefixCache will store all the entries within the cache using a prefix
+type prefixCache struct {
+	prefix string
+	cache  autocert.Cache
+}
+
+// Get returns the certificate data for the specified key
+func (pc *prefixCache) Get(ctx context.Context, key string) ([]byte, error) {
+	return pc.cache.Get(ctx, pc.prefix+key)
+}
+
+// Put stores the data in the cache under the specified key
+func (pc *prefixCache) Put(ctx context.Context, key string, data []byte) error {
+	return pc.cache.Put(ctx, pc.prefix+key, data)
+}
+
+// PutExpiring stores the data under the key until the ttl has passed
+func (pc *prefixCache) PutExpiring(ctx context.Context, key string, data []byte, ttl time.Duration) error {
+	return putExpiring(ctx, pc.cache, pc.prefix+key, data, ttl)
+}
+
+// CompareAndSwap will store the data only if the current entry is old
+func (pc *prefixCache) CompareAndSwap(ctx context.Context, key string, old, data []byte) (bool, error) {
+	return compareAndSwap(ctx, pc.cache, pc.prefix+key, old, data)
+}
+
+// Delete removes a certificate data from the cache under the specified key
+func (pc *prefixCache) Delete(ctx context.Context, key string) error {
+	return pc.cache.Delete(ctx, pc.prefix+key)
+}
@@ -0,0 +1,177 @@
+// Copyright 2016 Landonia Ltd. All rights reserved.
+
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// adminHandler will return the handler used by the admin server
+func (gm *Proxy) adminHandler() (http.Handler, error) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/config", gm.adminConfig)
+	mux.HandleFunc("/loglevel", gm.adminLogLevel)
+	mux.HandleFunc("/proxies", gm.adminProxies)
+	mux.HandleFunc("/memory", gm.adminMemory)
+	mux.HandleFunc("/routes", gm.adminRoutes)
+	mux.HandleFunc("/captures", gm.adminCaptures)
+	mux.HandleFunc("/quotas", gm.adminQuotas)
+	return gm.adminAuth(mux)
+}
+
+// adminConfig will write the currently active configuration with any
+// secrets redacted
+func (gm *Proxy) adminConfig(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	b, err := yaml.Marshal(gm.Config().Redacted())
+	if err != nil {
+		logger.Error("Could not marshal configuration: %s", err.Error())
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/x-yaml")
+	resp.Write(b)
+}
+
+// adminLogLevel will write the current log level or change it when a new
+// level is provided using the level parameter
+func (gm *Proxy) adminLogLevel(resp http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		if err := gm.SetLogLevel(req.FormValue("level")); err != nil {
+			http.Error(resp, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	resp.Header().Set("Content-Type", "text/plain")
+	resp.Write([]byte(gm.Config().LogLevel + "\n"))
+}
+
+// adminProxies will write the proxies, add (or replace) the proxy provided
+// within the body or remove the proxy using the host parameter
+func (gm *Proxy) adminProxies(resp http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		var conf HostConfig
+		b, err := io.ReadAll(io.LimitReader(req.Body, 1<<20))
+		if err == nil {
+			err = yaml.Unmarshal(b, &conf)
+		}
+		if err == nil && (!adminCanAccess(req, conf.Proxy) || !adminCanRoute(req, gm.proxyConfig(conf.Proxy), conf)) {
+			http.Error(resp, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		if err == nil {
+			err = gm.AddProxy(conf)
+		}
+		if err != nil {
+			http.Error(resp, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case http.MethodDelete:
+		if !adminCanAccess(req, req.FormValue("host")) {
+			http.Error(resp, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		gm.RemoveProxy(req.FormValue("host"))
+	default:
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var proxies []HostConfig
+	for _, conf := range gm.Config().Proxies {
+		if adminCanAccess(req, conf.Proxy) {
+			redact(reflect.ValueOf(&conf).Elem(), false)
+			proxies = append(proxies, conf)
+		}
+	}
+	b, err := yaml.Marshal(proxies)
+	if err != nil {
+		logger.Error("Could not marshal proxies: %s", err.Error())
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/x-yaml")
+	resp.Write(b)
+}
+
+// proxyConfig will return the configuration of the proxy (nil if it does
+// not exist)
+func (gm *Proxy) proxyConfig(host string) *HostConfig {
+	for _, conf := range gm.Config().Proxies {
+		if conf.Proxy == host {
+			return &conf
+		}
+	}
+	return nil
+}
+
+// adminMemory will write the memory budget statistics
+func (gm *Proxy) adminMemory(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	limit, used, consumers := gm.memory.stats()
+	b, err := yaml.Marshal(struct {
+		Limit     int64         `yaml:"limit"`
+		Used      int64         `yaml:"used"`
+		Consumers []MemoryStats `yaml:"consumers"`
+	}{limit, used, consumers})
+	if err != nil {
+		logger.Error("Could not marshal memory statistics: %s", err.Error())
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/x-yaml")
+	resp.Write(b)
+}
+
+// adminRoutes will write the routing table with the live counters of each
+// route as JSON
+func (gm *Proxy) adminRoutes(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var routes []Route
+	for _, r := range gm.Routes() {
+		if adminCanAccess(req, r.Host) || (r.Match == "alias" && adminCanAccess(req, r.Target)) {
+			routes = append(routes, r)
+		}
+	}
+	for i := range routes {
+		name := strings.ToLower(routes[i].Host)
+		if routes[i].Match == "rule" {
+			name = routes[i].Path
+		}
+		stats := gm.stats.get(routes[i].Match, name)
+		switch routes[i].Match {
+		case "handler", "matcher", "static", "file", "redirect":
+			stats.Health = "up"
+		}
+		routes[i].Stats = &stats
+	}
+	b, err := json.MarshalIndent(routes, "", "  ")
+	if err != nil {
+		logger.Error("Could not marshal routes: %s", err.Error())
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write(b)
+}
@@ -0,0 +1,157 @@
+// Copyright 2016 Landonia Ltd. All rights reserved.
+
+package proxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The admin roles
+const (
+	AdminRoleRead  = "read"  // Can only view the routes, statistics and configuration
+	AdminRoleWrite = "write" // Can also modify the routes and log level
+)
+
+// hostScopedEndpoints can be used by credentials limited to specific hosts as
+// they only return (or change) the information for those hosts. The other
+// endpoints expose the configuration of every host.
+var hostScopedEndpoints = map[string]bool{
+	"routes":   true,
+	"proxies":  true,
+	"captures": true,
+	"quotas":   true,
+}
+
+// adminContextKey is used to store the authenticated credential within the
+// context of the admin requests
+type adminContextKey struct{}
+
+// adminAuth will authenticate the admin requests using the configured bearer
+// tokens, basic auth users or client certificates and check the credential
+// has the scope of the endpoint. When no credentials have been configured
+// the admin server is left open. Every credential must have a role so that
+// the credentials created before the roles were introduced (which could
+// make changes) are not silently made read only.
+func (gm *Proxy) adminAuth(next http.Handler) (http.Handler, error) {
+	creds := gm.config.Admin.Credentials
+	if len(creds) == 0 {
+		logger.Warn("No admin credentials have been configured - the admin server is not protected")
+		return next, nil
+	}
+	basic := false
+	for _, cred := range creds {
+		basic = basic || cred.Username != ""
+		if cred.Role != AdminRoleRead && cred.Role != AdminRoleWrite {
+			return nil, fmt.Errorf("Admin credential %s must have the %s or %s role (found %q)", cred.Name, AdminRoleRead, AdminRoleWrite, cred.Role)
+		}
+	}
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		cred := authenticateAdmin(creds, req)
+		if cred == nil {
+			if basic {
+				resp.Header().Set("WWW-Authenticate", `Basic realm="gomost"`)
+			}
+			http.Error(resp, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		endpoint := strings.Trim(req.URL.Path, "/")
+		if !cred.hasScope(endpoint) || (!isReadOnly(req) && cred.Role != AdminRoleWrite) ||
+			(len(cred.Hosts) > 0 && !hostScopedEndpoints[endpoint]) {
+			http.Error(resp, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(resp, req.WithContext(context.WithValue(req.Context(), adminContextKey{}, cred)))
+	}), nil
+}
+
+// authenticateAdmin will return the credential matching the request (nil if
+// none match)
+func authenticateAdmin(creds []AdminCredential, req *http.Request) *AdminCredential {
+	var token string
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimSpace(auth[len("Bearer "):])
+	}
+	username, password, hasBasic := req.BasicAuth()
+	for i := range creds {
+		cred := &creds[i]
+		switch {
+		case cred.Token != "" && token != "":
+			if subtle.ConstantTimeCompare([]byte(cred.Token), []byte(token)) == 1 {
+				return cred
+			}
+		case cred.Username != "" && hasBasic:
+			if cred.Username == username && checkPassword(cred.Password, password) {
+				return cred
+			}
+		case len(cred.Subject) > 0 && req.TLS != nil && len(req.TLS.VerifiedChains) > 0:
+			if matchName(req.TLS.VerifiedChains[0][0].Subject, cred.Subject) {
+				return cred
+			}
+		}
+	}
+	return nil
+}
+
+// checkPassword will compare the password to the configured password which
+// can be a bcrypt hash
+func checkPassword(configured, password string) bool {
+	if strings.HasPrefix(configured, "$2") {
+		return bcrypt.CompareHashAndPassword([]byte(configured), []byte(password)) == nil
+	}
+	return configured != "" && subtle.ConstantTimeCompare([]byte(configured), []byte(password)) == 1
+}
+
+// hasScope will return true if the credential can use the endpoint
+func (cred *AdminCredential) hasScope(endpoint string) bool {
+	for _, scope := range cred.Scopes {
+		if scope == "*" || scope == endpoint {
+			return true
+		}
+	}
+	return false
+}
+
+// isReadOnly will return true if the request does not change anything
+func isReadOnly(req *http.Request) bool {
+	return req.Method == http.MethodGet || req.Method == http.MethodHead
+}
+
+// adminCanRoute will return true if the credential of the admin request can
+// set the upstreams of the proxy. Credentials limited to hosts cannot change
+// the upstream hosts, forward proxy or SOCKS5 proxy from those already
+// configured (nor add a proxy with them) as they could otherwise have the
+// proxy send requests to any internal address.
+func adminCanRoute(req *http.Request, existing *HostConfig, conf HostConfig) bool {
+	cred, _ := req.Context().Value(adminContextKey{}).(*AdminCredential)
+	if cred == nil || len(cred.Hosts) == 0 {
+		return true
+	}
+	var current HostConfig
+	if existing != nil {
+		current = *existing
+	}
+	return conf.Host == current.Host && reflect.DeepEqual(conf.Hosts, current.Hosts) &&
+		conf.ForwardProxy == current.ForwardProxy && reflect.DeepEqual(conf.SOCKS5, current.SOCKS5)
+}
+
+// adminCanAccess will return true if the credential of the admin request can
+// view or change the host
+func adminCanAccess(req *http.Request, host string) bool {
+	cred, _ := req.Context().Value(adminContextKey{}).(*AdminCredential)
+	if cred == nil || len(cred.Hosts) == 0 {
+		return true
+	}
+	for _, h := range cred.Hosts {
+		if strings.EqualFold(h, host) {
+			return true
+		}
+	}
+	return false
+}
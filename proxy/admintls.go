@@ -0,0 +1,80 @@
+// Copyright 2016 Landonia Ltd. All rights reserved.
+
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+)
+
+// adminTLSConfig will return the TLS configuration of the admin server (nil
+// if not enabled) which uses its own certificate or reuses the main one
+func (gm *Proxy) adminTLSConfig(main *tls.Config) (*tls.Config, error) {
+	conf := gm.config.Admin.TLS
+	var tlsConfig *tls.Config
+	if conf.CertFile != "" && conf.KeyFile != "" {
+		var err error
+		if tlsConfig, err = fileTLSConfig(conf.CertFile, conf.KeyFile); err != nil {
+			return nil, err
+		}
+	} else if conf.Reuse {
+		if main == nil {
+			return nil, fmt.Errorf("The admin server cannot reuse the main certificate as SSL is disabled")
+		}
+		tlsConfig = main.Clone()
+
+		// The public client settings do not apply to the admin server
+		tlsConfig.GetConfigForClient = nil
+		tlsConfig.ClientCAs = nil
+		tlsConfig.ClientAuth = tls.NoClientCert
+	} else {
+		return nil, nil
+	}
+	if conf.ClientCAFile != "" {
+		b, err := os.ReadFile(conf.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read admin client CA file: %s", err.Error())
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("No certificates found in admin client CA file: %s", conf.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if conf.RequireClientCert {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	} else if conf.RequireClientCert {
+		return nil, fmt.Errorf("The admin clientcafile is required to verify the client certificates")
+	}
+	return tlsConfig, nil
+}
+
+// checkInternalAddr will return an error unless the address is bound to a
+// loopback or private interface
+func checkInternalAddr(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		if host == "" {
+			return fmt.Errorf("The admin address %s binds to every interface", addr)
+		}
+		if ips, err = net.LookupIP(host); err != nil {
+			return err
+		}
+	}
+	for _, ip := range ips {
+		if ip.IsUnspecified() {
+			return fmt.Errorf("The admin address %s binds to every interface", addr)
+		} else if !ip.IsLoopback() && !ip.IsPrivate() {
+			return fmt.Errorf("The admin address %s is not an internal address", addr)
+		}
+	}
+	return nil
+}
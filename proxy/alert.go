@@ -0,0 +1,271 @@
+// Copyright 2016 Landonia Ltd. All rights reserved.
+
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultAlertInterval is the seconds between alerts for the same event
+	// type and host
+	DefaultAlertInterval = 300
+	// pagerDutyURL is the PagerDuty Events API v2 endpoint
+	pagerDutyURL = "https://events.pagerduty.com/v2/enqueue"
+)
+
+// Notifier will send an alert for the event
+type Notifier interface {
+	Notify(event Event) error
+}
+
+// NotifierFactory will create a notifier using the configured options
+type NotifierFactory func(options map[string]string) (Notifier, error)
+
+var (
+	notifiersMu sync.RWMutex
+	notifiers   = map[string]NotifierFactory{
+		"slack":     newSlackNotifier,
+		"email":     newEmailNotifier,
+		"pagerduty": newPagerDutyNotifier,
+	}
+)
+
+// RegisterNotifier will make the notifier available to the alerts using the
+// name. If the name has already been registered it will panic.
+func RegisterNotifier(name string, factory NotifierFactory) {
+	notifiersMu.Lock()
+	defer notifiersMu.Unlock()
+	if factory == nil {
+		panic("proxy: RegisterNotifier factory is nil")
+	}
+	if _, dup := notifiers[name]; dup {
+		panic("proxy: RegisterNotifier called twice for notifier " + name)
+	}
+	notifiers[name] = factory
+}
+
+// oppositeEvents are the events that end the state reported by another so
+// an alert is sent straight away when the state changes back
+var oppositeEvents = map[EventType]EventType{
+	EventUpstreamDown: EventUpstreamUp,
+	EventUpstreamUp:   EventUpstreamDown,
+}
+
+// alert will send the events it is subscribed to using the notifier no more
+// than once per interval for each event type and route (or host)
+type alert struct {
+	*eventWorker
+	conf     AlertConfig
+	notifier Notifier
+	interval time.Duration
+	last     map[string]time.Time // When an alert was last sent by event type and route
+	pruned   time.Time            // When the expired entries were last removed
+}
+
+// newAlert will create the configured notifier
+func newAlert(conf AlertConfig, events *Events) (*alert, error) {
+	notifiersMu.RLock()
+	factory, exists := notifiers[conf.Type]
+	notifiersMu.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("Unknown alert type: %s", conf.Type)
+	}
+	notifier, err := factory(conf.Options)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create %s alert: %s", conf.Type, err.Error())
+	}
+	interval := conf.Interval
+	if interval == 0 {
+		interval = DefaultAlertInterval
+	}
+	a := &alert{
+		conf:     conf,
+		notifier: notifier,
+		interval: time.Duration(interval) * time.Second,
+		last:     make(map[string]time.Time),
+	}
+	a.eventWorker = newEventWorker(events, conf.Events, a.notify)
+	return a, nil
+}
+
+// notify will send the alert unless one was sent recently for the same
+// event type and route. The events are keyed by the configured route rather
+// than the host when there is one as the host is supplied by the client.
+func (a *alert) notify(event Event) {
+	if event.Time.Sub(a.pruned) >= a.interval {
+		for key, last := range a.last {
+			if event.Time.Sub(last) >= a.interval {
+				delete(a.last, key)
+			}
+		}
+		a.pruned = event.Time
+	}
+	subject := event.Route
+	if subject == "" {
+		subject = event.Host
+	}
+	key := string(event.Type) + "|" + subject
+	if last, exists := a.last[key]; exists && event.Time.Sub(last) < a.interval {
+		return
+	}
+	a.last[key] = event.Time
+	if opposite, exists := oppositeEvents[event.Type]; exists {
+		delete(a.last, string(opposite)+"|"+subject)
+	}
+	if err := a.notifier.Notify(event); err != nil {
+		logger.Warn("Could not send %s alert: %s", a.conf.Type, err.Error())
+	}
+}
+
+// eventSummary will describe the event in a single line. Any line breaks
+// (such as within a client supplied host) are removed so that the summary
+// can be used as an email subject.
+func eventSummary(event Event) string {
+	parts := []string{"[gomost]", string(event.Type)}
+	for _, part := range []string{event.Host, event.Route, event.Upstream, event.Detail, event.Error} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(strings.Join(parts, " "))
+}
+
+// postJSON will post the value as JSON failing on any unsuccessful status
+func postJSON(client *http.Client, url string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Unexpected status: %s", resp.Status)
+	}
+	return nil
+}
+
+// slackNotifier posts the alerts to a Slack incoming webhook
+type slackNotifier struct {
+	url    string
+	client *http.Client
+}
+
+// newSlackNotifier requires the url of the incoming webhook
+func newSlackNotifier(options map[string]string) (Notifier, error) {
+	if options["url"] == "" {
+		return nil, fmt.Errorf("The url option is required")
+	}
+	return &slackNotifier{url: options["url"], client: &http.Client{Timeout: 10 * time.Second}}, nil
+}
+
+// Notify will post the summary of the event
+func (sn *slackNotifier) Notify(event Event) error {
+	return postJSON(sn.client, sn.url, map[string]string{"text": eventSummary(event)})
+}
+
+// emailNotifier sends the alerts using SMTP
+type emailNotifier struct {
+	addr string
+	auth smtp.Auth
+	from string
+	to   []string
+}
+
+// newEmailNotifier requires the addr (host:port) of the SMTP server, from
+// and the comma separated to addresses with an optional username/password
+func newEmailNotifier(options map[string]string) (Notifier, error) {
+	en := &emailNotifier{addr: options["addr"], from: options["from"]}
+	for _, to := range strings.Split(options["to"], ",") {
+		if to = strings.TrimSpace(to); to != "" {
+			en.to = append(en.to, to)
+		}
+	}
+	if en.addr == "" || en.from == "" || len(en.to) == 0 {
+		return nil, fmt.Errorf("The addr, from and to options are required")
+	}
+	if options["username"] != "" {
+		host, _, err := net.SplitHostPort(en.addr)
+		if err != nil {
+			return nil, err
+		}
+		en.auth = smtp.PlainAuth("", options["username"], options["password"], host)
+	}
+	return en, nil
+}
+
+// Notify will send the event as a plain text email
+func (en *emailNotifier) Notify(event Event) error {
+	b, _ := json.MarshalIndent(event, "", "  ")
+	msg := "From: " + en.from + "\r\n" +
+		"To: " + strings.Join(en.to, ", ") + "\r\n" +
+		"Subject: " + eventSummary(event) + "\r\n" +
+		"Date: " + event.Time.Format(time.RFC1123Z) + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n\r\n" +
+		string(b) + "\r\n"
+	return smtp.SendMail(en.addr, en.auth, en.from, en.to, []byte(msg))
+}
+
+// pagerDutyNotifier triggers (and resolves) incidents using the PagerDuty
+// Events API v2
+type pagerDutyNotifier struct {
+	routingKey string
+	severity   string
+	source     string
+	client     *http.Client
+}
+
+// newPagerDutyNotifier requires the routingkey of the integration
+func newPagerDutyNotifier(options map[string]string) (Notifier, error) {
+	if options["routingkey"] == "" {
+		return nil, fmt.Errorf("The routingkey option is required")
+	}
+	pn := &pagerDutyNotifier{
+		routingKey: options["routingkey"],
+		severity:   options["severity"],
+		client:     &http.Client{Timeout: 10 * time.Second},
+	}
+	if pn.severity == "" {
+		pn.severity = "error"
+	}
+	pn.source, _ = os.Hostname()
+	return pn, nil
+}
+
+// Notify will trigger an incident for the event or resolve the incident
+// when the upstream comes back up
+func (pn *pagerDutyNotifier) Notify(event Event) error {
+	action := "trigger"
+	dedup := "gomost " + string(event.Type) + " " + event.Host + " " + event.Route
+	switch event.Type {
+	case EventUpstreamUp:
+		action = "resolve"
+		fallthrough
+	case EventUpstreamDown:
+		dedup = "gomost " + string(EventUpstreamDown) + " " + event.Route
+	}
+	return postJSON(pn.client, pagerDutyURL, map[string]interface{}{
+		"routing_key":  pn.routingKey,
+		"event_action": action,
+		"dedup_key":    dedup,
+		"payload": map[string]interface{}{
+			"summary":        eventSummary(event),
+			"source":         pn.source,
+			"severity":       pn.severity,
+			"timestamp":      event.Time.Format(time.RFC3339),
+			"custom_details": event,
+		},
+	})
+}
@@ -0,0 +1,200 @@
+// Copyright 2016 Landonia Ltd. All rights reserved.
+
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// hashReplicas is the number of points each upstream has on the ring
+	hashReplicas = 160
+	// DefaultStickyTTL is the seconds a sticky session is kept since its
+	// last request
+	DefaultStickyTTL = 3600
+)
+
+// balancer will choose the upstream (by index) for the request
+type balancer interface {
+	pick(req *http.Request) int
+}
+
+// newBalancedProxy will create a reverse proxy that forwards the requests to
+// one of the upstreams using the configured strategy
+func newBalancedProxy(conf HostConfig, upstreams []*url.URL, state stateStore) (*httputil.ReverseProxy, error) {
+	var b balancer
+	switch conf.Strategy {
+	case "", "roundrobin":
+		b = &roundRobin{n: uint64(len(upstreams))}
+	case "hash":
+		key, err := hashKey(conf.HashKey)
+		if err != nil {
+			return nil, err
+		}
+		b = newHashRing(upstreams, key)
+	default:
+		return nil, fmt.Errorf("Unknown strategy: %s", conf.Strategy)
+	}
+	if conf.Sticky.Cookie != "" {
+		b = newStickySessions(conf, upstreams, state, b)
+	}
+	directors := make([]func(*http.Request), len(upstreams))
+	for i, u := range upstreams {
+		directors[i] = httputil.NewSingleHostReverseProxy(u).Director
+	}
+	return &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			directors[b.pick(req)](req)
+		},
+	}, nil
+}
+
+// roundRobin will choose each upstream in turn
+type roundRobin struct {
+	next uint64
+	n    uint64
+}
+
+// pick will return the next upstream
+func (rr *roundRobin) pick(req *http.Request) int {
+	return int((atomic.AddUint64(&rr.next, 1) - 1) % rr.n)
+}
+
+// hashRing will choose the upstream using a consistent hash of the request
+// key so that the same key is always sent to the same upstream and only the
+// keys of an added or removed upstream move
+type hashRing struct {
+	points []uint32
+	owners map[uint32]int
+	key    func(*http.Request) string
+}
+
+// newHashRing will create the ring for the upstreams
+func newHashRing(upstreams []*url.URL, key func(*http.Request) string) *hashRing {
+	hr := &hashRing{owners: make(map[uint32]int), key: key}
+	for i, u := range upstreams {
+		for r := 0; r < hashReplicas; r++ {
+			p := crc32.ChecksumIEEE([]byte(u.String() + "#" + strconv.Itoa(r)))
+			if _, exists := hr.owners[p]; !exists {
+				hr.owners[p] = i
+				hr.points = append(hr.points, p)
+			}
+		}
+	}
+	sort.Slice(hr.points, func(i, j int) bool { return hr.points[i] < hr.points[j] })
+	return hr
+}
+
+// pick will return the upstream owning the first point after the key hash
+func (hr *hashRing) pick(req *http.Request) int {
+	h := crc32.ChecksumIEEE([]byte(hr.key(req)))
+	i := sort.Search(len(hr.points), func(i int) bool { return hr.points[i] >= h })
+	if i == len(hr.points) {
+		i = 0
+	}
+	return hr.owners[hr.points[i]]
+}
+
+// stickySessions will send the requests of a session to the upstream that
+// was chosen for the first request of the session. The sessions are kept
+// within the state store so that they are shared by the replicas when the
+// store is shared.
+type stickySessions struct {
+	host      string
+	cookie    string
+	ttl       time.Duration
+	upstreams []string
+	index     map[string]int
+	state     stateStore
+	next      balancer
+}
+
+// newStickySessions will create the sticky sessions falling back to the
+// balancer to choose the upstream of each new session
+func newStickySessions(conf HostConfig, upstreams []*url.URL, state stateStore, next balancer) *stickySessions {
+	ss := &stickySessions{
+		host:   conf.Proxy,
+		cookie: conf.Sticky.Cookie,
+		ttl:    seconds(conf.Sticky.TTL, DefaultStickyTTL),
+		index:  make(map[string]int),
+		state:  state,
+		next:   next,
+	}
+	for i, u := range upstreams {
+		ss.upstreams = append(ss.upstreams, u.String())
+		ss.index[u.String()] = i
+	}
+	return ss
+}
+
+// startSessions will start a session for any request without one so the
+// upstream chosen for the request is remembered
+func startSessions(cookie string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if c, err := req.Cookie(cookie); err != nil || c.Value == "" {
+			b := make([]byte, 16)
+			if _, err := rand.Read(b); err == nil {
+				session := &http.Cookie{
+					Name:     cookie,
+					Value:    hex.EncodeToString(b),
+					Path:     "/",
+					Secure:   req.TLS != nil,
+					HttpOnly: true,
+					SameSite: http.SameSiteLaxMode,
+				}
+				http.SetCookie(resp, session)
+				req.AddCookie(session)
+			}
+		}
+		next.ServeHTTP(resp, req)
+	})
+}
+
+// pick will return the upstream of the session (choosing one if it is a
+// new session or the upstream has been removed)
+func (ss *stickySessions) pick(req *http.Request) int {
+	c, err := req.Cookie(ss.cookie)
+	if err != nil || c.Value == "" {
+		return ss.next.pick(req)
+	}
+	key := "sticky+" + ss.host + "+" + c.Value
+	upstream, err := ss.state.get(req.Context(), key)
+	if err != nil {
+		logger.Warn("Could not load the sticky session of %s: %s", ss.host, err.Error())
+	}
+	i, exists := ss.index[upstream]
+	if !exists {
+		i = ss.next.pick(req)
+	}
+
+	// Storing the session each time keeps it alive while it is in use
+	if err := ss.state.set(req.Context(), key, ss.upstreams[i], ss.ttl); err != nil {
+		logger.Warn("Could not store the sticky session of %s: %s", ss.host, err.Error())
+	}
+	return i
+}
+
+// hashKey will return the function to extract the key used to hash the
+// request which is either ip (default), header:Name or cookie:Name
+func hashKey(key string) (func(*http.Request) string, error) {
+	switch {
+	case key == "" || key == "ip":
+		return requestRemoteIP, nil
+	case strings.HasPrefix(key, "header:"):
+		return namedValue("header", key[len("header:"):]), nil
+	case strings.HasPrefix(key, "cookie:"):
+		return namedValue("cookie", key[len("cookie:"):]), nil
+	}
+	return nil, fmt.Errorf("Unknown hash key: %s", key)
+}
@@ -0,0 +1,64 @@
+// Copyright 2016 Landonia Ltd. All rights reserved.
+
+package proxy
+
+import (
+	"sync"
+)
+
+const (
+	// DefaultBufferSize is the KB of each buffer used to copy the responses
+	DefaultBufferSize = 32
+	// fallbackBufferSize is used when the memory budget has been exhausted
+	// (or half the buffer size when the buffers are not larger)
+	fallbackBufferSize = 2 << 10
+)
+
+// bufferPool provides the buffers used by the reverse proxies to copy the
+// response bodies so a new buffer is not allocated for every request. The
+// buffers in use are reserved from the memory budget and when exhausted a
+// small buffer is used instead so the copy slows rather than fails. The
+// fallback buffers are never the size of the pooled buffers so that they
+// are not returned to the pool or released from the budget.
+type bufferPool struct {
+	size     int
+	fallback int
+	pool     sync.Pool
+	memory   *memoryConsumer
+}
+
+// newBufferPool will create the pool with the buffer size in KB
+func newBufferPool(kb int, budget *memoryBudget) *bufferPool {
+	if kb <= 0 {
+		kb = DefaultBufferSize
+	}
+	bp := &bufferPool{size: kb << 10, fallback: fallbackBufferSize}
+	if bp.fallback >= bp.size {
+		bp.fallback = bp.size / 2
+	}
+	bp.pool.New = func() interface{} {
+		b := make([]byte, bp.size)
+		return &b
+	}
+	bp.memory = budget.consumer("buffers")
+	return bp
+}
+
+// Get will return a buffer from the pool
+func (bp *bufferPool) Get() []byte {
+	if !bp.memory.reserve(int64(bp.size)) {
+		return make([]byte, bp.fallback)
+	}
+	return *(bp.pool.Get().(*[]byte))
+}
+
+// Put will return the buffer to the pool releasing it from the budget
+// (the fallback buffers are left to the garbage collector)
+func (bp *bufferPool) Put(b []byte) {
+	if cap(b) != bp.size {
+		return
+	}
+	bp.memory.release(int64(bp.size))
+	b = b[:bp.size]
+	bp.pool.Put(&b)
+}
@@ -0,0 +1,311 @@
+// Copyright 2016 Landonia Ltd. All rights reserved.
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	// dirCacheLockTimeout is how long a lock file is held before it is
+	// considered to have been left behind by a stopped node
+	dirCacheLockTimeout = 30 * time.Second
+)
+
+// CacheFactory will create a certificate cache using the configured options
+type CacheFactory func(options map[string]string) (autocert.Cache, error)
+
+var (
+	cachesMu sync.RWMutex
+	caches   = map[string]CacheFactory{
+		"dir":   newDirCache,
+		"http":  newHTTPCache,
+		"redis": newRedisCache,
+	}
+)
+
+// RegisterCache will make the certificate cache backend available using the
+// name. Sharing the cache between instances allows the certificates and the
+// ACME challenges to be shared. If the name has already been registered it
+// will panic.
+func RegisterCache(name string, factory CacheFactory) {
+	cachesMu.Lock()
+	defer cachesMu.Unlock()
+	if factory == nil {
+		panic("proxy: RegisterCache factory is nil")
+	}
+	if _, dup := caches[name]; dup {
+		panic("proxy: RegisterCache called twice for cache " + name)
+	}
+	caches[name] = factory
+}
+
+// newCertCache will create the configured certificate cache backend
+func newCertCache(config ACMEConfig) (autocert.Cache, error) {
+	cacheType := config.Cache.Type
+	if cacheType == "" {
+		cacheType = "dir"
+	}
+	options := config.Cache.Options
+	if cacheType == "dir" && options["dir"] == "" {
+		options = map[string]string{"dir": config.CacheDir}
+	}
+	return newCache(CacheConfig{Type: cacheType, Options: options})
+}
+
+// newCache will create the registered cache backend
+func newCache(config CacheConfig) (autocert.Cache, error) {
+	cachesMu.RLock()
+	factory, exists := caches[config.Type]
+	cachesMu.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("Unknown cache: %s", config.Type)
+	}
+	return factory(config.Options)
+}
+
+// casCache is implemented by the caches that can atomically replace an
+// entry allowing the nodes of a cluster to change the shared state without
+// overwriting each other
+type casCache interface {
+
+	// CompareAndSwap will store the data under the key only if the current
+	// entry is old (or missing when old is nil) returning false if it was not
+	CompareAndSwap(ctx context.Context, key string, old, data []byte) (bool, error)
+}
+
+// expiringCache is implemented by the caches that can remove the entries
+// once they expire
+type expiringCache interface {
+
+	// PutExpiring stores the data under the key until the ttl has passed
+	PutExpiring(ctx context.Context, key string, data []byte, ttl time.Duration) error
+}
+
+// putExpiring will store the entry until the ttl has passed when the cache
+// supports expiring entries (the entry must otherwise be deleted once it
+// is no longer required)
+func putExpiring(ctx context.Context, cache autocert.Cache, key string, data []byte, ttl time.Duration) error {
+	if ec, ok := cache.(expiringCache); ok {
+		return ec.PutExpiring(ctx, key, data, ttl)
+	}
+	return cache.Put(ctx, key, data)
+}
+
+// compareAndSwap will replace the entry if it has not changed. Caches that
+// cannot do this atomically are checked before and after the entry is
+// stored which narrows (but does not remove) the window for a conflict.
+func compareAndSwap(ctx context.Context, cache autocert.Cache, key string, old, data []byte) (bool, error) {
+	if cas, ok := cache.(casCache); ok {
+		return cas.CompareAndSwap(ctx, key, old, data)
+	}
+	if current, err := getEntry(ctx, cache, key); err != nil || !sameEntry(current, old) {
+		return false, err
+	}
+	if err := cache.Put(ctx, key, data); err != nil {
+		return false, err
+	}
+	current, err := getEntry(ctx, cache, key)
+	return err == nil && bytes.Equal(current, data), err
+}
+
+// getEntry will return the entry of the key (nil if it is missing)
+func getEntry(ctx context.Context, cache autocert.Cache, key string) ([]byte, error) {
+	b, err := cache.Get(ctx, key)
+	if err == autocert.ErrCacheMiss {
+		return nil, nil
+	}
+	return b, err
+}
+
+// sameEntry will return true if the entry matches the expected entry (where
+// nil expects the entry to be missing)
+func sameEntry(current, expected []byte) bool {
+	if current == nil || expected == nil {
+		return current == nil && expected == nil
+	}
+	return bytes.Equal(current, expected)
+}
+
+// newDirCache will create a cache using the local (or a shared) directory
+func newDirCache(options map[string]string) (autocert.Cache, error) {
+	dir := options["dir"]
+	if dir == "" {
+		dir = DefaultCertCacheDir
+	}
+	return &dirCache{DirCache: autocert.DirCache(dir), dir: dir}, nil
+}
+
+// dirCache is the directory cache which replaces the entries atomically by
+// holding a lock file (which also works when the directory is shared)
+type dirCache struct {
+	autocert.DirCache
+	dir string
+}
+
+// CompareAndSwap will store the data only if the current entry is old
+func (dc *dirCache) CompareAndSwap(ctx context.Context, key string, old, data []byte) (bool, error) {
+	if err := os.MkdirAll(dc.dir, 0700); err != nil {
+		return false, err
+	}
+	lock := filepath.Join(dc.dir, key+".lock")
+	for {
+		f, err := os.OpenFile(lock, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			f.Close()
+			break
+		} else if !os.IsExist(err) {
+			return false, err
+		}
+
+		// Remove the lock of a node that stopped while holding it
+		if info, err := os.Stat(lock); err == nil && time.Since(info.ModTime()) > dirCacheLockTimeout {
+			os.Remove(lock)
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	defer os.Remove(lock)
+	if current, err := getEntry(ctx, dc.DirCache, key); err != nil || !sameEntry(current, old) {
+		return false, err
+	}
+	return true, dc.DirCache.Put(ctx, key, data)
+}
+
+// httpCache will store the entries using a HTTP key/value store where each
+// key is a path relative to the base URL. GET returns the entry (404 when
+// missing), PUT stores the entry and DELETE removes it.
+type httpCache struct {
+	url    string
+	header http.Header
+	client *http.Client
+}
+
+// newHTTPCache will create a cache using the url and optional token options
+func newHTTPCache(options map[string]string) (autocert.Cache, error) {
+	u, err := url.Parse(options["url"])
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("The http cache requires a valid url option")
+	}
+	hc := &httpCache{
+		url:    strings.TrimRight(u.String(), "/") + "/",
+		header: make(http.Header),
+		client: &http.Client{},
+	}
+	if token := options["token"]; token != "" {
+		hc.header.Set("Authorization", "Bearer "+token)
+	}
+	return hc, nil
+}
+
+// do will perform the request for the key
+func (hc *httpCache) do(ctx context.Context, method, key string, body []byte, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, hc.url+url.PathEscape(key), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range hc.header {
+		req.Header[name] = values
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	return hc.client.Do(req.WithContext(ctx))
+}
+
+// Get returns the certificate data for the specified key
+func (hc *httpCache) Get(ctx context.Context, key string) ([]byte, error) {
+	resp, err := hc.do(ctx, http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return io.ReadAll(resp.Body)
+	case http.StatusNotFound:
+		return nil, autocert.ErrCacheMiss
+	}
+	return nil, fmt.Errorf("Could not get %s from the http cache: %s", key, resp.Status)
+}
+
+// Put stores the data in the cache under the specified key
+func (hc *httpCache) Put(ctx context.Context, key string, data []byte) error {
+	resp, err := hc.do(ctx, http.MethodPut, key, data, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Could not put %s into the http cache: %s", key, resp.Status)
+	}
+	return nil
+}
+
+// CompareAndSwap will store the data only if the current entry is old. The
+// entry is replaced using a conditional PUT (If-Match with the ETag of the
+// current entry or If-None-Match when it is missing) so the store should
+// reply with 412 Precondition Failed when the entry has changed.
+func (hc *httpCache) CompareAndSwap(ctx context.Context, key string, old, data []byte) (bool, error) {
+	resp, err := hc.do(ctx, http.MethodGet, key, nil, nil)
+	if err != nil {
+		return false, err
+	}
+	current, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	header := make(http.Header)
+	switch {
+	case err != nil:
+		return false, err
+	case resp.StatusCode == http.StatusNotFound:
+		if old != nil {
+			return false, nil
+		}
+		header.Set("If-None-Match", "*")
+	case resp.StatusCode != http.StatusOK:
+		return false, fmt.Errorf("Could not get %s from the http cache: %s", key, resp.Status)
+	case old == nil || !bytes.Equal(current, old):
+		return false, nil
+	case resp.Header.Get("ETag") != "":
+		header.Set("If-Match", resp.Header.Get("ETag"))
+	}
+	if resp, err = hc.do(ctx, http.MethodPut, key, data, header); err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return false, nil
+	} else if resp.StatusCode/100 != 2 {
+		return false, fmt.Errorf("Could not put %s into the http cache: %s", key, resp.Status)
+	}
+	return true, nil
+}
+
+// Delete removes a certificate data from the cache under the specified key
+func (hc *httpCache) Delete(ctx context.Context, key string) error {
+	resp, err := hc.do(ctx, http.MethodDelete, key, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("Could not delete %s from the http cache: %s", key, resp.Status)
+	}
+	return nil
+}
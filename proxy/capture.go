@@ -0,0 +1,508 @@
+// Copyright 2016 Landonia Ltd. All rights reserved.
+
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	// DefaultCaptureDir is the directory the HAR files are written to
+	DefaultCaptureDir = "./captures"
+
+	// DefaultCaptureCount is the number of requests captured when no count
+	// is provided
+	DefaultCaptureCount = 100
+
+	// DefaultCaptureMaxCount is the maximum number of requests a capture can
+	// record
+	DefaultCaptureMaxCount = 1000
+
+	// DefaultCaptureMaxBody is the KB of each body recorded
+	DefaultCaptureMaxBody = 64
+)
+
+// defaultCaptureRedact are the headers, cookies and query parameters that
+// are always redacted
+var defaultCaptureRedact = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// CaptureStatus describes a capture started using the admin server
+type CaptureStatus struct {
+	Host     string    `yaml:"host"`     // The host being captured
+	Count    int       `yaml:"count"`    // The number of requests to capture
+	Captured int       `yaml:"captured"` // The number of requests captured
+	Bodies   bool      `yaml:"bodies"`   // True if the bodies are recorded
+	Started  time.Time `yaml:"started"`  // When the capture was started
+	File     string    `yaml:"file"`     // The HAR file written once complete
+	Done     bool      `yaml:"done"`     // True once the HAR file has been written
+}
+
+// capture records the requests for a host until the count is reached
+type capture struct {
+	mu      sync.Mutex
+	status  CaptureStatus
+	entries []harEntry
+}
+
+// captures will record the requests and responses of a host into HAR files
+// when started from the admin server
+type captures struct {
+	conf   CaptureConfig
+	redact map[string]bool
+	mu     sync.RWMutex
+	active map[string]*capture // The running capture by host
+	done   []CaptureStatus     // The completed captures (most recent last)
+}
+
+// newCaptures will create the captures using the configuration
+func newCaptures(conf CaptureConfig) *captures {
+	if conf.Dir == "" {
+		conf.Dir = DefaultCaptureDir
+	}
+	if conf.MaxCount == 0 {
+		conf.MaxCount = DefaultCaptureMaxCount
+	}
+	if conf.MaxBody == 0 {
+		conf.MaxBody = DefaultCaptureMaxBody
+	}
+	c := &captures{conf: conf, redact: make(map[string]bool), active: make(map[string]*capture)}
+	for _, name := range append(defaultCaptureRedact, conf.Redact...) {
+		c.redact[strings.ToLower(name)] = true
+	}
+	return c
+}
+
+// start will start capturing the requests for the host
+func (c *captures) start(host string, count int, bodies bool) (CaptureStatus, error) {
+	if host == "" {
+		return CaptureStatus{}, fmt.Errorf("The host must be provided")
+	}
+	if count <= 0 {
+		count = DefaultCaptureCount
+	} else if count > c.conf.MaxCount {
+		return CaptureStatus{}, fmt.Errorf("The count cannot be more than %d", c.conf.MaxCount)
+	}
+	host = strings.ToLower(host)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, exists := c.active[host]; exists {
+		return CaptureStatus{}, fmt.Errorf("A capture is already running for %s", host)
+	}
+	now := time.Now()
+	name := fmt.Sprintf("%s-%s.har", strings.NewReplacer(":", "_", "/", "_").Replace(host), now.UTC().Format("20060102T150405Z"))
+	cp := &capture{status: CaptureStatus{
+		Host:    host,
+		Count:   count,
+		Bodies:  bodies,
+		Started: now,
+		File:    filepath.Join(c.conf.Dir, name),
+	}}
+	c.active[host] = cp
+	return cp.status, nil
+}
+
+// stop will stop the capture for the host writing the requests captured so
+// far to the HAR file
+func (c *captures) stop(host string) (CaptureStatus, error) {
+	c.mu.RLock()
+	cp, exists := c.active[strings.ToLower(host)]
+	c.mu.RUnlock()
+	if !exists {
+		return CaptureStatus{}, fmt.Errorf("No capture is running for %s", host)
+	}
+	return c.finish(cp)
+}
+
+// finish will write the HAR file for the capture (only the first call for
+// the capture writes the file)
+func (c *captures) finish(cp *capture) (CaptureStatus, error) {
+	c.mu.Lock()
+	if c.active[cp.status.Host] != cp {
+		c.mu.Unlock()
+		return cp.status, nil
+	}
+	delete(c.active, cp.status.Host)
+	c.mu.Unlock()
+	cp.mu.Lock()
+	cp.status.Done = true
+	status, entries := cp.status, cp.entries
+	cp.mu.Unlock()
+	err := writeHAR(status.File, entries)
+	c.mu.Lock()
+	c.done = append(c.done, status)
+	c.mu.Unlock()
+	if err != nil {
+		return status, fmt.Errorf("Could not write HAR file: %s", err.Error())
+	}
+	logger.Info("Captured %d requests for %s to %s", status.Captured, status.Host, status.File)
+	return status, nil
+}
+
+// list will return the status of the running and completed captures
+func (c *captures) list() []CaptureStatus {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	statuses := append([]CaptureStatus(nil), c.done...)
+	for _, cp := range c.active {
+		cp.mu.Lock()
+		statuses = append(statuses, cp.status)
+		cp.mu.Unlock()
+	}
+	return statuses
+}
+
+// middleware will record the requests for the hosts being captured
+func (c *captures) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		c.mu.RLock()
+		cp, exists := c.active[canonicalHost(req)]
+		c.mu.RUnlock()
+		if !exists {
+			next.ServeHTTP(resp, req)
+			return
+		}
+		maxBody := c.conf.MaxBody * 1024
+		var reqBody *limitedBuffer
+		if cp.status.Bodies && req.Body != nil && req.Body != http.NoBody {
+			reqBody = &limitedBuffer{max: maxBody}
+			req.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.TeeReader(req.Body, reqBody), req.Body}
+		}
+		entry := c.request(req)
+		rec := &captureRecorder{statusRecorder: statusRecorder{ResponseWriter: resp, status: http.StatusOK}}
+		if cp.status.Bodies {
+			rec.body = &limitedBuffer{max: maxBody}
+		}
+		start := time.Now()
+		next.ServeHTTP(rec, req)
+		elapsed := float64(time.Since(start).Microseconds()) / 1000
+		entry.StartedDateTime = start.Format(time.RFC3339Nano)
+		entry.Time = elapsed
+		entry.Timings = harTimings{Send: 0, Wait: elapsed, Receive: 0}
+		if reqBody != nil {
+			entry.Request.BodySize = reqBody.size
+			entry.Request.PostData = &harPostData{MimeType: req.Header.Get("Content-Type")}
+			entry.Request.PostData.Text, _, entry.Request.PostData.Comment = reqBody.text()
+		}
+		entry.Response = c.response(req, rec)
+
+		// Record the entry and write the file once the count has been reached
+		cp.mu.Lock()
+		full := cp.status.Done || cp.status.Captured >= cp.status.Count
+		if !full {
+			cp.entries = append(cp.entries, entry)
+			cp.status.Captured++
+			full = cp.status.Captured >= cp.status.Count
+		}
+		cp.mu.Unlock()
+		if full {
+			if _, err := c.finish(cp); err != nil {
+				logger.Error(err.Error())
+			}
+		}
+	})
+}
+
+// request will create the entry for the request
+func (c *captures) request(req *http.Request) harEntry {
+	u := *req.URL
+	u.Host = req.Host
+	u.Scheme = requestScheme(req)
+	query := u.Query()
+	var queryString []harNameValue
+	for name, values := range query {
+		for _, value := range values {
+			queryString = append(queryString, harNameValue{Name: name, Value: c.redactValue(name, value)})
+		}
+		if c.redact[strings.ToLower(name)] {
+			query.Set(name, RedactedValue)
+		}
+	}
+	u.RawQuery = query.Encode()
+	var cookies []harNameValue
+	for _, cookie := range req.Cookies() {
+		cookies = append(cookies, harNameValue{Name: cookie.Name, Value: c.redactCookie("Cookie", cookie)})
+	}
+	return harEntry{
+		Request: harRequest{
+			Method:      req.Method,
+			URL:         u.String(),
+			HTTPVersion: req.Proto,
+			Cookies:     nonNil(cookies),
+			Headers:     c.headers(req.Header),
+			QueryString: nonNil(queryString),
+			HeadersSize: -1,
+		},
+		Cache: struct{}{},
+	}
+}
+
+// response will create the response of the entry from the recorder
+func (c *captures) response(req *http.Request, rec *captureRecorder) harResponse {
+	var cookies []harNameValue
+	for _, cookie := range (&http.Response{Header: rec.Header()}).Cookies() {
+		cookies = append(cookies, harNameValue{Name: cookie.Name, Value: c.redactCookie("Set-Cookie", cookie)})
+	}
+	content := harContent{Size: rec.bytes, MimeType: rec.Header().Get("Content-Type")}
+	if rec.body != nil {
+		content.Text, content.Encoding, content.Comment = rec.body.text()
+	}
+	return harResponse{
+		Status:      rec.status,
+		StatusText:  http.StatusText(rec.status),
+		HTTPVersion: req.Proto,
+		Cookies:     nonNil(cookies),
+		Headers:     c.headers(rec.Header()),
+		Content:     content,
+		RedirectURL: rec.Header().Get("Location"),
+		HeadersSize: -1,
+		BodySize:    rec.bytes,
+	}
+}
+
+// headers will return the headers with the values redacted
+func (c *captures) headers(header http.Header) []harNameValue {
+	headers := []harNameValue{}
+	for name, values := range header {
+		for _, value := range values {
+			headers = append(headers, harNameValue{Name: name, Value: c.redactValue(name, value)})
+		}
+	}
+	return headers
+}
+
+// redactValue will return the redacted value if the name should be redacted
+func (c *captures) redactValue(name, value string) string {
+	if c.redact[strings.ToLower(name)] {
+		return RedactedValue
+	}
+	return value
+}
+
+// redactCookie will return the redacted value if the cookie or the header it
+// was sent in should be redacted
+func (c *captures) redactCookie(header string, cookie *http.Cookie) string {
+	return c.redactValue(header, c.redactValue(cookie.Name, cookie.Value))
+}
+
+// adminCaptures will list the captures, start a capture using the host,
+// count and bodies parameters, stop the capture for the host or write the
+// HAR file using the file parameter
+func (gm *Proxy) adminCaptures(resp http.ResponseWriter, req *http.Request) {
+	host := req.FormValue("host")
+	var err error
+	switch req.Method {
+	case http.MethodGet:
+		if file := req.FormValue("file"); file != "" {
+			gm.adminCaptureFile(resp, req, file)
+			return
+		}
+	case http.MethodPost:
+		if !adminCanAccess(req, host) {
+			http.Error(resp, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		count, _ := strconv.Atoi(req.FormValue("count"))
+		_, err = gm.captures.start(host, count, req.FormValue("bodies") == "true")
+	case http.MethodDelete:
+		if !adminCanAccess(req, host) {
+			http.Error(resp, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		_, err = gm.captures.stop(host)
+	default:
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var statuses []CaptureStatus
+	for _, status := range gm.captures.list() {
+		if adminCanAccess(req, status.Host) {
+			statuses = append(statuses, status)
+		}
+	}
+	b, err := yaml.Marshal(statuses)
+	if err != nil {
+		logger.Error("Could not marshal captures: %s", err.Error())
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/x-yaml")
+	resp.Write(b)
+}
+
+// adminCaptureFile will write the HAR file of a completed capture
+func (gm *Proxy) adminCaptureFile(resp http.ResponseWriter, req *http.Request, file string) {
+	for _, status := range gm.captures.list() {
+		if status.Done && filepath.Base(status.File) == file && adminCanAccess(req, status.Host) {
+			resp.Header().Set("Content-Type", "application/json")
+			resp.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(file))
+			http.ServeFile(resp, req, status.File)
+			return
+		}
+	}
+	http.NotFound(resp, req)
+}
+
+// writeHAR will write the entries to the HAR file
+func writeHAR(file string, entries []harEntry) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	var har struct {
+		Log harLog `json:"log"`
+	}
+	har.Log = harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: "gomost", Version: "1"},
+		Entries: entries,
+	}
+	if har.Log.Entries == nil {
+		har.Log.Entries = []harEntry{}
+	}
+	b, err := json.MarshalIndent(har, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, b, 0600)
+}
+
+// nonNil will return an empty slice rather than nil so that the HAR file
+// contains an empty array
+func nonNil(values []harNameValue) []harNameValue {
+	if values == nil {
+		return []harNameValue{}
+	}
+	return values
+}
+
+// captureRecorder records the response including the body (up to a limit)
+type captureRecorder struct {
+	statusRecorder
+	body *limitedBuffer
+}
+
+// Write will record the body
+func (r *captureRecorder) Write(b []byte) (int, error) {
+	if r.body != nil {
+		r.body.Write(b)
+	}
+	return r.statusRecorder.Write(b)
+}
+
+// limitedBuffer will keep the bytes written up to the maximum while counting
+// every byte
+type limitedBuffer struct {
+	bytes.Buffer
+	max  int
+	size int64
+}
+
+// Write will keep the bytes up to the maximum
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.size += int64(len(p))
+	if remaining := b.max - b.Len(); remaining > 0 {
+		if len(p) > remaining {
+			b.Buffer.Write(p[:remaining])
+		} else {
+			b.Buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// text will return the content as text (or base64 when binary), the
+// encoding and a comment when it was truncated
+func (b *limitedBuffer) text() (string, string, string) {
+	comment := ""
+	if b.size > int64(b.Len()) {
+		comment = fmt.Sprintf("truncated to %d of %d bytes", b.Len(), b.size)
+	}
+	if utf8.Valid(b.Bytes()) {
+		return b.String(), "", comment
+	}
+	return base64.StdEncoding.EncodeToString(b.Bytes()), "base64", comment
+}
+
+// The HAR 1.2 format (http://www.softwareishard.com/blog/har-12-spec/)
+type (
+	harLog struct {
+		Version string     `json:"version"`
+		Creator harCreator `json:"creator"`
+		Entries []harEntry `json:"entries"`
+	}
+	harCreator struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}
+	harEntry struct {
+		StartedDateTime string      `json:"startedDateTime"`
+		Time            float64     `json:"time"`
+		Request         harRequest  `json:"request"`
+		Response        harResponse `json:"response"`
+		Cache           struct{}    `json:"cache"`
+		Timings         harTimings  `json:"timings"`
+	}
+	harRequest struct {
+		Method      string         `json:"method"`
+		URL         string         `json:"url"`
+		HTTPVersion string         `json:"httpVersion"`
+		Cookies     []harNameValue `json:"cookies"`
+		Headers     []harNameValue `json:"headers"`
+		QueryString []harNameValue `json:"queryString"`
+		PostData    *harPostData   `json:"postData,omitempty"`
+		HeadersSize int            `json:"headersSize"`
+		BodySize    int64          `json:"bodySize"`
+	}
+	harResponse struct {
+		Status      int            `json:"status"`
+		StatusText  string         `json:"statusText"`
+		HTTPVersion string         `json:"httpVersion"`
+		Cookies     []harNameValue `json:"cookies"`
+		Headers     []harNameValue `json:"headers"`
+		Content     harContent     `json:"content"`
+		RedirectURL string         `json:"redirectURL"`
+		HeadersSize int            `json:"headersSize"`
+		BodySize    int64          `json:"bodySize"`
+	}
+	harNameValue struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+	harPostData struct {
+		MimeType string `json:"mimeType"`
+		Text     string `json:"text"`
+		Comment  string `json:"comment,omitempty"`
+	}
+	harContent struct {
+		Size     int64  `json:"size"`
+		MimeType string `json:"mimeType"`
+		Text     string `json:"text,omitempty"`
+		Encoding string `json:"encoding,omitempty"`
+		Comment  string `json:"comment,omitempty"`
+	}
+	harTimings struct {
+		Send    float64 `json:"send"`
+		Wait    float64 `json:"wait"`
+		Receive float64 `json:"receive"`
+	}
+)
@@ -0,0 +1,271 @@
+// Copyright 2016 Landonia Ltd. All rights reserved.
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// The check statuses
+const (
+	CheckPass = "pass"
+	CheckWarn = "warn"
+	CheckFail = "fail"
+)
+
+const (
+	// checkExpiryWarning is how long before a certificate expires that a
+	// warning is given
+	checkExpiryWarning = 14 * 24 * time.Hour
+	// checkUpstreamTimeout is how long an upstream has to respond
+	checkUpstreamTimeout = 10 * time.Second
+)
+
+// CheckResult is the outcome of a single self-test check
+type CheckResult struct {
+	Check  string `yaml:"check" json:"check"`   // What was checked (e.g. upstream, certificate or acme)
+	Target string `yaml:"target" json:"target"` // The upstream, file or URL checked
+	Status string `yaml:"status" json:"status"` // Either pass, warn or fail
+	Detail string `yaml:"detail" json:"detail"` // The reason for the status
+}
+
+// Check will connect to every configured upstream, verify the certificate
+// files and the reachability of the ACME directories. The checks are run
+// concurrently and the results returned in the order they were configured.
+func (gm *Proxy) Check(ctx context.Context) []CheckResult {
+	config := gm.Config()
+	var checks []func() CheckResult
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	// Every upstream the requests can be forwarded to (reached the same way
+	// as the requests are so any forward proxy, SOCKS5 proxy and protocol of
+	// the host is used)
+	upstream := func(route, target string, conf HostConfig) {
+		checks = append(checks, func() CheckResult {
+			return checkUpstream(ctx, conf, route, target)
+		})
+	}
+	for _, conf := range config.Proxies {
+		for _, host := range append([]string{conf.Host}, conf.Hosts...) {
+			if host != "" {
+				upstream("proxy "+conf.Proxy, host, conf)
+			}
+		}
+	}
+	for _, conf := range config.Rules {
+		if conf.Host != "" {
+			upstream("rule "+conf.Match, conf.Host, HostConfig{Host: conf.Host})
+		}
+	}
+	for _, conf := range config.WellKnown {
+		if conf.Upstream != "" {
+			upstream("wellknown "+conf.Path, conf.Upstream, HostConfig{Proxy: conf.Path, Host: conf.Upstream})
+		}
+	}
+	if config.DefaultProxy != "" {
+		upstream("default", config.DefaultProxy, HostConfig{Proxy: "*", Host: config.DefaultProxy})
+	}
+
+	// The certificate and CA files
+	if config.SSL.Default.CertFile != "" || config.SSL.Default.KeyFile != "" {
+		checks = append(checks, func() CheckResult {
+			return checkKeyPair("certificate", config.SSL.Default.CertFile, config.SSL.Default.KeyFile)
+		})
+	}
+	if config.Admin.TLS.CertFile != "" || config.Admin.TLS.KeyFile != "" {
+		checks = append(checks, func() CheckResult {
+			return checkKeyPair("admin certificate", config.Admin.TLS.CertFile, config.Admin.TLS.KeyFile)
+		})
+	}
+	if config.SSL.ClientAuth.CAFile != "" {
+		checks = append(checks, func() CheckResult {
+			return checkCAFile("client CA", config.SSL.ClientAuth.CAFile)
+		})
+	}
+	if config.SSL.LocalCA.Enable {
+		checks = append(checks, func() CheckResult {
+			return checkCAFile("local CA", filepath.Join(localCADir(config.SSL.LocalCA), LocalCACertFile))
+		})
+	}
+	if config.Admin.TLS.ClientCAFile != "" {
+		checks = append(checks, func() CheckResult {
+			return checkCAFile("admin client CA", config.Admin.TLS.ClientCAFile)
+		})
+	}
+
+	// The ACME directories used when the certificates are obtained automatically
+	if config.SSL.Default.CertFile == "" && !config.SSL.LocalCA.Enable && !config.SSL.DisableLetsEncrypt {
+		directories := []string{config.SSL.ACME.Directory}
+		for _, account := range config.SSL.ACME.Accounts {
+			directories = append(directories, account.Directory)
+		}
+		seen := make(map[string]bool)
+		for _, directory := range directories {
+			if directory == "" {
+				directory = acme.LetsEncryptURL
+			}
+			if !seen[directory] {
+				seen[directory] = true
+				d := directory
+				checks = append(checks, func() CheckResult {
+					return checkACMEDirectory(ctx, client, d)
+				})
+			}
+		}
+	}
+
+	results := make([]CheckResult, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check func() CheckResult) {
+			defer wg.Done()
+			results[i] = check()
+		}(i, check)
+	}
+	wg.Wait()
+	return results
+}
+
+// checkUpstream will request the root of the upstream using the transport
+// of the host. Any response other than a server error passes as the
+// upstream is reachable.
+func checkUpstream(ctx context.Context, conf HostConfig, route, target string) CheckResult {
+	result := CheckResult{Check: "upstream " + route, Target: target}
+	transport, err := newUpstreamTransport(conf)
+	if err != nil {
+		result.Status, result.Detail = CheckFail, err.Error()
+		return result
+	}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   checkUpstreamTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		result.Status, result.Detail = CheckFail, err.Error()
+		return result
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		result.Status, result.Detail = CheckFail, err.Error()
+		return result
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+	resp.Body.Close()
+	result.Status = CheckPass
+	if resp.StatusCode >= 500 {
+		result.Status = CheckWarn
+	}
+	result.Detail = fmt.Sprintf("%s in %s", resp.Status, time.Since(start).Round(time.Millisecond))
+	return result
+}
+
+// checkKeyPair will load the certificate and key and check that the
+// certificate has not expired
+func checkKeyPair(name, certFile, keyFile string) CheckResult {
+	result := CheckResult{Check: name, Target: certFile}
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		result.Status, result.Detail = CheckFail, err.Error()
+		return result
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		result.Status, result.Detail = CheckFail, err.Error()
+		return result
+	}
+	return checkExpiry(result, []*x509.Certificate{leaf})
+}
+
+// checkCAFile will load the CA certificates and check that none of them
+// have expired
+func checkCAFile(name, caFile string) CheckResult {
+	result := CheckResult{Check: name, Target: caFile}
+	b, err := os.ReadFile(caFile)
+	if err != nil {
+		result.Status, result.Detail = CheckFail, err.Error()
+		return result
+	}
+	var certs []*x509.Certificate
+	for block, rest := pem.Decode(b); block != nil; block, rest = pem.Decode(rest) {
+		if cert, err := x509.ParseCertificate(block.Bytes); err == nil && block.Type == "CERTIFICATE" {
+			certs = append(certs, cert)
+		}
+	}
+	if len(certs) == 0 {
+		result.Status, result.Detail = CheckFail, "no certificates found"
+		return result
+	}
+	return checkExpiry(result, certs)
+}
+
+// checkExpiry will set the status using the certificate that expires first
+func checkExpiry(result CheckResult, certs []*x509.Certificate) CheckResult {
+	first := certs[0]
+	for _, cert := range certs[1:] {
+		if cert.NotAfter.Before(first.NotAfter) {
+			first = cert
+		}
+	}
+	expires := first.NotAfter.UTC().Format(time.RFC3339)
+	switch {
+	case time.Now().After(first.NotAfter):
+		result.Status, result.Detail = CheckFail, fmt.Sprintf("%s expired on %s", first.Subject.CommonName, expires)
+	case time.Until(first.NotAfter) < checkExpiryWarning:
+		result.Status, result.Detail = CheckWarn, fmt.Sprintf("%s expires on %s", first.Subject.CommonName, expires)
+	default:
+		result.Status, result.Detail = CheckPass, fmt.Sprintf("%s valid until %s", first.Subject.CommonName, expires)
+	}
+	return result
+}
+
+// checkACMEDirectory will fetch the ACME directory
+func checkACMEDirectory(ctx context.Context, client *http.Client, directory string) CheckResult {
+	result := CheckResult{Check: "acme", Target: directory}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, directory, nil)
+	if err != nil {
+		result.Status, result.Detail = CheckFail, err.Error()
+		return result
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		result.Status, result.Detail = CheckFail, err.Error()
+		return result
+	}
+	defer resp.Body.Close()
+	var dir struct {
+		NewNonce string `json:"newNonce"`
+	}
+	if resp.StatusCode != http.StatusOK {
+		result.Status, result.Detail = CheckFail, resp.Status
+	} else if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&dir); err != nil || dir.NewNonce == "" {
+		result.Status, result.Detail = CheckFail, "not an ACME directory"
+	} else {
+		result.Status, result.Detail = CheckPass, "directory reachable"
+	}
+	return result
+}
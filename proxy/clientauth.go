@@ -0,0 +1,133 @@
+// Copyright 2016 Landonia Ltd. All rights reserved.
+
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// clientAuth will authorise the requests to hosts using the attributes of
+// the verified client certificate
+type clientAuth struct {
+	conf  ClientAuthConfig
+	pool  *x509.CertPool
+	rules map[string]ClientCertRule // The rules by (lower case) host
+}
+
+// newClientAuth will load the CA certificates used to verify the clients
+func newClientAuth(conf ClientAuthConfig) (*clientAuth, error) {
+	b, err := os.ReadFile(conf.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read client CA file: %s", err.Error())
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("No certificates found in client CA file: %s", conf.CAFile)
+	}
+	rules := make(map[string]ClientCertRule)
+	for _, rule := range conf.Hosts {
+		rules[strings.ToLower(rule.Host)] = rule
+	}
+	return &clientAuth{conf: conf, pool: pool, rules: rules}, nil
+}
+
+// configure will request the client certificates during the handshake. The
+// certificates are only verified if given so that hosts without any rules
+// (and the ACME challenges) continue to work without one.
+func (ca *clientAuth) configure(tlsConfig *tls.Config) {
+	tlsConfig.ClientCAs = ca.pool
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+}
+
+// middleware will reject any request to a host with rules that was not sent
+// with an authorised certificate and forward the verified subject. The rules
+// are matched using the canonical host so that they also apply to the
+// aliases and the www/apex counterparts of the hosts.
+func (ca *clientAuth) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+
+		// Never trust the value sent by the client
+		if ca.conf.SubjectHeader != "" {
+			req.Header.Del(ca.conf.SubjectHeader)
+		}
+		var cert *x509.Certificate
+		if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+			cert = req.TLS.VerifiedChains[0][0]
+		}
+		if rule, exists := ca.rules[canonicalHost(req)]; exists {
+			if cert == nil || !rule.allows(cert) {
+				http.Error(resp, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+		}
+		if cert != nil && ca.conf.SubjectHeader != "" {
+			req.Header.Set(ca.conf.SubjectHeader, cert.Subject.String())
+		}
+		next.ServeHTTP(resp, req)
+	})
+}
+
+// allows will return true if the certificate matches every condition of the
+// rule. A condition matches if any of its values match.
+func (rule ClientCertRule) allows(cert *x509.Certificate) bool {
+	if len(rule.Subject) > 0 && !matchName(cert.Subject, rule.Subject) {
+		return false
+	}
+	if len(rule.Issuer) > 0 && !matchName(cert.Issuer, rule.Issuer) {
+		return false
+	}
+	if len(rule.SAN) > 0 && !matchSAN(cert, rule.SAN) {
+		return false
+	}
+	return true
+}
+
+// matchName will return true if the name has any of the attributes which
+// are written as KEY=value (e.g. OU=Ops)
+func matchName(name pkix.Name, attrs []string) bool {
+	values := map[string][]string{
+		"CN":     {name.CommonName},
+		"O":      name.Organization,
+		"OU":     name.OrganizationalUnit,
+		"C":      name.Country,
+		"L":      name.Locality,
+		"ST":     name.Province,
+		"SERIAL": {name.SerialNumber},
+	}
+	for _, attr := range attrs {
+		i := strings.IndexByte(attr, '=')
+		if i < 0 {
+			continue
+		}
+		for _, v := range values[strings.ToUpper(strings.TrimSpace(attr[:i]))] {
+			if v != "" && v == strings.TrimSpace(attr[i+1:]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchSAN will return true if any of the subject alternative names match
+// which can use a leading wildcard for DNS names (e.g. *.example.com)
+func matchSAN(cert *x509.Certificate, sans []string) bool {
+	names := append([]string{}, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		names = append(names, u.String())
+	}
+	for _, san := range sans {
+		for _, name := range names {
+			if name == san || (strings.HasPrefix(san, "*.") && strings.HasSuffix(name, san[1:])) {
+				return true
+			}
+		}
+	}
+	return false
+}
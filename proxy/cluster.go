@@ -0,0 +1,234 @@
+// Copyright 2016 Landonia Ltd. All rights reserved.
+
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	// DefaultClusterInterval is the seconds between each cluster sync
+	DefaultClusterInterval = 10
+
+	// clusterStateKey is the key of the shared runtime state
+	clusterStateKey = "cluster+state"
+
+	// clusterPublishAttempts is the number of times a change is applied to
+	// the shared state before giving up when other nodes keep changing it
+	clusterPublishAttempts = 5
+)
+
+// clusterState is the runtime state shared between the nodes
+type clusterState struct {
+	Revision int64        `json:"revision"` // Incremented with every change
+	Node     string       `json:"node"`     // The node that made the last change
+	Proxies  []HostConfig `json:"proxies"`  // The proxies
+}
+
+// cluster will synchronise the runtime state of the proxy with the other
+// nodes using the shared store. Every node polls the store and applies any
+// newer revision, and publishes a new revision whenever a runtime change is
+// made locally. The store is also used as the certificate cache so renewed
+// certificates are available to every node, with a single elected leader
+// responsible for requesting and renewing the certificates.
+type cluster struct {
+	gm       *Proxy
+	node     string
+	store    autocert.Cache
+	interval time.Duration
+	mu       sync.Mutex           // Guards the revision while the state is synced or published
+	revision int64                // The revision of the applied state
+	leader   int32                // Set to 1 while this node holds the leader lease
+	failed   map[string]time.Time // The time each failed certificate can be requested again
+	stop     chan struct{}
+}
+
+// newCluster will create the cluster using the configured store
+func newCluster(gm *Proxy, conf ClusterConfig) (*cluster, error) {
+	if conf.Store.Type == "" {
+		return nil, fmt.Errorf("The cluster store type must be provided")
+	}
+	store, err := newCertCache(ACMEConfig{Cache: conf.Store})
+	if err != nil {
+		return nil, err
+	}
+	node := conf.Node
+	if node == "" {
+		if node, err = os.Hostname(); err != nil {
+			return nil, err
+		}
+	}
+	return &cluster{
+		gm:       gm,
+		node:     node,
+		store:    store,
+		interval: seconds(conf.Interval, DefaultClusterInterval),
+		failed:   make(map[string]time.Time),
+		stop:     make(chan struct{}),
+	}, nil
+}
+
+// certCache will return the cache used to share the certificates
+func (c *cluster) certCache() autocert.Cache {
+	return &prefixCache{prefix: "certs+", cache: c.store}
+}
+
+// start will begin polling the store until shutdown
+func (c *cluster) start() {
+	logger.Info("Joining cluster as node: %s", c.node)
+	c.tick()
+	go func() {
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-ticker.C:
+				c.tick()
+			}
+		}
+	}()
+}
+
+// tick will sync the state, elect the leader and (if this node is the
+// leader) request any pending certificates
+func (c *cluster) tick() {
+	c.sync()
+	ctx, cancel := context.WithTimeout(context.Background(), c.interval)
+	defer cancel()
+	c.elect(ctx)
+	if c.isLeader() {
+		c.issuePending(ctx)
+	}
+}
+
+// shutdown will stop polling the store
+func (c *cluster) shutdown(ctx context.Context) error {
+	close(c.stop)
+
+	// Release the lease so another node can take over the renewals
+	if c.isLeader() {
+		if lease, err := c.loadLease(ctx); err == nil && lease != nil && lease.Node == c.node {
+			return c.store.Delete(ctx, clusterLeaderKey)
+		}
+	}
+	return nil
+}
+
+// load will return the shared state (nil if it does not exist) along with
+// the stored entry which must be unchanged for a new revision to replace it
+func (c *cluster) load(ctx context.Context) (*clusterState, []byte, error) {
+	b, err := getEntry(ctx, c.store, clusterStateKey)
+	if err != nil || b == nil {
+		return nil, nil, err
+	}
+	state := &clusterState{}
+	return state, b, json.Unmarshal(b, state)
+}
+
+// sync will apply the shared state if it is newer than the local state
+func (c *cluster) sync() {
+	ctx, cancel := context.WithTimeout(context.Background(), c.interval)
+	defer cancel()
+	state, _, err := c.load(ctx)
+	if err != nil {
+		logger.Error("Could not load the cluster state: %s", err.Error())
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if state == nil || state.Revision <= c.revision {
+		return
+	}
+	logger.Info("Applying cluster state revision %d from node: %s", state.Revision, state.Node)
+	c.revision = state.Revision
+	c.gm.setProxies(state.Proxies)
+}
+
+// publish will apply the local change to the latest shared state and store
+// it as a new revision. The revision is only stored if the shared state has
+// not changed since it was loaded, otherwise the change is applied to the
+// newer state and stored again so that the changes made by other nodes at
+// the same time are not overwritten.
+func (c *cluster) publish(change func([]HostConfig) []HostConfig) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.interval)
+	defer cancel()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for attempt := 1; attempt <= clusterPublishAttempts; attempt++ {
+		state, current, err := c.load(ctx)
+		if err != nil {
+			logger.Error("Could not load the cluster state: %s", err.Error())
+			return
+		}
+
+		// The local proxies are shared when the state does not exist yet
+		revision, proxies := c.revision, c.gm.Config().Proxies
+		if state != nil {
+			proxies = state.Proxies
+			if state.Revision > revision {
+				revision = state.Revision
+			}
+		}
+		next := &clusterState{
+			Revision: revision + 1,
+			Node:     c.node,
+			Proxies:  change(append([]HostConfig(nil), proxies...)),
+		}
+		b, err := json.Marshal(next)
+		if err != nil {
+			logger.Error("Could not publish the cluster state: %s", err.Error())
+			return
+		}
+		swapped, err := compareAndSwap(ctx, c.store, clusterStateKey, current, b)
+		if err != nil {
+			logger.Error("Could not publish the cluster state: %s", err.Error())
+			return
+		} else if swapped {
+			c.revision = next.Revision
+			if state != nil {
+				c.gm.setProxies(next.Proxies)
+			}
+			return
+		}
+		logger.Debug("The cluster state changed while publishing revision %d (attempt %d)", next.Revision, attempt)
+	}
+	logger.Error("Could not publish the cluster state: it changed %d times while publishing", clusterPublishAttempts)
+}
+
+// setProxies will replace all the proxies with those provided
+func (gm *Proxy) setProxies(confs []HostConfig) {
+	proxies := make(map[string]http.Handler)
+	for _, conf := range confs {
+		if rp, err := gm.newProxyHandler(conf); err == nil {
+			proxies[strings.ToLower(conf.Proxy)] = rp
+		} else {
+			logger.Warn("Could not parse Host: %s", err.Error())
+		}
+	}
+	gm.mu.Lock()
+	previous := gm.proxies
+	gm.proxies = proxies
+	gm.config.Proxies = confs
+	gm.mu.Unlock()
+	for host := range proxies {
+		if _, exists := previous[host]; !exists {
+			gm.events.Publish(Event{Type: EventRouteAdded, Host: host, Route: "proxy " + host})
+		}
+	}
+	for host := range previous {
+		if _, exists := proxies[host]; !exists {
+			gm.events.Publish(Event{Type: EventRouteRemoved, Host: host, Route: "proxy " + host})
+		}
+	}
+}
@@ -5,34 +5,388 @@ package proxy
 import (
 	"bytes"
 	"os"
+	"reflect"
 
 	yaml "gopkg.in/yaml.v2"
 )
 
+const (
+	// RedactedValue is used in place of any secret values (and the redacted
+	// values within the captures)
+	RedactedValue = "<redacted>"
+	// DefaultLogLevel is the log level used when none has been configured
+	DefaultLogLevel = "info"
+)
+
 // Configuration wraps the settings required for the app
 type Configuration struct {
-	Prod      bool         `yaml:"prod"`     // Whether in production (this will change the SSL handler)
-	Addr      string       `yaml:"addr"`     // The host to locally bind
-	LogLevel  string       `yaml:"loglevel"` // The log level to use
-	StaticDir string       `yaml:"static"`   // The static hosts root directory
-	Proxies   []HostConfig `yaml:"proxies"`  // The proxy information
-	SSL       struct {
+	Prod         bool                `yaml:"prod"`         // Whether in production (this will change the SSL handler)
+	Addr         string              `yaml:"addr"`         // The host to locally bind
+	ReusePort    int                 `yaml:"reuseport"`    // The listeners to open using SO_REUSEPORT (one per CPU if -1)
+	LogLevel     string              `yaml:"loglevel"`     // The log level to use
+	LogFile      string              `yaml:"logfile"`      // The file the log is written to instead of stdout (not supported on windows)
+	StaticDir    string              `yaml:"static"`       // The static hosts root directory
+	StaticHosts  []StaticHostConfig  `yaml:"statichosts"`  // The explicitly configured static hosts
+	Proxies      []HostConfig        `yaml:"proxies"`      // The proxy information
+	DefaultProxy string              `yaml:"defaultproxy"` // The upstream for any host that is not routed (disabled if empty)
+	EchoHosts    []string            `yaml:"echohosts"`    // The hosts that echo back the request they receive (e.g. debug.localhost)
+	Rules        []RuleConfig        `yaml:"rules"`        // The expression routing rules
+	Scripts      []ScriptConfig      `yaml:"scripts"`      // The scripted request/response hooks
+	Plugins      []PluginConfig      `yaml:"plugins"`      // The plugins to enable
+	Files        []FileConfig        `yaml:"files"`        // The files served directly for the hosts
+	WellKnown    []WellKnownConfig   `yaml:"wellknown"`    // The /.well-known paths routed explicitly
+	Maintenance  []MaintenanceConfig `yaml:"maintenance"`  // The scheduled maintenance windows of hosts
+	Quotas       QuotasConfig        `yaml:"quotas"`       // The request and transfer quotas of hosts
+	OIDC         []OIDCConfig        `yaml:"oidc"`         // Require the users of hosts to sign in with an OIDC provider
+	Aliases      map[string][]string `yaml:"aliases"`      // The alternative hosts that are routed as the host
+	Webhooks     []WebhookConfig     `yaml:"webhooks"`     // The webhooks the events are sent to
+	Alerts       []AlertConfig       `yaml:"alerts"`       // The notifiers the events are sent to
+	SSL          struct {
 		RedirectHTTP struct {
 			Enable bool   `yaml:"enable"` // If true this will setup a second server to redirect HTTP -> HTTPS
 			Addr   string `yaml:"addr"`   // The address of the redirect
 		} `yaml:"redirecthttp"`
-		DisableLetsEncrypt bool `yaml:"disableletsencrypt"` // True if LetsEncrypt auto SSL should not be used
+		DisableLetsEncrypt bool             `yaml:"disableletsencrypt"` // True if LetsEncrypt auto SSL should not be used
+		ACME               ACMEConfig       `yaml:"acme"`               // The ACME account information
+		ClientAuth         ClientAuthConfig `yaml:"clientauth"`         // The client certificate (mTLS) information
+		LocalCA            LocalCAConfig    `yaml:"localca"`            // The local CA used to issue development certificates
 		Default            struct {
 			CertFile string `yaml:"certfile"` // The certfile path
 			KeyFile  string `yaml:"keyfile"`  // The keyfile path
 		} `yaml:"files"`
 	} `yaml:"ssl"` // The ssl information
+	Admin struct {
+		Addr        string            `yaml:"addr"`        // The address of the admin server (disabled if empty)
+		Trusted     []string          `yaml:"trusted"`     // The client IPs/CIDRs that can use the X-Gomost-Explain header
+		Credentials []AdminCredential `yaml:"credentials"` // The credentials allowed to use the admin server (open if empty)
+		Internal    bool              `yaml:"internal"`    // True if the admin server must be bound to a loopback or private address
+		TLS         AdminTLSConfig    `yaml:"tls"`         // The TLS information of the admin server
+		Capture     CaptureConfig     `yaml:"capture"`     // The request capture information
+	} `yaml:"admin"` // The admin information
+	AccessLog    string             `yaml:"accesslog"`    // The file to write the access log to (disabled if empty)
+	ErrorLogs    []ErrorLogConfig   `yaml:"errorlogs"`    // The files the errors of each host are written to
+	Fingerprint  FingerprintConfig  `yaml:"fingerprint"`  // The TLS fingerprint information
+	Strict       StrictConfig       `yaml:"strict"`       // The strict request parsing information
+	MemoryBudget int                `yaml:"memorybudget"` // The MB available to the caches and buffers (unlimited if 0)
+	BufferSize   int                `yaml:"buffersize"`   // The KB of each buffer used to copy the proxied responses
+	Cluster      ClusterConfig      `yaml:"cluster"`      // The cluster information
+	LoadShedding LoadSheddingConfig `yaml:"loadshedding"` // The load shedding information
+	State        StateConfig        `yaml:"state"`        // The store of the rate limits, bans and sticky sessions
+	Shutdown     struct {
+		DrainTimeout     int `yaml:"draintimeout"`     // The seconds to wait for in-flight requests before forcing connections closed
+		LongLivedTimeout int `yaml:"longlivedtimeout"` // The seconds to wait for websocket/event stream connections to finish
+	} `yaml:"shutdown"` // The shutdown information
+}
+
+// ACMEConfig information
+type ACMEConfig struct {
+	Email     string        `yaml:"email"`     // The email of the default account
+	Directory string        `yaml:"directory"` // The CA directory URL (LetsEncrypt by default)
+	EAB       EABConfig     `yaml:"eab"`       // The external account binding of the default account
+	CacheDir  string        `yaml:"cachedir"`  // The certificate cache directory
+	Cache     CacheConfig   `yaml:"cache"`     // The certificate cache backend (shared between instances)
+	Accounts  []ACMEAccount `yaml:"accounts"`  // The accounts to use for specific hosts
+}
+
+// ACMEAccount information allowing hosts to be issued certificates using
+// their own account
+type ACMEAccount struct {
+	Name      string    `yaml:"name"`      // The unique name used to store the account key
+	Email     string    `yaml:"email"`     // The email of the account
+	Directory string    `yaml:"directory"` // The CA directory URL (LetsEncrypt by default)
+	EAB       EABConfig `yaml:"eab"`       // The external account binding of the account
+	Hosts     []string  `yaml:"hosts"`     // The hosts that will use this account
+}
+
+// CacheConfig information for the cache backend used for the certificates
+// and the shared sessions
+type CacheConfig struct {
+	Type    string            `yaml:"type"`                  // The registered cache type (dir by default)
+	Options map[string]string `yaml:"options" secret:"true"` // The options passed to the cache
+}
+
+// ClusterConfig information for sharing the runtime state and certificates
+// between multiple instances
+type ClusterConfig struct {
+	Enable   bool        `yaml:"enable"`   // True if the instance should join the cluster
+	Node     string      `yaml:"node"`     // The unique name of the node (hostname by default)
+	Store    CacheConfig `yaml:"store"`    // The store shared by all the nodes
+	Interval int         `yaml:"interval"` // The seconds between checking the store for changes
+}
+
+// StateConfig information for the store of the rate limits, bans and sticky
+// sessions
+type StateConfig struct {
+	Type    string            `yaml:"type"`                  // The store: memory (default) or redis (shared by the replicas)
+	Options map[string]string `yaml:"options" secret:"true"` // The options of the store (the same as the redis cache)
+}
+
+// LoadSheddingConfig information for rejecting the lowest priority traffic
+// when the proxy is under resource pressure
+type LoadSheddingConfig struct {
+	Enable        bool           `yaml:"enable"`        // True if the load shedding is enabled
+	Interval      int            `yaml:"interval"`      // The milliseconds between each check
+	MaxGoroutines int            `yaml:"maxgoroutines"` // The goroutine threshold (ignored if 0)
+	MaxMemory     int            `yaml:"maxmemory"`     // The heap MB threshold (ignored if 0)
+	MaxInFlight   int            `yaml:"maxinflight"`   // The in-flight requests threshold (ignored if 0)
+	MaxLatency    int            `yaml:"maxlatency"`    // The average latency milliseconds threshold (ignored if 0)
+	Priorities    map[string]int `yaml:"priorities"`    // The priority of each host (0 by default, higher is shed last)
+}
+
+// WebhookConfig information for sending events to an external service
+type WebhookConfig struct {
+	URL      string            `yaml:"url"`                   // The URL the events are posted to
+	Events   []string          `yaml:"events"`                // The event types to send (all except the request events if empty)
+	Template string            `yaml:"template"`              // The payload template (the event as JSON if empty)
+	Headers  map[string]string `yaml:"headers" secret:"true"` // The headers sent with each request (e.g. Authorization)
+	Retries  int               `yaml:"retries"`               // The times a failed delivery is retried (3 by default, -1 to disable)
+	Timeout  int               `yaml:"timeout"`               // The milliseconds to wait for each delivery (5000 by default)
+}
+
+// AlertConfig information for sending events using a notifier
+type AlertConfig struct {
+	Type     string            `yaml:"type"`                  // The registered notifier (slack, email or pagerduty)
+	Events   []string          `yaml:"events"`                // The event types to send (all except the request events if empty)
+	Interval int               `yaml:"interval"`              // The minimum seconds between alerts for the same event type and host (300 by default)
+	Options  map[string]string `yaml:"options" secret:"true"` // The options passed to the notifier
+}
+
+// AdminTLSConfig information for serving the admin server using TLS
+// separately from the public ssl configuration
+type AdminTLSConfig struct {
+	CertFile          string `yaml:"certfile"`          // The certfile path
+	KeyFile           string `yaml:"keyfile"`           // The keyfile path
+	Reuse             bool   `yaml:"reuse"`             // True to reuse the main certificate when no files are provided
+	ClientCAFile      string `yaml:"clientcafile"`      // The CA certificates used to verify the client certificates
+	RequireClientCert bool   `yaml:"requireclientcert"` // True if every client must provide a verified certificate
+}
+
+// CaptureConfig information for the request captures started using the
+// admin server
+type CaptureConfig struct {
+	Dir      string   `yaml:"dir"`      // The directory the HAR files are written to (./captures by default)
+	MaxCount int      `yaml:"maxcount"` // The maximum requests a capture can record (1000 by default)
+	MaxBody  int      `yaml:"maxbody"`  // The KB of each body recorded (64 by default)
+	Redact   []string `yaml:"redact"`   // The headers, cookies and query parameters redacted (Authorization, Proxy-Authorization, Cookie and Set-Cookie are always redacted)
+}
+
+// AdminCredential information for authenticating the admin requests using a
+// bearer token, basic auth or a client certificate subject
+type AdminCredential struct {
+	Name     string   `yaml:"name"`                   // The name of the credential
+	Token    string   `yaml:"token" secret:"true"`    // The bearer token
+	Username string   `yaml:"username"`               // The basic auth username
+	Password string   `yaml:"password" secret:"true"` // The basic auth password (or bcrypt hash)
+	Subject  []string `yaml:"subject"`                // The client certificate subject attributes, any of which must match (e.g. OU=Ops)
+	Scopes   []string `yaml:"scopes"`                 // The endpoints that can be used (e.g. routes, proxies or * for all)
+	Role     string   `yaml:"role"`                   // Either read or write to also allow changes (required)
+	Hosts    []string `yaml:"hosts"`                  // The only hosts that can be viewed or changed (all if empty)
+}
+
+// StaticHostConfig information for serving the files of a host which takes
+// precedence over the directory named after the host within the static dir
+type StaticHostConfig struct {
+	Hosts   []string `yaml:"hosts"`   // The hosts serving the files
+	DocRoot string   `yaml:"docroot"` // The directory containing the files
+	Index   string   `yaml:"index"`   // The file served for a directory (index.html by default)
+	SPA     bool     `yaml:"spa"`     // True to serve the index for any path that is not a file
+	Cache   string   `yaml:"cache"`   // The Cache-Control header of the responses (e.g. public, max-age=3600)
+	Listing bool     `yaml:"listing"` // True to list the directories without an index
+	Deny    []string `yaml:"deny"`    // The path patterns that are never served (e.g. .git or *.bak)
+}
+
+// ErrorLogConfig information for writing the upstream errors, TLS failures
+// and 5xx responses of hosts to their own file
+type ErrorLogConfig struct {
+	Hosts []string `yaml:"hosts"` // The hosts writing to the file
+	File  string   `yaml:"file"`  // The file the errors are written to
+}
+
+// OIDCConfig information for requiring the users of hosts to sign in with
+// an OpenID Connect provider before the requests are passed on
+type OIDCConfig struct {
+	Hosts        []string          `yaml:"hosts"`                      // The hosts requiring authentication
+	Issuer       string            `yaml:"issuer"`                     // The issuer URL of the provider
+	ClientID     string            `yaml:"clientid"`                   // The client id registered with the provider
+	ClientSecret string            `yaml:"clientsecret" secret:"true"` // The client secret registered with the provider
+	Scopes       []string          `yaml:"scopes"`                     // The scopes requested (openid, email and profile by default)
+	CallbackPath string            `yaml:"callbackpath"`               // The path the provider redirects back to (/oauth2/callback by default)
+	SignOutPath  string            `yaml:"signoutpath"`                // The path that clears the session (/oauth2/sign_out by default)
+	CookieName   string            `yaml:"cookiename"`                 // The session cookie name (_gomost_auth by default)
+	CookieSecret string            `yaml:"cookiesecret" secret:"true"` // The secret the session cookie is encrypted with
+	CookieDomain string            `yaml:"cookiedomain"`               // The parent domain the session cookie is shared with (the host only by default)
+	Store        CacheConfig       `yaml:"store"`                      // The registered cache the sessions are stored in (within the cookie by default)
+	Session      int               `yaml:"session"`                    // The minutes each session lasts (720 by default)
+	Allow        []string          `yaml:"allow"`                      // The emails or @domains allowed (any user if empty)
+	Headers      map[string]string `yaml:"headers"`                    // The claim forwarded to the upstream by header (X-Forwarded-User: sub and X-Forwarded-Email: email by default)
+}
+
+// SOCKS5Config information
+type SOCKS5Config struct {
+	Addr     string `yaml:"addr"`                   // The host:port of the SOCKS5 proxy
+	Username string `yaml:"username"`               // The username if the proxy requires authentication
+	Password string `yaml:"password" secret:"true"` // The password if the proxy requires authentication
+}
+
+// FileConfig information for a file served directly by the proxy (such as
+// robots.txt or security.txt) without reaching the upstream
+type FileConfig struct {
+	Hosts       []string `yaml:"hosts"`       // The hosts serving the file (every host if empty)
+	Path        string   `yaml:"path"`        // The request path (e.g. /robots.txt)
+	Content     string   `yaml:"content"`     // The content of the file
+	File        string   `yaml:"file"`        // The local file to serve instead of the content
+	ContentType string   `yaml:"contenttype"` // The content type (from the path extension by default)
+}
+
+// WellKnownConfig information for routing a /.well-known path explicitly
+// rather than following the generic routing of the host
+type WellKnownConfig struct {
+	Hosts       []string `yaml:"hosts"`       // The hosts the path is routed for (every host if empty)
+	Path        string   `yaml:"path"`        // The path (and any path below it) e.g. /.well-known/apple-app-site-association
+	Upstream    string   `yaml:"upstream"`    // The upstream the requests are forwarded to
+	Dir         string   `yaml:"dir"`         // The directory the files are served from (relative to /.well-known)
+	ContentType string   `yaml:"contenttype"` // The content type of the files (from the extension or application/json by default)
+}
+
+// QuotasConfig information for the usage quotas of hosts
+type QuotasConfig struct {
+	File   string        `yaml:"file"`   // The file the usage is saved to so that it survives restarts
+	Limits []QuotaConfig `yaml:"limits"` // The quotas
+}
+
+// QuotaConfig information for a quota applied to each of the hosts
+type QuotaConfig struct {
+	Hosts    []string `yaml:"hosts"`    // The hosts the quota applies to (each host is counted separately)
+	Period   string   `yaml:"period"`   // Either day or month (calendar periods in UTC, default day)
+	Requests int64    `yaml:"requests"` // The maximum requests within the period (0 for no limit)
+	Transfer int64    `yaml:"transfer"` // The maximum megabytes received and sent within the period (0 for no limit)
+	Action   string   `yaml:"action"`   // Either reject (429), throttle or notify once exceeded (default reject)
+	Delay    int      `yaml:"delay"`    // The milliseconds each throttled request is delayed (default 1000)
+	Rate     int      `yaml:"rate"`     // The KB per second each throttled response is written at (default 64)
+}
+
+// MaintenanceConfig information for a scheduled maintenance window during
+// which the hosts respond with a 503 and a Retry-After header
+type MaintenanceConfig struct {
+	Hosts    []string `yaml:"hosts"`    // The hosts under maintenance
+	Start    string   `yaml:"start"`    // When the maintenance starts (RFC 3339 e.g. 2016-10-02T22:00:00Z)
+	Duration int      `yaml:"duration"` // The minutes the maintenance lasts
+	Template string   `yaml:"template"` // The html/template file of the maintenance page (a basic page by default)
+	Allow    []string `yaml:"allow"`    // The client IPs/CIDRs that can still use the hosts to verify them
+}
+
+// LocalCAConfig information for issuing the certificates of the hosts using
+// a local CA during development
+type LocalCAConfig struct {
+	Enable bool     `yaml:"enable"` // True if the certificates should be issued by the local CA
+	Dir    string   `yaml:"dir"`    // The directory the CA is created within (./localca by default)
+	Hosts  []string `yaml:"hosts"`  // The hosts (or wildcards such as *.dev.test) certificates are issued for (the configured hosts if empty)
+}
+
+// ClientAuthConfig information for verifying the client certificates and
+// authorising the requests to hosts using their attributes
+type ClientAuthConfig struct {
+	CAFile        string           `yaml:"cafile"`        // The CA certificates used to verify the clients (disabled if empty)
+	SubjectHeader string           `yaml:"subjectheader"` // The request header used to forward the verified subject
+	Hosts         []ClientCertRule `yaml:"hosts"`         // The hosts that require an authorised certificate
+}
+
+// ClientCertRule information for the certificates authorised for a host
+// where each value is matched if any of its entries match
+type ClientCertRule struct {
+	Host    string   `yaml:"host"`    // The host requiring a certificate
+	Subject []string `yaml:"subject"` // The subject attributes, any of which must match (e.g. OU=Ops)
+	Issuer  []string `yaml:"issuer"`  // The issuer attributes, any of which must match
+	SAN     []string `yaml:"san"`     // The subject alternative names, any of which must match
+}
+
+// FingerprintConfig information for capturing the JA3/JA4 fingerprints of
+// the TLS clients
+type FingerprintConfig struct {
+	Enable    bool   `yaml:"enable"`    // True if the fingerprints should be captured
+	JA3Header string `yaml:"ja3header"` // The request header used to forward the JA3 fingerprint
+	JA4Header string `yaml:"ja4header"` // The request header used to forward the JA4 fingerprint
+}
+
+// StrictConfig information for rejecting ambiguous requests that could be
+// used to smuggle requests past a proxy
+type StrictConfig struct {
+	Enable         bool `yaml:"enable"`         // True if the requests should be strictly checked
+	MaxHeaderBytes int  `yaml:"maxheaderbytes"` // The maximum size of the request head
+}
+
+// EABConfig information required by CAs that use external account binding
+type EABConfig struct {
+	KeyID   string `yaml:"keyid"`                 // The key identifier provided by the CA
+	HMACKey string `yaml:"hmackey" secret:"true"` // The base64url encoded HMAC key provided by the CA
 }
 
 // HostConfig information
 type HostConfig struct {
-	Proxy string `yaml:"proxy"`
-	Host  string `yaml:"host"`
+	Proxy    string   `yaml:"proxy"`
+	Host     string   `yaml:"host"`
+	Hosts    []string `yaml:"hosts"`    // Additional upstream hosts to balance the requests between
+	Strategy string   `yaml:"strategy"` // The balancing strategy: roundrobin (default) or hash
+	HashKey  string   `yaml:"hashkey"`  // The hash strategy key: ip (default), header:Name or cookie:Name
+	MaxConns int      `yaml:"maxconns"` // The maximum concurrent requests to the upstreams (unlimited if 0)
+	Queue    struct {
+		Depth   int `yaml:"depth"`   // The maximum requests waiting when at the limit (rejected immediately if 0)
+		Timeout int `yaml:"timeout"` // The milliseconds a request can wait before being rejected
+	} `yaml:"queue"` // The queue information
+	Sign         SignConfig      `yaml:"sign"`                       // Sign the requests sent to the upstreams
+	ForwardProxy string          `yaml:"forwardproxy" secret:"true"` // The HTTP proxy used to reach the upstreams (HTTP_PROXY/HTTPS_PROXY/NO_PROXY by default or direct)
+	SOCKS5       SOCKS5Config    `yaml:"socks5"`                     // The SOCKS5 proxy the upstreams are dialed through
+	Protocol     string          `yaml:"protocol"`                   // The protocol used to the upstreams: http1, http2 or h2c (HTTP/2 when negotiated using TLS by default)
+	RateLimit    RateLimitConfig `yaml:"ratelimit"`                  // Limit the requests of each client
+	Sticky       StickyConfig    `yaml:"sticky"`                     // Send the requests of a session to the same upstream
+}
+
+// RateLimitConfig information for limiting the requests of each client
+// within a window and banning the clients that keep exceeding the limit
+type RateLimitConfig struct {
+	Requests int    `yaml:"requests"` // The requests each client can make within the window (unlimited if 0)
+	Window   int    `yaml:"window"`   // The seconds of each window (60 by default)
+	Key      string `yaml:"key"`      // The key identifying the client: ip (default), header:Name or cookie:Name
+	Ban      struct {
+		After    int `yaml:"after"`    // Ban a client once this many requests have been rejected within the duration (disabled if 0)
+		Duration int `yaml:"duration"` // The seconds a client is banned for (3600 by default)
+	} `yaml:"ban"` // The ban information
+}
+
+// StickyConfig information for sending the requests of a session to the
+// upstream that handled the first request of the session
+type StickyConfig struct {
+	Cookie string `yaml:"cookie"` // The cookie identifying the session (disabled if empty)
+	TTL    int    `yaml:"ttl"`    // The seconds a session is kept since its last request (3600 by default)
+}
+
+// SignConfig information for signing the proxied requests with a shared
+// secret so that the upstream can reject requests that bypassed the proxy
+type SignConfig struct {
+	Secret  string `yaml:"secret" secret:"true"` // The shared secret (signing is disabled if empty)
+	Header  string `yaml:"header"`               // The header the signature is sent in (X-Gomost-Signature by default)
+	MaxBody int    `yaml:"maxbody"`              // The KB of a request body that can be signed (1024 by default, larger bodies are rejected with a 413)
+}
+
+// RuleConfig information for routing requests matching an expression
+type RuleConfig struct {
+	Match string `yaml:"match"` // The expression the request must match
+	Host  string `yaml:"host"`  // The host the request is forwarded to
+	File  string `yaml:"file"`  // The file served instead of forwarding (e.g. a closed page)
+}
+
+// ScriptConfig information for the Starlark request/response hooks
+type ScriptConfig struct {
+	File     string   `yaml:"file"`     // The Starlark script file
+	Hosts    []string `yaml:"hosts"`    // The hosts the script applies to (all if empty)
+	MaxSteps uint64   `yaml:"maxsteps"` // The maximum steps each hook can execute
+	Timeout  int      `yaml:"timeout"`  // The milliseconds each hook can execute for
+}
+
+// PluginConfig information
+type PluginConfig struct {
+	Name    string            `yaml:"name"`                  // The registered name of the plugin
+	Options map[string]string `yaml:"options" secret:"true"` // The options passed to the plugin
 }
 
 // DefaultConfig will return a sensible default configuration
@@ -47,6 +401,62 @@ func DefaultConfig() Configuration {
 	return conf
 }
 
+// Redacted will return a copy of the configuration with any field tagged
+// as `secret:"true"` masked so that it can be safely displayed
+func (c Configuration) Redacted() Configuration {
+	v := reflect.ValueOf(&c).Elem()
+	redact(v, false)
+	return c
+}
+
+// redact will walk the value masking any secret string values (any value
+// contained within a secret field is also treated as secret)
+func redact(v reflect.Value, secret bool) {
+	switch v.Kind() {
+	case reflect.String:
+		if secret && v.String() != "" {
+			v.SetString(RedactedValue)
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < v.NumField(); i++ {
+			redact(v.Field(i), secret || t.Field(i).Tag.Get("secret") == "true")
+		}
+	case reflect.Slice:
+		if v.IsNil() {
+			return
+		}
+
+		// Copy the slice so that the original is left untouched
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		reflect.Copy(c, v)
+		v.Set(c)
+		for i := 0; i < v.Len(); i++ {
+			redact(v.Index(i), secret)
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			return
+		}
+		c := reflect.MakeMapWithSize(v.Type(), v.Len())
+		for _, k := range v.MapKeys() {
+			e := reflect.New(v.Type().Elem()).Elem()
+			e.Set(v.MapIndex(k))
+			redact(e, secret)
+			c.SetMapIndex(k, e)
+		}
+		v.Set(c)
+	case reflect.Ptr:
+		if v.IsNil() {
+			return
+		}
+		e := reflect.New(v.Type().Elem())
+		e.Elem().Set(v.Elem())
+		redact(e.Elem(), secret)
+		v.Set(e)
+	}
+}
+
 // ParseFileConfig will return a new Configuration
 func ParseFileConfig(path string) (Configuration, error) {
 
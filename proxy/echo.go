@@ -0,0 +1,108 @@
+// Copyright 2016 Landonia Ltd. All rights reserved.
+
+package proxy
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// maxEchoBody is the number of bytes of the request body that are echoed
+const maxEchoBody = 64 * 1024
+
+// echoTLS describes the TLS connection of the echoed request
+type echoTLS struct {
+	Version       string   `json:"version"`
+	CipherSuite   string   `json:"cipherSuite"`
+	ServerName    string   `json:"serverName"`
+	Protocol      string   `json:"protocol"`
+	Resumed       bool     `json:"resumed"`
+	ClientSubject string   `json:"clientSubject,omitempty"`
+	ClientIssuer  string   `json:"clientIssuer,omitempty"`
+	ClientSANs    []string `json:"clientSANs,omitempty"`
+	JA3           string   `json:"ja3,omitempty"`
+	JA4           string   `json:"ja4,omitempty"`
+}
+
+// echoResponse is the request as received by the echo host
+type echoResponse struct {
+	Method     string              `json:"method"`
+	Host       string              `json:"host"`
+	URI        string              `json:"uri"`
+	Proto      string              `json:"proto"`
+	RemoteAddr string              `json:"remoteAddr"`
+	ClientIP   string              `json:"clientIP"`
+	Route      string              `json:"route"`
+	Headers    map[string][]string `json:"headers"`
+	Body       string              `json:"body,omitempty"`
+	BodySize   int64               `json:"bodySize"`
+	TLS        *echoTLS            `json:"tls,omitempty"`
+}
+
+// echo will write the request it received (after the middleware has been
+// applied) so that operators can see what would be forwarded to an upstream.
+// The credentials are redacted as they are within the captures.
+func (gm *Proxy) echo(resp http.ResponseWriter, req *http.Request) {
+	echo := echoResponse{
+		Method:     req.Method,
+		Host:       req.Host,
+		URI:        req.RequestURI,
+		Proto:      req.Proto,
+		RemoteAddr: req.RemoteAddr,
+		ClientIP:   requestRemoteIP(req),
+		Headers:    echoHeaders(req.Header, append(defaultCaptureRedact, gm.config.Admin.Capture.Redact...)),
+	}
+	if event, ok := req.Context().Value(routeContextKey{}).(Event); ok {
+		echo.Route = event.Route
+	}
+	if req.Body != nil {
+		body, _ := io.ReadAll(io.LimitReader(req.Body, maxEchoBody))
+		n, _ := io.Copy(io.Discard, req.Body)
+		echo.Body, echo.BodySize = string(body), int64(len(body))+n
+	}
+	if state := req.TLS; state != nil {
+		echo.TLS = &echoTLS{
+			Version:     tls.VersionName(state.Version),
+			CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+			ServerName:  state.ServerName,
+			Protocol:    state.NegotiatedProtocol,
+			Resumed:     state.DidResume,
+		}
+		if len(state.PeerCertificates) > 0 {
+			cert := state.PeerCertificates[0]
+			echo.TLS.ClientSubject = cert.Subject.String()
+			echo.TLS.ClientIssuer = cert.Issuer.String()
+			echo.TLS.ClientSANs = append(append([]string(nil), cert.DNSNames...), cert.EmailAddresses...)
+		}
+		echo.TLS.JA3, echo.TLS.JA4 = gm.Fingerprint(req)
+	}
+	b, err := json.MarshalIndent(echo, "", "  ")
+	if err != nil {
+		logger.Error("Could not marshal echo: %s", err.Error())
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Header().Set("Cache-Control", "no-store")
+	resp.Write(append(b, '\n'))
+}
+
+// echoHeaders will return a copy of the headers with the values of the
+// redacted headers replaced
+func echoHeaders(header http.Header, redact []string) map[string][]string {
+	redacted := make(map[string]bool)
+	for _, name := range redact {
+		redacted[strings.ToLower(name)] = true
+	}
+	headers := make(map[string][]string, len(header))
+	for name, values := range header {
+		if redacted[strings.ToLower(name)] {
+			values = []string{RedactedValue}
+		}
+		headers[name] = values
+	}
+	return headers
+}
@@ -0,0 +1,114 @@
+// Copyright 2016 Landonia Ltd. All rights reserved.
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tlsHandshakeError is the prefix of the handshake errors logged by the server
+const tlsHandshakeError = "http: TLS handshake error from "
+
+// errorLogs will write the upstream errors, TLS failures and 5xx responses
+// of each host to its own file in addition to the global log
+type errorLogs struct {
+	*eventWorker
+	files       map[string]*logFile // The files by host
+	all         []*logFile          // Every file (a file can be shared by hosts)
+	mu          sync.Mutex
+	serverNames map[string]string // The requested server name by remote address
+}
+
+// newErrorLogs will open the error log files
+func newErrorLogs(confs []ErrorLogConfig, events *Events) (*errorLogs, error) {
+	el := &errorLogs{files: make(map[string]*logFile), serverNames: make(map[string]string)}
+	for _, conf := range confs {
+		lf, err := openLogFile(conf.File)
+		if err != nil {
+			el.close(context.Background())
+			return nil, fmt.Errorf("Could not open error log: %s", err.Error())
+		}
+		el.all = append(el.all, lf)
+		for _, host := range conf.Hosts {
+			el.files[strings.ToLower(host)] = lf
+		}
+	}
+	el.eventWorker = newEventWorker(events, []string{string(EventCertFailed)}, func(event Event) {
+		el.log(event.Host, "tls", "Could not obtain certificate: "+event.Error)
+	})
+	return el, nil
+}
+
+// log will write the message to the error log of the host (if any)
+func (el *errorLogs) log(host, kind, msg string) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if lf, exists := el.files[strings.ToLower(host)]; exists {
+		lf.write(fmt.Sprintf("%s [%s] %s: %s\n", time.Now().Format(time.RFC3339), kind, host, msg))
+	}
+}
+
+// captureServerName will record the server name requested by the client so
+// that any handshake failure can be attributed to the host
+func (el *errorLogs) captureServerName(hello *tls.ClientHelloInfo) {
+	if hello.Conn != nil && hello.ServerName != "" {
+		el.mu.Lock()
+		el.serverNames[hello.Conn.RemoteAddr().String()] = hello.ServerName
+		el.mu.Unlock()
+	}
+}
+
+// connState will remove the server name once the connection has closed
+func (el *errorLogs) connState(c net.Conn, state http.ConnState) {
+	if state == http.StateClosed || state == http.StateHijacked {
+		el.mu.Lock()
+		delete(el.serverNames, c.RemoteAddr().String())
+		el.mu.Unlock()
+	}
+}
+
+// Write is used as the error log of the server to write the TLS handshake
+// errors to the error log of the host before writing them to the global log
+func (el *errorLogs) Write(b []byte) (int, error) {
+	line := strings.TrimSpace(string(b))
+	if i := strings.Index(line, tlsHandshakeError); i >= 0 {
+		rest := line[i+len(tlsHandshakeError):]
+		if j := strings.Index(rest, ": "); j >= 0 {
+			el.mu.Lock()
+			host, exists := el.serverNames[rest[:j]]
+			delete(el.serverNames, rest[:j])
+			el.mu.Unlock()
+			if exists {
+				el.log(host, "tls", "Handshake failed from "+rest)
+			}
+		}
+	}
+	return log.Writer().Write(b)
+}
+
+// reopen will reopen every error log file
+func (el *errorLogs) reopen() error {
+	for _, lf := range el.all {
+		if err := lf.reopen(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// close will close every error log file
+func (el *errorLogs) close(ctx context.Context) error {
+	for _, lf := range el.all {
+		lf.close()
+	}
+	return nil
+}
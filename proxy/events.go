@@ -0,0 +1,202 @@
+// Copyright 2016 Landonia Ltd. All rights reserved.
+
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventType identifies the type of an event
+type EventType string
+
+// The events published by the proxy
+const (
+	EventRequestStarted   EventType = "request.started"   // A request has been routed
+	EventRequestCompleted EventType = "request.completed" // A request has been handled
+	EventUpstreamFailed   EventType = "upstream.failed"   // An upstream could not be reached
+	EventUpstreamDown     EventType = "upstream.down"     // The upstream of a route has started failing
+	EventUpstreamUp       EventType = "upstream.up"       // The upstream of a route has recovered
+	EventRouteAdded       EventType = "route.added"       // A handler or proxy has been added
+	EventRouteRemoved     EventType = "route.removed"     // A proxy has been removed
+	EventCertRenewed      EventType = "cert.renewed"      // A new certificate is being served for a host
+	EventCertFailed       EventType = "cert.failed"       // A certificate could not be obtained for a host
+	EventBanApplied       EventType = "ban.applied"       // A client has been banned by the rate limiter (or a plugin)
+	EventQuotaExceeded    EventType = "quota.exceeded"    // A host has exceeded a quota within the period
+)
+
+const (
+	// eventWorkerBuffer is the number of events queued for each worker
+	eventWorkerBuffer = 100
+)
+
+// Event is published on the event bus
+type Event struct {
+	Type     EventType     `json:"type"`               // The type of event
+	Time     time.Time     `json:"time"`               // When the event occurred
+	Host     string        `json:"host,omitempty"`     // The host the event relates to
+	Route    string        `json:"route,omitempty"`    // The route type and name (e.g. proxy www.dev1.com)
+	Upstream string        `json:"upstream,omitempty"` // The upstream address
+	Status   int           `json:"status,omitempty"`   // The response status
+	Duration time.Duration `json:"duration,omitempty"` // The time taken to handle the request
+	Error    string        `json:"error,omitempty"`    // The error that caused the event
+	Detail   string        `json:"detail,omitempty"`   // Any additional information
+	Request  *http.Request `json:"-"`                  // The request (only for the request events)
+}
+
+// Events is the bus that events are published on. Events are delivered to
+// each subscriber without blocking the proxy so they are dropped when a
+// subscriber does not keep up.
+type Events struct {
+	mu          sync.RWMutex
+	subscribers map[*Subscription]struct{}
+	count       int32 // The number of subscribers
+}
+
+// Subscription receives the events it is subscribed to on C until closed
+type Subscription struct {
+	C       <-chan Event
+	c       chan Event
+	types   map[EventType]bool
+	dropped int64
+	events  *Events
+	once    sync.Once
+}
+
+// newEvents will create the event bus
+func newEvents() *Events {
+	return &Events{subscribers: make(map[*Subscription]struct{})}
+}
+
+// Events will return the event bus allowing embedders and plugins to
+// subscribe to (or publish) events
+func (gm *Proxy) Events() *Events {
+	return gm.events
+}
+
+// Subscribe will return a subscription to the event types (every type if
+// none are provided) with a channel buffering the number of events
+func (e *Events) Subscribe(buffer int, types ...EventType) *Subscription {
+	c := make(chan Event, buffer)
+	s := &Subscription{C: c, c: c, events: e}
+	if len(types) > 0 {
+		s.types = make(map[EventType]bool)
+		for _, t := range types {
+			s.types[t] = true
+		}
+	}
+	e.mu.Lock()
+	e.subscribers[s] = struct{}{}
+	atomic.AddInt32(&e.count, 1)
+	e.mu.Unlock()
+	return s
+}
+
+// Publish will deliver the event to the subscribers
+func (e *Events) Publish(event Event) {
+	if atomic.LoadInt32(&e.count) == 0 {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	for s := range e.subscribers {
+		if s.types != nil && !s.types[event.Type] {
+			continue
+		}
+		select {
+		case s.c <- event:
+		default:
+			atomic.AddInt64(&s.dropped, 1)
+		}
+	}
+}
+
+// active will return true if there are any subscribers
+func (e *Events) active() bool {
+	return atomic.LoadInt32(&e.count) > 0
+}
+
+// Dropped will return the number of events dropped as the channel was full
+func (s *Subscription) Dropped() int64 {
+	return atomic.LoadInt64(&s.dropped)
+}
+
+// Close will stop the events being delivered and close the channel
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		s.events.mu.Lock()
+		delete(s.events.subscribers, s)
+		atomic.AddInt32(&s.events.count, -1)
+		s.events.mu.Unlock()
+		close(s.c)
+	})
+}
+
+// operationalEvents are sent by the webhooks and alerts when no events have
+// been configured (the request events are excluded as there is one for every
+// request)
+var operationalEvents = []EventType{EventUpstreamFailed, EventUpstreamDown, EventUpstreamUp, EventRouteAdded,
+	EventRouteRemoved, EventCertRenewed, EventCertFailed, EventBanApplied, EventQuotaExceeded}
+
+// eventWorker will handle the subscribed events in order on its own
+// goroutine so that slow deliveries never block the proxy
+type eventWorker struct {
+	events *Events
+	types  []EventType
+	handle func(Event)
+	sub    *Subscription
+	wg     sync.WaitGroup
+	stop   chan struct{} // Closed when the shutdown has expired
+}
+
+// newEventWorker will create the worker for the configured event types
+// (the operational events if none are configured)
+func newEventWorker(events *Events, names []string, handle func(Event)) *eventWorker {
+	types := operationalEvents
+	if len(names) > 0 {
+		types = make([]EventType, len(names))
+		for i, name := range names {
+			types[i] = EventType(name)
+		}
+	}
+	return &eventWorker{events: events, types: types, handle: handle, stop: make(chan struct{})}
+}
+
+// start will subscribe to the events and handle them until shutdown
+func (w *eventWorker) start() {
+	w.sub = w.events.Subscribe(eventWorkerBuffer, w.types...)
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		for event := range w.sub.C {
+			w.handle(event)
+		}
+	}()
+}
+
+// shutdown will stop the subscription and wait for the queued events to be
+// handled (or the context to expire)
+func (w *eventWorker) shutdown(ctx context.Context) error {
+	if w.sub == nil {
+		return nil
+	}
+	w.sub.Close()
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		close(w.stop)
+		return ctx.Err()
+	}
+}
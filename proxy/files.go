@@ -0,0 +1,85 @@
+// Copyright 2016 Landonia Ltd. All rights reserved.
+
+package proxy
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// injectedFile is a file served directly by the proxy
+type injectedFile struct {
+	contentType string
+	content     []byte
+}
+
+// injectedFiles will serve the configured files (such as robots.txt and the
+// /.well-known files) before the requests reach the host handlers and proxies
+type injectedFiles struct {
+	byHost map[string]map[string]*injectedFile // The files by lowercase host then path
+	all    map[string]*injectedFile            // The files for every host by path
+}
+
+// newInjectedFiles will load the configured files
+func newInjectedFiles(confs []FileConfig) (*injectedFiles, error) {
+	files := &injectedFiles{
+		byHost: make(map[string]map[string]*injectedFile),
+		all:    make(map[string]*injectedFile),
+	}
+	for _, conf := range confs {
+		if conf.Path == "" || conf.Path[0] != '/' {
+			return nil, fmt.Errorf("The file path must start with '/': %q", conf.Path)
+		}
+		content := []byte(conf.Content)
+		if conf.File != "" {
+			b, err := os.ReadFile(conf.File)
+			if err != nil {
+				return nil, fmt.Errorf("Could not read file %s: %s", conf.File, err.Error())
+			}
+			content = b
+		}
+		f := &injectedFile{contentType: conf.ContentType, content: content}
+		if f.contentType == "" {
+			if f.contentType = mime.TypeByExtension(path.Ext(conf.Path)); f.contentType == "" {
+				f.contentType = "text/plain; charset=utf-8"
+			}
+		}
+		if len(conf.Hosts) == 0 {
+			files.all[conf.Path] = f
+		}
+		for _, host := range conf.Hosts {
+			host = strings.ToLower(host)
+			if files.byHost[host] == nil {
+				files.byHost[host] = make(map[string]*injectedFile)
+			}
+			files.byHost[host][conf.Path] = f
+		}
+	}
+	return files, nil
+}
+
+// middleware will serve the file if one has been configured for the host
+// and path otherwise the request is passed on
+func (files *injectedFiles) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		f, exists := files.byHost[canonicalHost(req)][req.URL.Path]
+		if !exists {
+			f, exists = files.all[req.URL.Path]
+		}
+		if !exists || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+			next.ServeHTTP(resp, req)
+			return
+		}
+		resp.Header().Set("Content-Type", f.contentType)
+		resp.Header().Set("Content-Length", strconv.Itoa(len(f.content)))
+		resp.WriteHeader(http.StatusOK)
+		if req.Method != http.MethodHead {
+			resp.Write(f.content)
+		}
+	})
+}
@@ -0,0 +1,232 @@
+// Copyright 2016 Landonia Ltd. All rights reserved.
+
+package proxy
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// TLS extension identifiers that are treated specially by JA4
+const (
+	extServerName = 0x0000
+	extALPN       = 0x0010
+)
+
+// tlsFingerprint is the fingerprint of the ClientHello of a connection
+type tlsFingerprint struct {
+	ja3 string
+	ja4 string
+}
+
+// fingerprints will capture the ClientHello fingerprints of the connections
+// so that bot frameworks rotating their IPs can still be identified
+type fingerprints struct {
+	mu    sync.RWMutex
+	conns map[string]tlsFingerprint // The fingerprints by remote address
+}
+
+// newFingerprints will create the store of connection fingerprints
+func newFingerprints() *fingerprints {
+	return &fingerprints{conns: make(map[string]tlsFingerprint)}
+}
+
+// capture will record the fingerprint of each ClientHello
+func (f *fingerprints) capture(hello *tls.ClientHelloInfo) {
+	if hello.Conn != nil {
+		fp := tlsFingerprint{ja3: ja3(hello), ja4: ja4(hello)}
+		f.mu.Lock()
+		f.conns[hello.Conn.RemoteAddr().String()] = fp
+		f.mu.Unlock()
+	}
+}
+
+// connState will remove the fingerprint once the connection has closed
+func (f *fingerprints) connState(c net.Conn, state http.ConnState) {
+	if state == http.StateClosed || state == http.StateHijacked {
+		f.mu.Lock()
+		delete(f.conns, c.RemoteAddr().String())
+		f.mu.Unlock()
+	}
+}
+
+// get will return the fingerprint of the connection the request was sent on
+func (f *fingerprints) get(req *http.Request) (tlsFingerprint, bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	fp, exists := f.conns[req.RemoteAddr]
+	return fp, exists
+}
+
+// Fingerprint will return the JA3 and JA4 fingerprints of the TLS client
+// that sent the request (empty if fingerprinting is disabled or the request
+// was not sent using TLS)
+func (gm *Proxy) Fingerprint(req *http.Request) (ja3, ja4 string) {
+	if gm.fingerprints == nil {
+		return "", ""
+	}
+	fp, _ := gm.fingerprints.get(req)
+	return fp.ja3, fp.ja4
+}
+
+// isGREASE will return true if the value is a reserved GREASE value which
+// clients send randomly so must be ignored
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// ja3 will return the JA3 fingerprint which is the MD5 of the version,
+// ciphers, extensions, curves and point formats in the order sent
+func ja3(hello *tls.ClientHelloInfo) string {
+	version := uint16(0)
+	for _, v := range hello.SupportedVersions {
+		if !isGREASE(v) && v > version {
+			version = v
+		}
+	}
+
+	// TLS 1.3 clients send the TLS 1.2 legacy version
+	if version > tls.VersionTLS12 {
+		version = tls.VersionTLS12
+	}
+	curves := make([]uint16, len(hello.SupportedCurves))
+	for i, c := range hello.SupportedCurves {
+		curves[i] = uint16(c)
+	}
+	points := make([]uint16, len(hello.SupportedPoints))
+	for i, p := range hello.SupportedPoints {
+		points[i] = uint16(p)
+	}
+	s := strconv.Itoa(int(version)) + "," +
+		joinDecimal(hello.CipherSuites) + "," +
+		joinDecimal(hello.Extensions) + "," +
+		joinDecimal(curves) + "," +
+		joinDecimal(points)
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// ja4 will return the JA4 fingerprint which unlike JA3 sorts the ciphers
+// and extensions so is not affected by clients randomising their order
+func ja4(hello *tls.ClientHelloInfo) string {
+	version := "00"
+	max := uint16(0)
+	for _, v := range hello.SupportedVersions {
+		if !isGREASE(v) && v > max {
+			max = v
+		}
+	}
+	switch max {
+	case tls.VersionTLS13:
+		version = "13"
+	case tls.VersionTLS12:
+		version = "12"
+	case tls.VersionTLS11:
+		version = "11"
+	case tls.VersionTLS10:
+		version = "10"
+	}
+	sni := "i"
+	if hello.ServerName != "" {
+		sni = "d"
+	}
+	alpn := "00"
+	if len(hello.SupportedProtos) > 0 && hello.SupportedProtos[0] != "" {
+		p := hello.SupportedProtos[0]
+		alpn = p[:1] + p[len(p)-1:]
+	}
+	ciphers := withoutGREASE(hello.CipherSuites)
+	extensions := withoutGREASE(hello.Extensions)
+	var hashed []uint16
+	for _, e := range extensions {
+		if e != extServerName && e != extALPN {
+			hashed = append(hashed, e)
+		}
+	}
+	sort.Slice(ciphers, func(i, j int) bool { return ciphers[i] < ciphers[j] })
+	sort.Slice(hashed, func(i, j int) bool { return hashed[i] < hashed[j] })
+	schemes := make([]uint16, len(hello.SignatureSchemes))
+	for i, s := range hello.SignatureSchemes {
+		schemes[i] = uint16(s)
+	}
+	ext := joinHex(hashed)
+	if len(schemes) > 0 {
+		ext += "_" + joinHex(schemes)
+	}
+	return fmt.Sprintf("t%s%s%02d%02d%s_%s_%s", version, sni, min(len(ciphers), 99),
+		min(len(extensions), 99), alpn, truncatedHash(joinHex(ciphers)), truncatedHash(ext))
+}
+
+// withoutGREASE will return a copy of the values without the GREASE values
+func withoutGREASE(values []uint16) []uint16 {
+	result := make([]uint16, 0, len(values))
+	for _, v := range values {
+		if !isGREASE(v) {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// joinDecimal will join the non GREASE values using a dash
+func joinDecimal(values []uint16) string {
+	parts := make([]string, 0, len(values))
+	for _, v := range values {
+		if !isGREASE(v) {
+			parts = append(parts, strconv.Itoa(int(v)))
+		}
+	}
+	return strings.Join(parts, "-")
+}
+
+// joinHex will join the values as 4 character hex using a comma
+func joinHex(values []uint16) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = fmt.Sprintf("%04x", v)
+	}
+	return strings.Join(parts, ",")
+}
+
+// truncatedHash will return the first 12 characters of the SHA256 hex
+func truncatedHash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// forwardFingerprint will add the fingerprints to the configured request
+// headers so they are available to the upstreams
+func (gm *Proxy) forwardFingerprint(next http.Handler) http.Handler {
+	conf := gm.config.Fingerprint
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+
+		// Never trust the values sent by the client
+		if conf.JA3Header != "" {
+			req.Header.Del(conf.JA3Header)
+		}
+		if conf.JA4Header != "" {
+			req.Header.Del(conf.JA4Header)
+		}
+		if fp, exists := gm.fingerprints.get(req); exists {
+			if conf.JA3Header != "" {
+				req.Header.Set(conf.JA3Header, fp.ja3)
+			}
+			if conf.JA4Header != "" {
+				req.Header.Set(conf.JA4Header, fp.ja4)
+			}
+		}
+		next.ServeHTTP(resp, req)
+	})
+}
@@ -0,0 +1,244 @@
+// Copyright 2016 Landonia Ltd. All rights reserved.
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	// clusterLeaderKey is the key of the leader lease
+	clusterLeaderKey = "cluster+leader"
+	// clusterPendingKey is the key of the hosts waiting for a certificate
+	clusterPendingKey = "cluster+pending"
+	// leaseIntervals is the number of sync intervals a lease is valid for
+	leaseIntervals = 3
+	// pendingRetryInterval is how long the leader waits before requesting a
+	// certificate that could not be obtained again
+	pendingRetryInterval = 10 * time.Minute
+)
+
+// leaderLease is held by the node responsible for the ACME renewals
+type leaderLease struct {
+	Node    string    `json:"node"`
+	Expires time.Time `json:"expires"`
+}
+
+// elect will acquire or renew the lease if it is free, expired or already
+// held by this node. The lease is replaced using a compare and swap so only
+// one of the nodes racing for an expired lease can acquire it.
+func (c *cluster) elect(ctx context.Context) {
+	b, err := getEntry(ctx, c.store, clusterLeaderKey)
+	lease := &leaderLease{}
+	if err == nil && b != nil {
+		err = json.Unmarshal(b, lease)
+	}
+	if err != nil {
+		logger.Error("Could not load the cluster leader: %s", err.Error())
+		c.setLeader(false)
+		return
+	}
+	now := time.Now()
+	if b != nil && lease.Node != c.node && now.Before(lease.Expires) {
+		c.setLeader(false)
+		return
+	}
+	next, _ := json.Marshal(&leaderLease{Node: c.node, Expires: now.Add(leaseIntervals * c.interval)})
+	swapped, err := compareAndSwap(ctx, c.store, clusterLeaderKey, b, next)
+	if err != nil {
+		logger.Error("Could not store the cluster leader: %s", err.Error())
+	}
+	c.setLeader(swapped)
+}
+
+// loadLease will return the current lease (nil if there is none)
+func (c *cluster) loadLease(ctx context.Context) (*leaderLease, error) {
+	b, err := c.store.Get(ctx, clusterLeaderKey)
+	if err == autocert.ErrCacheMiss {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	lease := &leaderLease{}
+	return lease, json.Unmarshal(b, lease)
+}
+
+// setLeader will record whether this node is the leader
+func (c *cluster) setLeader(leader bool) {
+	var value int32
+	if leader {
+		value = 1
+	}
+	if previous := atomic.SwapInt32(&c.leader, value); previous != value {
+		if leader {
+			logger.Info("Node %s is now the cluster leader", c.node)
+		} else {
+			logger.Info("Node %s is no longer the cluster leader", c.node)
+		}
+	}
+}
+
+// isLeader will return true if this node is responsible for ACME renewals
+func (c *cluster) isLeader() bool {
+	return atomic.LoadInt32(&c.leader) == 1
+}
+
+// issuePending will request the certificates for the hosts that the other
+// nodes have received requests for but could not find within the store.
+// Each host is only removed from the pending hosts once it has been issued
+// (so hosts added meanwhile are kept) and a host that failed is not tried
+// again until the retry interval has passed.
+func (c *cluster) issuePending(ctx context.Context) {
+	if c.gm.acme == nil {
+		return
+	}
+	hosts, _, err := c.loadPending(ctx)
+	if err != nil || len(hosts) == 0 {
+		return
+	}
+	issued := make(map[string]bool)
+	for _, host := range hosts {
+		if retry, failed := c.failed[host]; failed && time.Now().Before(retry) {
+			continue
+		}
+		logger.Info("Requesting certificate for %s on behalf of the cluster", host)
+		hello := &tls.ClientHelloInfo{
+			ServerName:   host,
+			CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		}
+		if _, err := c.gm.acme.manager(host).GetCertificate(hello); err != nil {
+			logger.Error("Could not get certificate for %s: %s", host, err.Error())
+			c.failed[host] = time.Now().Add(pendingRetryInterval)
+			continue
+		}
+		delete(c.failed, host)
+		issued[host] = true
+	}
+	if len(issued) == 0 {
+		return
+	}
+	err = c.updatePending(ctx, func(hosts []string) []string {
+		var remaining []string
+		for _, host := range hosts {
+			if !issued[host] {
+				remaining = append(remaining, host)
+			}
+		}
+		return remaining
+	})
+	if err != nil {
+		logger.Error("Could not update the pending certificates: %s", err.Error())
+	}
+}
+
+// requestCertificate will add the host to those waiting for the leader to
+// request a certificate
+func (c *cluster) requestCertificate(ctx context.Context, host string) error {
+	return c.updatePending(ctx, func(hosts []string) []string {
+		for _, h := range hosts {
+			if h == host {
+				return hosts
+			}
+		}
+		return append(hosts, host)
+	})
+}
+
+// updatePending will change the pending hosts using a compare and swap so
+// that the changes made by other nodes at the same time are not lost
+func (c *cluster) updatePending(ctx context.Context, change func([]string) []string) error {
+	for attempt := 0; attempt < clusterPublishAttempts; attempt++ {
+		hosts, current, err := c.loadPending(ctx)
+		if err != nil {
+			return err
+		}
+		b, _ := json.Marshal(change(hosts))
+		if swapped, err := compareAndSwap(ctx, c.store, clusterPendingKey, current, b); err != nil || swapped {
+			return err
+		}
+	}
+	return fmt.Errorf("The pending certificates changed %d times while updating", clusterPublishAttempts)
+}
+
+// loadPending will return the hosts waiting for a certificate along with
+// the stored entry (nil if there is none)
+func (c *cluster) loadPending(ctx context.Context) ([]string, []byte, error) {
+	b, err := getEntry(ctx, c.store, clusterPendingKey)
+	if err != nil || b == nil {
+		return nil, nil, err
+	}
+	var hosts []string
+	return hosts, b, json.Unmarshal(b, &hosts)
+}
+
+// followerCerts provides the certificates to nodes that are not the leader
+// directly from the store so they never request or renew certificates
+type followerCerts struct {
+	am    *acmeManager
+	c     *cluster
+	mu    sync.Mutex
+	certs map[string]*followerCert
+}
+
+// followerCert is a certificate loaded from the store
+type followerCert struct {
+	cert     *tls.Certificate
+	loadedAt time.Time
+}
+
+// GetCertificate will return the certificate from the store (reloading it
+// every sync interval to pick up any renewals made by the leader)
+func (fc *followerCerts) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	host := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if host == "" {
+		return nil, fmt.Errorf("Missing server name")
+	}
+	fc.mu.Lock()
+	cached := fc.certs[host]
+	fc.mu.Unlock()
+	if cached != nil && time.Since(cached.loadedAt) < fc.c.interval {
+		return cached.cert, nil
+	}
+	ctx, cancel := context.WithTimeout(hello.Context(), fc.c.interval)
+	defer cancel()
+	m := fc.am.manager(host)
+	if m.HostPolicy != nil {
+		if err := m.HostPolicy(ctx, host); err != nil {
+			return nil, err
+		}
+	}
+	b, err := m.Cache.Get(ctx, host)
+	if err == nil {
+		var cert tls.Certificate
+		if cert, err = tls.X509KeyPair(b, b); err == nil {
+			if cert.Leaf == nil {
+				cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+			}
+			if err == nil && time.Now().Before(cert.Leaf.NotAfter) {
+				fc.mu.Lock()
+				fc.certs[host] = &followerCert{cert: &cert, loadedAt: time.Now()}
+				fc.mu.Unlock()
+				return &cert, nil
+			}
+		}
+	}
+
+	// Use the previous certificate until the leader has renewed it
+	if cached != nil && time.Now().Before(cached.cert.Leaf.NotAfter) {
+		return cached.cert, nil
+	}
+	if err := fc.c.requestCertificate(ctx, host); err != nil {
+		logger.Error("Could not request certificate for %s: %s", host, err.Error())
+	}
+	return nil, fmt.Errorf("The certificate for %s has been requested from the cluster leader", host)
+}
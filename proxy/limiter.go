@@ -0,0 +1,77 @@
+// Copyright 2016 Landonia Ltd. All rights reserved.
+
+package proxy
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultQueueTimeout is the milliseconds a queued request will wait
+	DefaultQueueTimeout = 1000
+)
+
+// limiter will restrict the number of concurrent requests to the handler.
+// Once at the limit the requests are queued (up to the depth) until a slot
+// becomes available or the timeout expires and are otherwise rejected with
+// a 503 so short bursts are smoothed rather than failed.
+type limiter struct {
+	host    string
+	next    http.Handler
+	slots   chan struct{}
+	waiting int64
+	depth   int64
+	timeout time.Duration
+}
+
+// newLimiter will create the limiter for the host configuration
+func newLimiter(conf HostConfig, next http.Handler) *limiter {
+	timeout := conf.Queue.Timeout
+	if timeout <= 0 {
+		timeout = DefaultQueueTimeout
+	}
+	return &limiter{
+		host:    conf.Proxy,
+		next:    next,
+		slots:   make(chan struct{}, conf.MaxConns),
+		depth:   int64(conf.Queue.Depth),
+		timeout: time.Duration(timeout) * time.Millisecond,
+	}
+}
+
+// ServeHTTP will forward the request once a slot is available
+func (l *limiter) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	select {
+	case l.slots <- struct{}{}:
+	default:
+		if !l.wait(req) {
+			logger.Debug("Rejecting request to %s: at the concurrency limit", l.host)
+			resp.Header().Set("Retry-After", "1")
+			resp.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+	}
+	defer func() { <-l.slots }()
+	l.next.ServeHTTP(resp, req)
+}
+
+// wait will queue the request until a slot is available returning false if
+// the queue is full, the timeout expires or the client goes away
+func (l *limiter) wait(req *http.Request) bool {
+	if atomic.AddInt64(&l.waiting, 1) > l.depth {
+		atomic.AddInt64(&l.waiting, -1)
+		return false
+	}
+	defer atomic.AddInt64(&l.waiting, -1)
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+	case <-req.Context().Done():
+	}
+	return false
+}
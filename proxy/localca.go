@@ -0,0 +1,236 @@
+// Copyright 2016 Landonia Ltd. All rights reserved.
+
+package proxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultLocalCADir is the directory the local CA is created within
+	DefaultLocalCADir = "./localca"
+	// LocalCACertFile is the name of the local CA certificate file that
+	// must be trusted
+	LocalCACertFile = "rootCA.pem"
+	// localCAKeyFile is the name of the local CA key file
+	localCAKeyFile = "rootCA-key.pem"
+	// localCAValidity is how long the local CA is valid for
+	localCAValidity = 10 * 365 * 24 * time.Hour
+	// localCertValidity is how long each issued certificate is valid for
+	localCertValidity = 30 * 24 * time.Hour
+	// localCAMaxIssued is the most issued certificates that are kept
+	localCAMaxIssued = 1000
+)
+
+// localCA issues the certificates of the hosts on the fly using a CA that
+// is created locally so that HTTPS can be tested without a public domain
+type localCA struct {
+	cert   *x509.Certificate
+	key    crypto.Signer
+	hosts  []string                    // The hosts certificates can be issued for
+	routed func(host string) bool      // Whether the host is routed when no hosts are configured
+	mu     sync.Mutex                  // Guards the issued certificates
+	issued map[string]*tls.Certificate // The certificates by host
+}
+
+// InitLocalCA will create the local CA within the directory if it does not
+// exist and return the path of the CA certificate that must be trusted
+func InitLocalCA(conf LocalCAConfig) (string, error) {
+	if _, err := newLocalCA(conf); err != nil {
+		return "", err
+	}
+	return filepath.Abs(filepath.Join(localCADir(conf), LocalCACertFile))
+}
+
+// newLocalCA will load the local CA or create it if it does not exist
+func newLocalCA(conf LocalCAConfig) (*localCA, error) {
+	dir := localCADir(conf)
+	certFile, keyFile := filepath.Join(dir, LocalCACertFile), filepath.Join(dir, localCAKeyFile)
+	if _, err := os.Stat(certFile); os.IsNotExist(err) {
+		if err = createLocalCA(dir, certFile, keyFile); err != nil {
+			return nil, fmt.Errorf("Could not create local CA: %s", err.Error())
+		}
+		logger.Info("Created the local CA %s", certFile)
+	}
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Could not load local CA: %s", err.Error())
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse local CA: %s", err.Error())
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok || !cert.IsCA {
+		return nil, fmt.Errorf("The local CA %s is not a CA certificate", certFile)
+	}
+	return &localCA{cert: cert, key: key, hosts: conf.Hosts, issued: make(map[string]*tls.Certificate)}, nil
+}
+
+// localCADir will return the directory of the local CA
+func localCADir(conf LocalCAConfig) string {
+	if conf.Dir == "" {
+		return DefaultLocalCADir
+	}
+	return conf.Dir
+}
+
+// createLocalCA will generate the CA key and self-signed certificate
+func createLocalCA(dir, certFile, keyFile string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	name := "gomost"
+	if u, err := user.Current(); err == nil {
+		name += " " + u.Username
+	}
+	if host, err := os.Hostname(); err == nil {
+		name += "@" + host
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"gomost development CA"}, CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(localCAValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// GetCertificate will return the certificate of the requested host issuing
+// it when it has not been issued or is about to expire. Clients that do not
+// send a server name are given a certificate for localhost.
+func (ca *localCA) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	host := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if host == "" {
+		host = "localhost"
+	} else if !ca.allowed(host) {
+		return nil, fmt.Errorf("The local CA cannot issue a certificate for %s", host)
+	}
+	ca.mu.Lock()
+	cert, exists := ca.issued[host]
+	ca.mu.Unlock()
+	if exists && time.Until(cert.Leaf.NotAfter) > 24*time.Hour {
+		return cert, nil
+	}
+
+	// The key is generated without holding the lock so that the handshakes
+	// of the other hosts are not blocked
+	cert, err := ca.issue(host)
+	if err != nil {
+		return nil, fmt.Errorf("Could not issue local certificate for %s: %s", host, err.Error())
+	}
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	if len(ca.issued) >= localCAMaxIssued {
+		for h, c := range ca.issued {
+			if time.Until(c.Leaf.NotAfter) <= 24*time.Hour {
+				delete(ca.issued, h)
+			}
+		}
+		for h := range ca.issued {
+			if len(ca.issued) < localCAMaxIssued {
+				break
+			}
+			delete(ca.issued, h)
+		}
+	}
+	ca.issued[host] = cert
+	return cert, nil
+}
+
+// allowed will return true if the host is within the configured hosts
+// (which can be wildcards such as *.dev.test) or, when no hosts have been
+// configured, if the host is routed by the proxy
+func (ca *localCA) allowed(host string) bool {
+	if len(ca.hosts) == 0 {
+		return host == "localhost" || (ca.routed != nil && ca.routed(host))
+	}
+	for _, h := range ca.hosts {
+		h = strings.ToLower(h)
+		if h == host || (strings.HasPrefix(h, "*.") && strings.HasSuffix(host, h[1:])) {
+			return true
+		}
+	}
+	return false
+}
+
+// issue will create the certificate of the host signed by the local CA
+func (ca *localCA) issue(host string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"gomost development certificate"}, CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(localCertValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+	if host == "localhost" {
+		template.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der, ca.cert.Raw}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// randomSerial will return a random 128 bit certificate serial number
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
@@ -0,0 +1,113 @@
+// Copyright 2016 Landonia Ltd. All rights reserved.
+
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultMaintenanceTemplate is the page served when no template is provided
+const defaultMaintenanceTemplate = `<!DOCTYPE html>
+<html>
+<head><title>Down for maintenance</title></head>
+<body>
+<h1>Down for maintenance</h1>
+<p>{{.Host}} is undergoing scheduled maintenance and will be back by {{.End.Format "15:04 MST on Jan 2"}}.</p>
+</body>
+</html>
+`
+
+// maintenanceWindow is a period during which a host is unavailable
+type maintenanceWindow struct {
+	start    time.Time
+	end      time.Time
+	template *template.Template
+	allow    []*net.IPNet
+}
+
+// maintenancePage is the data the maintenance template is executed with
+type maintenancePage struct {
+	Host       string    // The requested host
+	Start      time.Time // When the maintenance started
+	End        time.Time // When the maintenance is expected to end
+	RetryAfter int       // The seconds until the maintenance ends
+}
+
+// maintenance will serve a 503 with a Retry-After header for the hosts
+// within a scheduled maintenance window
+type maintenance struct {
+	byHost map[string][]*maintenanceWindow // The windows by host
+}
+
+// newMaintenance will parse the scheduled maintenance windows
+func newMaintenance(confs []MaintenanceConfig) (*maintenance, error) {
+	m := &maintenance{byHost: make(map[string][]*maintenanceWindow)}
+	defaultTemplate := template.Must(template.New("maintenance").Parse(defaultMaintenanceTemplate))
+	for _, conf := range confs {
+		start, err := time.Parse(time.RFC3339, conf.Start)
+		if err != nil {
+			return nil, fmt.Errorf("The maintenance start must be an RFC 3339 time: %s", err.Error())
+		}
+		if conf.Duration <= 0 {
+			return nil, fmt.Errorf("The maintenance duration must be provided for %s", conf.Start)
+		}
+		w := &maintenanceWindow{
+			start:    start,
+			end:      start.Add(time.Duration(conf.Duration) * time.Minute),
+			template: defaultTemplate,
+		}
+		if conf.Template != "" {
+			if w.template, err = template.ParseFiles(conf.Template); err != nil {
+				return nil, fmt.Errorf("Could not parse maintenance template: %s", err.Error())
+			}
+		}
+		if w.allow, err = parseCIDRs(conf.Allow); err != nil {
+			return nil, fmt.Errorf("Could not parse maintenance allow address: %s", err.Error())
+		}
+		for _, host := range conf.Hosts {
+			host = strings.ToLower(host)
+			m.byHost[host] = append(m.byHost[host], w)
+		}
+	}
+	return m, nil
+}
+
+// middleware will serve the maintenance page for the hosts within a window
+// unless the client is allowed to verify the host
+func (m *maintenance) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		now := time.Now()
+		for _, w := range m.byHost[canonicalHost(req)] {
+			if now.Before(w.start) || !now.Before(w.end) || containsIP(w.allow, requestRemoteIP(req)) {
+				continue
+			}
+			retryAfter := int(math.Ceil(w.end.Sub(now).Seconds()))
+			var body bytes.Buffer
+			if err := w.template.Execute(&body, maintenancePage{
+				Host:       requestHost(req),
+				Start:      w.start,
+				End:        w.end,
+				RetryAfter: retryAfter,
+			}); err != nil {
+				logger.Error("Could not execute maintenance template: %s", err.Error())
+			}
+			resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+			resp.Header().Set("Cache-Control", "no-store")
+			resp.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			resp.WriteHeader(http.StatusServiceUnavailable)
+			if req.Method != http.MethodHead {
+				resp.Write(body.Bytes())
+			}
+			return
+		}
+		next.ServeHTTP(resp, req)
+	})
+}
@@ -0,0 +1,94 @@
+// Copyright 2016 Landonia Ltd. All rights reserved.
+
+package proxy
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// memoryBudget governs the memory used by the caches and buffers so that
+// enabling them cannot exhaust the memory of small machines. Each consumer
+// reserves memory before using it and the reservation is rejected when the
+// budget is exhausted (the consumers hold memory only while it is in use so
+// there is nothing that can be evicted).
+type memoryBudget struct {
+	limit     int64
+	used      int64
+	mu        sync.Mutex
+	consumers []*memoryConsumer
+}
+
+// memoryConsumer is a cache or buffer using memory from the budget
+type memoryConsumer struct {
+	budget     *memoryBudget
+	name       string
+	used       int64
+	rejections int64
+}
+
+// MemoryStats are the statistics of a memory consumer
+type MemoryStats struct {
+	Name       string `yaml:"name"`
+	Used       int64  `yaml:"used"`
+	Rejections int64  `yaml:"rejections"`
+}
+
+// newMemoryBudget will create the budget with the limit in MB (unlimited
+// when 0)
+func newMemoryBudget(mb int) *memoryBudget {
+	return &memoryBudget{limit: int64(mb) << 20}
+}
+
+// consumer will register a new consumer of the budget
+func (b *memoryBudget) consumer(name string) *memoryConsumer {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := &memoryConsumer{budget: b, name: name}
+	b.consumers = append(b.consumers, c)
+	return c
+}
+
+// tryReserve will add the bytes to the budget if there is room
+func (b *memoryBudget) tryReserve(n int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.limit > 0 && b.used+n > b.limit {
+		return false
+	}
+	b.used += n
+	return true
+}
+
+// stats will return the statistics of the budget and each consumer
+func (b *memoryBudget) stats() (limit, used int64, consumers []MemoryStats) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, c := range b.consumers {
+		consumers = append(consumers, MemoryStats{
+			Name:       c.name,
+			Used:       atomic.LoadInt64(&c.used),
+			Rejections: atomic.LoadInt64(&c.rejections),
+		})
+	}
+	return b.limit, b.used, consumers
+}
+
+// reserve will attempt to reserve the bytes returning false if the budget
+// is exhausted
+func (c *memoryConsumer) reserve(n int64) bool {
+	if !c.budget.tryReserve(n) {
+		atomic.AddInt64(&c.rejections, 1)
+		return false
+	}
+	atomic.AddInt64(&c.used, n)
+	return true
+}
+
+// release will return the bytes to the budget
+func (c *memoryConsumer) release(n int64) {
+	atomic.AddInt64(&c.used, -n)
+	c.budget.mu.Lock()
+	c.budget.used -= n
+	c.budget.mu.Unlock()
+}
@@ -0,0 +1,749 @@
+// Copyright 2016 Landonia Ltd. All rights reserved.
+
+package proxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	// DefaultOIDCCallbackPath is the path the provider redirects back to
+	DefaultOIDCCallbackPath = "/oauth2/callback"
+
+	// DefaultOIDCSignOutPath is the path that will clear the session
+	DefaultOIDCSignOutPath = "/oauth2/sign_out"
+
+	// DefaultOIDCCookieName is the name of the session cookie
+	DefaultOIDCCookieName = "_gomost_auth"
+
+	// DefaultOIDCSession is the minutes a session lasts
+	DefaultOIDCSession = 12 * 60
+
+	// oidcStateTimeout is how long the user has to sign in with the provider
+	oidcStateTimeout = 10 * time.Minute
+
+	// oidcKeysInterval is the minimum time between fetching the signing keys
+	oidcKeysInterval = time.Minute
+
+	// oidcSweepInterval is how often the expired sessions are removed from a
+	// directory store
+	oidcSweepInterval = time.Hour
+
+	// oidcSessionPrefix is the prefix of the session keys within the store
+	oidcSessionPrefix = "session+"
+)
+
+// oidcProvider is the discovered configuration of the provider
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	EndSessionEndpoint    string `json:"end_session_endpoint"`
+}
+
+// oidcSession is stored (encrypted) within the session cookie or within the
+// store using the id held by the cookie
+type oidcSession struct {
+	ID      string            `json:"i,omitempty"`
+	Claims  map[string]string `json:"c,omitempty"`
+	Expires int64             `json:"e"`
+}
+
+// oidcState is stored (encrypted) within the state cookie while the user
+// signs in with the provider
+type oidcState struct {
+	State    string `json:"s"`
+	Verifier string `json:"v"`
+	Nonce    string `json:"n"`
+	Redirect string `json:"r"`
+	Expires  int64  `json:"e"`
+}
+
+// oidcAuth will require the users of the hosts to sign in with the OIDC
+// provider before the request is passed on. The identity claims are
+// forwarded to the upstream within the configured headers.
+type oidcAuth struct {
+	conf    OIDCConfig
+	hosts   map[string]bool
+	aead    cipher.AEAD
+	client  *http.Client
+	headers map[string]string // The claim forwarded by header
+	store   autocert.Cache    // The shared session store (nil if kept within the cookie)
+	dir     *dirCache         // The directory store that is swept for expired sessions (nil if not a directory)
+	stop    chan struct{}
+
+	mu       sync.Mutex
+	provider *oidcProvider               // The discovered provider (nil until discovered)
+	keys     map[string]crypto.PublicKey // The signing keys by id
+	fetched  time.Time                   // When the signing keys were last fetched
+}
+
+// newOIDCAuth will create the authentication for the configuration
+func newOIDCAuth(conf OIDCConfig) (*oidcAuth, error) {
+	if conf.Issuer == "" || conf.ClientID == "" {
+		return nil, fmt.Errorf("The OIDC issuer and clientid must be provided")
+	}
+	if conf.CookieSecret == "" {
+		return nil, fmt.Errorf("The OIDC cookiesecret must be provided")
+	}
+	if conf.CallbackPath == "" {
+		conf.CallbackPath = DefaultOIDCCallbackPath
+	}
+	if conf.SignOutPath == "" {
+		conf.SignOutPath = DefaultOIDCSignOutPath
+	}
+	if conf.CookieName == "" {
+		conf.CookieName = DefaultOIDCCookieName
+	}
+	if conf.Session == 0 {
+		conf.Session = DefaultOIDCSession
+	}
+	if len(conf.Scopes) == 0 {
+		conf.Scopes = []string{"openid", "email", "profile"}
+	}
+	headers := conf.Headers
+	if len(headers) == 0 {
+		headers = map[string]string{"X-Forwarded-User": "sub", "X-Forwarded-Email": "email"}
+	}
+
+	// The cookies are encrypted using a key derived from the secret so they
+	// can be read by any instance sharing the configuration
+	key := sha256.Sum256([]byte(conf.CookieSecret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	oa := &oidcAuth{
+		conf:    conf,
+		hosts:   make(map[string]bool),
+		aead:    aead,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		headers: make(map[string]string),
+		stop:    make(chan struct{}),
+	}
+	for _, host := range conf.Hosts {
+		host = strings.ToLower(host)
+		oa.hosts[host] = true
+
+		// The session cookie can only be shared with hosts under the domain
+		domain := strings.TrimPrefix(strings.ToLower(conf.CookieDomain), ".")
+		if domain != "" && host != domain && !strings.HasSuffix(host, "."+domain) {
+			return nil, fmt.Errorf("The OIDC host %s is not within the cookiedomain %s", host, conf.CookieDomain)
+		}
+	}
+	if conf.Store.Type != "" {
+		store, err := newCache(conf.Store)
+		if err != nil {
+			return nil, fmt.Errorf("Could not create OIDC session store: %s", err.Error())
+		}
+		oa.store = &prefixCache{prefix: oidcSessionPrefix, cache: store}
+		oa.dir, _ = store.(*dirCache)
+	}
+	for header, claim := range headers {
+		oa.headers[http.CanonicalHeaderKey(header)] = claim
+	}
+	return oa, nil
+}
+
+// middleware will only pass on the requests for the hosts that have a valid
+// session, redirecting the users to the provider to sign in otherwise. The
+// hosts are matched using the canonical host so that the aliases and the
+// www/apex counterparts of the hosts also require a session.
+func (oa *oidcAuth) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if !oa.hosts[canonicalHost(req)] {
+			next.ServeHTTP(resp, req)
+			return
+		}
+		switch req.URL.Path {
+		case oa.conf.CallbackPath:
+			oa.callback(resp, req)
+			return
+		case oa.conf.SignOutPath:
+			oa.signOut(resp, req)
+			return
+		}
+
+		// The identity headers can only be set by the proxy
+		for header := range oa.headers {
+			req.Header.Del(header)
+		}
+		if session, valid := oa.session(req); valid {
+			oa.stripCookies(req)
+			for header, claim := range oa.headers {
+				if value := session.Claims[claim]; value != "" {
+					req.Header.Set(header, value)
+				}
+			}
+			next.ServeHTTP(resp, req)
+			return
+		}
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			http.Error(resp, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		oa.signIn(resp, req)
+	})
+}
+
+// signIn will redirect the user to the provider to sign in
+func (oa *oidcAuth) signIn(resp http.ResponseWriter, req *http.Request) {
+	provider, err := oa.discover()
+	if err != nil {
+		logger.Warn("Could not discover OIDC provider %s: %s", oa.conf.Issuer, err.Error())
+		http.Error(resp, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	state := oidcState{
+		State:    randomToken(),
+		Verifier: randomToken(),
+		Nonce:    randomToken(),
+		Redirect: req.URL.RequestURI(),
+		Expires:  time.Now().Add(oidcStateTimeout).Unix(),
+	}
+	if err := oa.writeCookie(resp, req, oa.conf.CookieName+"_state", state, oidcStateTimeout); err != nil {
+		logger.Error("Could not write OIDC state: %s", err.Error())
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	challenge := sha256.Sum256([]byte(state.Verifier))
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {oa.conf.ClientID},
+		"redirect_uri":          {oa.redirectURI(req)},
+		"scope":                 {strings.Join(oa.conf.Scopes, " ")},
+		"state":                 {state.State},
+		"nonce":                 {state.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(provider.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(resp, req, provider.AuthorizationEndpoint+sep+params.Encode(), http.StatusFound)
+}
+
+// callback will exchange the code returned by the provider for the ID token
+// and start the session
+func (oa *oidcAuth) callback(resp http.ResponseWriter, req *http.Request) {
+	var state oidcState
+	if !oa.readCookie(req, oa.conf.CookieName+"_state", &state) || time.Now().Unix() >= state.Expires ||
+		req.FormValue("state") != state.State {
+		http.Error(resp, "Invalid sign in state", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(resp, oa.cookie(req, oa.conf.CookieName+"_state", "", -1))
+	if e := req.FormValue("error"); e != "" {
+		http.Error(resp, "Sign in failed: "+e, http.StatusForbidden)
+		return
+	}
+	claims, err := oa.exchange(req, req.FormValue("code"), state)
+	if err != nil {
+		logger.Warn("OIDC sign in failed for %s: %s", req.Host, err.Error())
+		http.Error(resp, "Sign in failed", http.StatusForbidden)
+		return
+	}
+	if !oa.allowed(claims) {
+		http.Error(resp, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	session := oidcSession{
+		Claims:  oa.sessionClaims(claims),
+		Expires: time.Now().Add(time.Duration(oa.conf.Session) * time.Minute).Unix(),
+	}
+	if err := oa.startSession(resp, req, session); err != nil {
+		logger.Error("Could not write OIDC session: %s", err.Error())
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// Only redirect within the host
+	redirect := state.Redirect
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") {
+		redirect = "/"
+	}
+	http.Redirect(resp, req, redirect, http.StatusFound)
+}
+
+// signOut will clear the session (on every host sharing it) and sign out from
+// the provider when supported
+func (oa *oidcAuth) signOut(resp http.ResponseWriter, req *http.Request) {
+	var session oidcSession
+	if oa.store != nil && oa.readCookie(req, oa.conf.CookieName, &session) && session.ID != "" {
+		if err := oa.store.Delete(req.Context(), session.ID); err != nil {
+			logger.Warn("Could not delete OIDC session: %s", err.Error())
+		}
+	}
+	http.SetCookie(resp, oa.cookie(req, oa.conf.CookieName, "", -1))
+	if provider, err := oa.discover(); err == nil && provider.EndSessionEndpoint != "" {
+		http.Redirect(resp, req, provider.EndSessionEndpoint+"?client_id="+url.QueryEscape(oa.conf.ClientID), http.StatusFound)
+		return
+	}
+	resp.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	resp.Write([]byte("Signed out\n"))
+}
+
+// session will return the session of the request and true if it is valid
+func (oa *oidcAuth) session(req *http.Request) (oidcSession, bool) {
+	var session oidcSession
+	if !oa.readCookie(req, oa.conf.CookieName, &session) || time.Now().Unix() >= session.Expires {
+		return session, false
+	} else if oa.store == nil {
+		return session, true
+	}
+
+	// The session may have been ended on another host
+	id := session.ID
+	b, err := oa.store.Get(req.Context(), id)
+	if err != nil {
+		if err != autocert.ErrCacheMiss {
+			logger.Warn("Could not get OIDC session: %s", err.Error())
+		}
+		return session, false
+	}
+	session = oidcSession{}
+	if err := json.Unmarshal(b, &session); err != nil || time.Now().Unix() >= session.Expires {
+		oa.store.Delete(req.Context(), id)
+		return session, false
+	}
+	return session, true
+}
+
+// startSession will write the session to the cookie (or the store with the
+// cookie holding its id)
+func (oa *oidcAuth) startSession(resp http.ResponseWriter, req *http.Request, session oidcSession) error {
+	if oa.store != nil {
+		b, err := json.Marshal(session)
+		if err != nil {
+			return err
+		}
+		id := randomToken()
+		ttl := time.Until(time.Unix(session.Expires, 0))
+		if err := putExpiring(req.Context(), oa.store, id, b, ttl); err != nil {
+			return err
+		}
+		session = oidcSession{ID: id, Expires: session.Expires}
+	}
+	return oa.writeCookie(resp, req, oa.conf.CookieName, session, time.Duration(oa.conf.Session)*time.Minute)
+}
+
+// start will remove the expired sessions from a directory store at each
+// interval until shutdown (the other stores expire the sessions themselves)
+func (oa *oidcAuth) start() {
+	if oa.dir == nil {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(oidcSweepInterval)
+		defer ticker.Stop()
+		for {
+			oa.sweep()
+			select {
+			case <-oa.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// shutdown will stop sweeping the sessions
+func (oa *oidcAuth) shutdown(ctx context.Context) error {
+	close(oa.stop)
+	return nil
+}
+
+// sweep will remove the expired sessions from the directory store
+func (oa *oidcAuth) sweep() {
+	entries, err := os.ReadDir(oa.dir.dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warn("Could not read the OIDC session store: %s", err.Error())
+		}
+		return
+	}
+	now := time.Now().Unix()
+	removed := 0
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, oidcSessionPrefix) {
+			continue
+		}
+		var session oidcSession
+		b, err := os.ReadFile(filepath.Join(oa.dir.dir, name))
+		if err == nil && json.Unmarshal(b, &session) == nil && now < session.Expires {
+			continue
+		}
+		if err := os.Remove(filepath.Join(oa.dir.dir, name)); err == nil {
+			removed++
+		}
+	}
+	if removed > 0 {
+		logger.Debug("Removed %d expired OIDC sessions", removed)
+	}
+}
+
+// exchange will exchange the code for the ID token and return its verified
+// claims
+func (oa *oidcAuth) exchange(req *http.Request, code string, state oidcState) (map[string]interface{}, error) {
+	provider, err := oa.discover()
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {oa.redirectURI(req)},
+		"code_verifier": {state.Verifier},
+		"client_id":     {oa.conf.ClientID},
+	}
+	treq, err := http.NewRequest(http.MethodPost, provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	treq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	treq.Header.Set("Accept", "application/json")
+	if oa.conf.ClientSecret != "" {
+		treq.SetBasicAuth(url.QueryEscape(oa.conf.ClientID), url.QueryEscape(oa.conf.ClientSecret))
+	}
+	tresp, err := oa.client.Do(treq)
+	if err != nil {
+		return nil, err
+	}
+	defer tresp.Body.Close()
+	var token struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(tresp.Body, 1<<20)).Decode(&token); err != nil {
+		return nil, fmt.Errorf("Could not decode token response: %s", err.Error())
+	}
+	if token.Error != "" {
+		return nil, fmt.Errorf("%s: %s", token.Error, token.ErrorDescription)
+	} else if token.IDToken == "" {
+		return nil, fmt.Errorf("No ID token was returned (status %d)", tresp.StatusCode)
+	}
+	claims, err := oa.verify(token.IDToken)
+	if err != nil {
+		return nil, err
+	}
+	if claims["iss"] != provider.Issuer {
+		return nil, fmt.Errorf("Unexpected issuer: %v", claims["iss"])
+	} else if !hasAudience(claims["aud"], oa.conf.ClientID) {
+		return nil, fmt.Errorf("Unexpected audience: %v", claims["aud"])
+	} else if claims["nonce"] != state.Nonce {
+		return nil, fmt.Errorf("Invalid nonce")
+	}
+	if exp, ok := claims["exp"].(float64); !ok || time.Now().After(time.Unix(int64(exp), 0).Add(time.Minute)) {
+		return nil, fmt.Errorf("The ID token has expired")
+	}
+	return claims, nil
+}
+
+// verify will verify the signature of the JWT and return its claims
+func (oa *oidcAuth) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("Malformed ID token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("Malformed ID token signature")
+	}
+	key, err := oa.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" {
+			return nil, fmt.Errorf("Unsupported ID token algorithm: %s", header.Alg)
+		}
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, hash[:], sig); err != nil {
+			return nil, fmt.Errorf("Invalid ID token signature")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 {
+			return nil, fmt.Errorf("Unsupported ID token algorithm: %s", header.Alg)
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(k, hash[:], r, s) {
+			return nil, fmt.Errorf("Invalid ID token signature")
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported ID token key")
+	}
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// discover will return the configuration of the provider discovering it
+// the first time
+func (oa *oidcAuth) discover() (*oidcProvider, error) {
+	oa.mu.Lock()
+	defer oa.mu.Unlock()
+	if oa.provider != nil {
+		return oa.provider, nil
+	}
+	var provider oidcProvider
+	if err := oa.getJSON(strings.TrimSuffix(oa.conf.Issuer, "/")+"/.well-known/openid-configuration", &provider); err != nil {
+		return nil, err
+	}
+	if provider.AuthorizationEndpoint == "" || provider.TokenEndpoint == "" || provider.JWKSURI == "" {
+		return nil, fmt.Errorf("The provider configuration is incomplete")
+	}
+	oa.provider = &provider
+	return oa.provider, nil
+}
+
+// key will return the signing key fetching the keys again if it is unknown
+func (oa *oidcAuth) key(kid string) (crypto.PublicKey, error) {
+	provider, err := oa.discover()
+	if err != nil {
+		return nil, err
+	}
+	oa.mu.Lock()
+	defer oa.mu.Unlock()
+	if key, exists := oa.keys[kid]; exists {
+		return key, nil
+	} else if time.Since(oa.fetched) < oidcKeysInterval {
+		return nil, fmt.Errorf("Unknown ID token key: %s", kid)
+	}
+	oa.fetched = time.Now()
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := oa.getJSON(provider.JWKSURI, &jwks); err != nil {
+		return nil, err
+	}
+	oa.keys = make(map[string]crypto.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch {
+		case k.Kty == "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN == nil && errE == nil && len(e) > 0 && len(e) <= 4 {
+				oa.keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+			}
+		case k.Kty == "EC" && k.Crv == "P-256":
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if errX == nil && errY == nil && len(x) == 32 && len(y) == 32 {
+				if key, err := ecdsa.ParseUncompressedPublicKey(elliptic.P256(), append(append([]byte{4}, x...), y...)); err == nil {
+					oa.keys[k.Kid] = key
+				}
+			}
+		}
+	}
+	if key, exists := oa.keys[kid]; exists {
+		return key, nil
+	}
+	return nil, fmt.Errorf("Unknown ID token key: %s", kid)
+}
+
+// getJSON will decode the JSON response of the URL
+func (oa *oidcAuth) getJSON(u string, v interface{}) error {
+	resp, err := oa.client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected status from %s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// allowed will return true if the email of the user is allowed
+func (oa *oidcAuth) allowed(claims map[string]interface{}) bool {
+	if len(oa.conf.Allow) == 0 {
+		return true
+	}
+	email, _ := claims["email"].(string)
+	if verified, ok := claims["email_verified"].(bool); email == "" || (ok && !verified) {
+		return false
+	}
+	email = strings.ToLower(email)
+	for _, allow := range oa.conf.Allow {
+		allow = strings.ToLower(allow)
+		if email == allow || (strings.HasPrefix(allow, "@") && strings.HasSuffix(email, allow)) {
+			return true
+		}
+	}
+	return false
+}
+
+// sessionClaims will return the claims kept within the session (only those
+// forwarded are kept so that the cookie remains small)
+func (oa *oidcAuth) sessionClaims(claims map[string]interface{}) map[string]string {
+	kept := make(map[string]string)
+	for _, claim := range oa.headers {
+		switch v := claims[claim].(type) {
+		case nil:
+		case string:
+			kept[claim] = v
+		case []interface{}:
+			values := make([]string, len(v))
+			for i, value := range v {
+				values[i] = fmt.Sprint(value)
+			}
+			kept[claim] = strings.Join(values, ",")
+		default:
+			kept[claim] = fmt.Sprint(v)
+		}
+	}
+	return kept
+}
+
+// redirectURI will return the callback URL for the host
+func (oa *oidcAuth) redirectURI(req *http.Request) string {
+	return requestScheme(req) + "://" + req.Host + oa.conf.CallbackPath
+}
+
+// cookie will return the cookie for the value. The session cookie is shared
+// with the cookie domain when configured.
+func (oa *oidcAuth) cookie(req *http.Request, name, value string, maxAge int) *http.Cookie {
+	domain := ""
+	if name == oa.conf.CookieName {
+		domain = oa.conf.CookieDomain
+	}
+	return &http.Cookie{
+		Domain:   domain,
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		Secure:   req.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// writeCookie will encrypt the value within the named cookie
+func (oa *oidcAuth) writeCookie(resp http.ResponseWriter, req *http.Request, name string, v interface{}, expires time.Duration) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, oa.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := oa.aead.Seal(nonce, nonce, b, []byte(name))
+	http.SetCookie(resp, oa.cookie(req, name, base64.RawURLEncoding.EncodeToString(sealed), int(expires.Seconds())))
+	return nil
+}
+
+// readCookie will decrypt the value of the named cookie returning false if
+// it is missing or has been tampered with
+func (oa *oidcAuth) readCookie(req *http.Request, name string, v interface{}) bool {
+	c, err := req.Cookie(name)
+	if err != nil {
+		return false
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(c.Value)
+	if err != nil || len(sealed) < oa.aead.NonceSize() {
+		return false
+	}
+	size := oa.aead.NonceSize()
+	b, err := oa.aead.Open(nil, sealed[:size], sealed[size:], []byte(name))
+	return err == nil && json.Unmarshal(b, v) == nil
+}
+
+// stripCookies will remove the session cookies before the request is passed
+// on so that they are not sent to the upstream
+func (oa *oidcAuth) stripCookies(req *http.Request) {
+	cookies := req.Cookies()
+	req.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name != oa.conf.CookieName && c.Name != oa.conf.CookieName+"_state" {
+			req.AddCookie(c)
+		}
+	}
+}
+
+// hasAudience will return true if the audience claim contains the client
+func hasAudience(aud interface{}, clientID string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == clientID
+	case []interface{}:
+		for _, a := range v {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// decodeSegment will decode the base64url encoded JSON segment of a JWT
+func decodeSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return fmt.Errorf("Malformed ID token")
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("Malformed ID token")
+	}
+	return nil
+}
+
+// randomToken will return a random URL safe token
+func randomToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,86 @@
+// Copyright 2016 Landonia Ltd. All rights reserved.
+
+package proxy
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// PluginAPIVersion is the version of the plugin API. It is incremented
+// whenever a change is made to the Proxy functions available to plugins
+// that would break existing plugins.
+//
+// Version 1 provides the following to plugins within Setup:
+//
+//	Use(middleware)       - wrap every request (e.g. authentication)
+//	AddHostHandler(h, hd) - handle a host within the proxy
+//	AddHostMatcher(m, hd) - handle any host matching a function
+//	AddProxy(conf)        - add a proxy at runtime (e.g. service discovery)
+//	RemoveProxy(host)     - remove a proxy at runtime
+//	OnReady(f)            - called once the proxy is serving
+//	OnShutdown(f)         - called when the proxy is shutting down
+//	Events()              - subscribe to (or publish) events
+const PluginAPIVersion = 1
+
+// Plugin allows third parties to extend the proxy. Plugins are compiled
+// into the binary and registered within an init function, then enabled
+// by name within the configuration.
+type Plugin interface {
+
+	// APIVersion returns the PluginAPIVersion the plugin was written for
+	APIVersion() int
+
+	// Setup is called when the plugin is enabled with the configured options
+	Setup(p *Proxy, options map[string]string) error
+}
+
+var (
+	pluginsMu sync.RWMutex
+	plugins   = make(map[string]Plugin)
+)
+
+// RegisterPlugin will make the plugin available using the name. If the
+// plugin is nil or the name has already been registered it will panic.
+func RegisterPlugin(name string, plugin Plugin) {
+	pluginsMu.Lock()
+	defer pluginsMu.Unlock()
+	if plugin == nil {
+		panic("proxy: RegisterPlugin plugin is nil")
+	}
+	if _, dup := plugins[name]; dup {
+		panic("proxy: RegisterPlugin called twice for plugin " + name)
+	}
+	plugins[name] = plugin
+}
+
+// Plugins will return the names of the registered plugins
+func Plugins() []string {
+	pluginsMu.RLock()
+	defer pluginsMu.RUnlock()
+	names := make([]string, 0, len(plugins))
+	for name := range plugins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// enablePlugin will setup the registered plugin using the configuration
+func (gm *Proxy) enablePlugin(conf PluginConfig) error {
+	pluginsMu.RLock()
+	plugin, exists := plugins[conf.Name]
+	pluginsMu.RUnlock()
+	if !exists {
+		return fmt.Errorf("Unknown plugin: %s", conf.Name)
+	}
+	if v := plugin.APIVersion(); v != PluginAPIVersion {
+		return fmt.Errorf("Plugin %s requires API version %d but version %d is provided", conf.Name, v, PluginAPIVersion)
+	}
+	if err := plugin.Setup(gm, conf.Options); err != nil {
+		return fmt.Errorf("Could not setup plugin %s: %s", conf.Name, err.Error())
+	}
+	logger.Info("Enabled plugin: %s", conf.Name)
+	return nil
+}
@@ -3,15 +3,23 @@
 package proxy
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
+	"log"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
 	"path"
+	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/landonia/golog"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 var (
@@ -22,11 +30,42 @@ var (
 type Proxy struct {
 	rs           *http.Server                      // The actual server
 	vs           *http.Server                      // The virtual redirect server
+	as           *http.Server                      // The admin server
+	acme         *acmeManager                      // The ACME certificate managers
+	cluster      *cluster                          // The cluster (nil if not enabled)
+	memory       *memoryBudget                     // The memory available to caches and buffers
+	buffers      *bufferPool                       // The buffers used to copy the proxied responses
+	signedBodies *memoryConsumer                   // The request bodies buffered so they can be signed
+	tracing      int32                             // Set to 1 when the trace log level is enabled
+	fingerprints *fingerprints                     // The TLS fingerprints (nil if not enabled)
+	clientAuth   *clientAuth                       // The client certificate authorisation (nil if not enabled)
+	accessLog    *accessLog                        // The access log (nil if not enabled)
+	errorLogs    *errorLogs                        // The error logs of each host (nil if not configured)
+	captures     *captures                         // The request captures (nil if the admin server is disabled)
+	quotas       *quotas                           // The usage quotas of the hosts (nil if not configured)
+	state        stateStore                        // The rate limits, bans and sticky sessions
+	echoing      bool                              // True if any echo hosts have been configured
+	events       *Events                           // The event bus
+	mu           sync.RWMutex                      // Guards the configuration
 	config       Configuration                     // The configuration
 	handlers     map[string]http.Handler           // The local handlers
-	proxies      map[string]*httputil.ReverseProxy // The proxies to the host->proxy
+	matchers     []hostMatcher                     // The local handlers using a host matcher
+	aliases      map[string]string                 // The alias->host
+	proxies      map[string]http.Handler           // The proxies to the host->proxy
+	statics      map[string]http.Handler           // The explicitly configured static hosts
+	defaultProxy http.Handler                      // The proxy for any host not routed (nil if not configured)
+	stats        *routeStats                       // The live counters for each route
+	trusted      []*net.IPNet                      // The clients allowed to use X-Gomost-Explain
+	rules        []*rule                           // The expression routing rules
 	proxyHandler http.Handler                      // The root proxy handler
+	middleware   []func(http.Handler) http.Handler // The middleware wrapping the root handler
+	longLived    *longLivedTracker                 // The websocket and event stream requests
+	onShutdown   []func(context.Context) error     // The shutdown callbacks
+	onReady      []func()                          // The ready callbacks
+	ready        chan struct{}                     // Closed once all the listeners are bound
+	readyOnce    sync.Once                         // Ensures the ready is only signalled once
 	exit         chan error                        // When to shutdown the server
+	shutdown     sync.Once                         // Ensures the shutdown is only performed once
 }
 
 // Setup will initialise the proxy and must be called before any other functions
@@ -34,64 +73,687 @@ func Setup(config Configuration) (*Proxy, error) {
 	gm := &Proxy{}
 	gm.config = config
 	gm.handlers = make(map[string]http.Handler)
-	gm.proxies = make(map[string]*httputil.ReverseProxy)
+	gm.proxies = make(map[string]http.Handler)
+	gm.statics = make(map[string]http.Handler)
+	gm.aliases = make(map[string]string)
+	gm.longLived = newLongLivedTracker()
+	gm.exit = make(chan error, 1)
+	gm.ready = make(chan struct{})
+	gm.memory = newMemoryBudget(config.MemoryBudget)
+	gm.buffers = newBufferPool(config.BufferSize, gm.memory)
+	gm.signedBodies = gm.memory.consumer("signed bodies")
+	gm.setTracing(config.LogLevel)
+	gm.stats = newRouteStats()
+	gm.events = newEvents()
+
+	// Only trusted clients can see how their requests were routed
+	trusted, err := parseCIDRs(config.Admin.Trusted)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse trusted address: %s", err.Error())
+	}
+	gm.trusted = trusted
+
+	// The rate limits, bans and sticky sessions are kept within the state
+	// store which is shared by the replicas when using redis
+	if gm.state, err = newStateStore(config.State); err != nil {
+		return nil, err
+	}
+
+	// The aliases are resolved to their host before routing
+	for host, aliases := range config.Aliases {
+		for _, alias := range aliases {
+			alias, host := strings.ToLower(alias), strings.ToLower(host)
+			if other, exists := gm.aliases[alias]; exists && other != host {
+				return nil, fmt.Errorf("The alias %s is used by %s and %s", alias, other, host)
+			}
+			gm.aliases[alias] = host
+		}
+	}
 
 	// If there are any proxies then we need to set them up as well
 	for _, proxy := range config.Proxies {
-		if u, err := url.Parse(proxy.Host); err == nil {
-			gm.proxies[proxy.Proxy] = httputil.NewSingleHostReverseProxy(u)
+		if rp, err := gm.newProxyHandler(proxy); err == nil {
+			gm.proxies[strings.ToLower(proxy.Proxy)] = rp
 		} else {
 			logger.Warn("Could not parse Host: %s", err.Error())
 		}
 	}
 
+	// The static hosts are checked up front so any missing docroots are found
+	for _, conf := range config.StaticHosts {
+		sh, err := newStaticHost(conf)
+		if err != nil {
+			return nil, err
+		}
+		for _, host := range conf.Hosts {
+			gm.statics[strings.ToLower(host)] = sh
+		}
+	}
+
+	// The echo hosts write back the request they receive for debugging
+	for _, host := range config.EchoHosts {
+		gm.handlers[strings.ToLower(host)] = http.HandlerFunc(gm.echo)
+		gm.echoing = true
+	}
+
+	// The rules are compiled up front so that any errors are found on load
+	for _, conf := range config.Rules {
+		r, err := gm.newRule(conf)
+		if err != nil {
+			return nil, err
+		}
+		gm.rules = append(gm.rules, r)
+	}
+
+	// Any host that is not routed is forwarded to the default proxy
+	if config.DefaultProxy != "" {
+		rp, err := gm.newProxyHandler(HostConfig{Proxy: "*", Host: config.DefaultProxy})
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse default proxy: %s", err.Error())
+		}
+		gm.defaultProxy = rp
+	}
+
 	// Create the root handler
 	gm.proxyHandler = http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
 
-		// We need to extract the host header and then forward to the correct handler
-		if handler, hExists := gm.handlers[req.Host]; hExists {
-			logger.Trace("Handler: %v: Path: %s", req.Host, req.URL.String())
+		// Long lived requests are tracked so they can be closed separately
+		// when shutting down
+		if isLongLived(req) {
+			var done func()
+			req, done = gm.longLived.track(req)
+			defer done()
+		}
+
+		// The rules take precedence and are matched in the order provided
+		for _, r := range gm.rules {
+			if r.match(req) {
+				gm.dispatch(resp, req, "rule", r.conf.Match, "the rule expression matched", r.handler)
+				return
+			}
+		}
+
+		// The host is resolved again as a script may have changed it
+		gm.mu.RLock()
+		requested := strings.ToLower(requestHost(req))
+		host := gm.resolveHost(canonicalHost(req))
+		reason := "the host matched"
+		var alias []string
+		if _, exists := gm.aliases[requested]; exists {
+			alias = []string{requested}
+			reason = "the host is an alias of " + host
+		} else if host != requested {
+			reason = "the host matched the handler " + host
+		}
+		handler, hExists := gm.handlers[host]
+		proxy, pExists := gm.proxies[host]
+		static, sExists := gm.statics[host]
+		kind, name := "handler", host
+		if !hExists && !pExists && !sExists {
+			kind, name, handler, hExists = gm.matchHandler(host)
+			reason = "the host matched the " + kind + " " + name
+		}
+		gm.mu.RUnlock()
+		if hExists {
 
 			// Forward to the local handler
-			handler.ServeHTTP(resp, req)
-		} else if proxy, pExists := gm.proxies[req.Host]; pExists {
-			logger.Trace("Proxy: %v: Path: %s", req.Host, req.URL.String())
+			gm.dispatch(resp, req, kind, name, reason, handler, alias...)
+		} else if pExists {
 
 			// Forward to the proxy
-			proxy.ServeHTTP(resp, req)
+			gm.dispatch(resp, req, "proxy", host, reason, proxy, alias...)
+		} else if sExists {
+
+			// Serve the configured static host
+			gm.dispatch(resp, req, "static", host, reason, static, alias...)
+		} else if gm.defaultProxy != nil && !gm.isStaticHost(host) {
+
+			// Forward to the default proxy
+			gm.dispatch(resp, req, "default", "*", "no route was found for the host", gm.defaultProxy)
 		} else if gm.config.StaticDir != "" {
-			logger.Trace("Serve: %v: Path: %s", req.Host, req.URL.String())
+			name := "*"
+			if gm.isStaticHost(host) {
+				name = host
+			}
 
 			// Just attempt to serve the file/directory specified by the host
-			http.ServeFile(resp, req, path.Join(gm.config.StaticDir, req.Host))
+			gm.dispatch(resp, req, "static", name, "no route was found for the host", http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+				http.ServeFile(resp, req, path.Join(gm.config.StaticDir, host))
+			}))
 		} else {
-			logger.Trace("Serve: %v: Notfound: %s", req.Host, req.URL.String())
-			resp.WriteHeader(http.StatusNotFound)
+			// The host is supplied by the client so the requests are counted
+			// together rather than creating a counter for every host sent
+			gm.dispatch(resp, req, "notfound", "*", "no route was found for the host", http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+				resp.WriteHeader(http.StatusNotFound)
+			}))
 		}
 	})
+
+	// Log every request
+	if config.AccessLog != "" {
+		al, err := newAccessLog(gm, config.AccessLog)
+		if err != nil {
+			return nil, err
+		}
+		gm.accessLog = al
+		gm.Use(al.middleware)
+		gm.OnShutdown(func(ctx context.Context) error { return al.close() })
+	}
+
+	// Write the errors of each host to its own log
+	if len(config.ErrorLogs) > 0 {
+		el, err := newErrorLogs(config.ErrorLogs, gm.events)
+		if err != nil {
+			return nil, err
+		}
+		gm.errorLogs = el
+		gm.OnReady(el.start)
+		gm.OnShutdown(el.shutdown)
+		gm.OnShutdown(el.close)
+	}
+
+	// Allow the requests of a host to be captured using the admin server
+	if config.Admin.Addr != "" {
+		gm.captures = newCaptures(config.Admin.Capture)
+		gm.Use(gm.captures.middleware)
+	}
+
+	// Capture the TLS fingerprints and forward them to the upstreams
+	if config.Fingerprint.Enable {
+		gm.fingerprints = newFingerprints()
+		gm.Use(gm.forwardFingerprint)
+	}
+
+	// Authorise the requests using the client certificates
+	if config.SSL.ClientAuth.CAFile != "" {
+		ca, err := newClientAuth(config.SSL.ClientAuth)
+		if err != nil {
+			return nil, err
+		}
+		gm.clientAuth = ca
+		gm.Use(ca.middleware)
+	}
+
+	// Serve the configured files before the request is routed
+	if len(config.Files) > 0 {
+		files, err := newInjectedFiles(config.Files)
+		if err != nil {
+			return nil, err
+		}
+		gm.Use(files.middleware)
+	}
+
+	// Route the /.well-known paths before the request is routed
+	if len(config.WellKnown) > 0 {
+		wk, err := gm.newWellKnown(config.WellKnown)
+		if err != nil {
+			return nil, err
+		}
+		gm.Use(wk.middleware)
+	}
+
+	// Serve the maintenance page for the hosts within a maintenance window
+	if len(config.Maintenance) > 0 {
+		m, err := newMaintenance(config.Maintenance)
+		if err != nil {
+			return nil, err
+		}
+		gm.Use(m.middleware)
+	}
+
+	// Count the usage of the hosts and enforce their quotas
+	if len(config.Quotas.Limits) > 0 {
+		q, err := newQuotas(config.Quotas, gm.events)
+		if err != nil {
+			return nil, err
+		}
+		gm.quotas = q
+		gm.Use(q.middleware)
+		gm.OnReady(q.start)
+		gm.OnShutdown(q.shutdown)
+	}
+
+	// Require the users of the hosts to sign in with the OIDC providers
+	for _, conf := range config.OIDC {
+		oa, err := newOIDCAuth(conf)
+		if err != nil {
+			return nil, err
+		}
+		gm.Use(oa.middleware)
+		gm.OnReady(oa.start)
+		gm.OnShutdown(oa.shutdown)
+	}
+
+	// Send the events to the webhooks once the proxy is ready
+	for _, conf := range config.Webhooks {
+		w, err := newWebhook(conf, gm.events)
+		if err != nil {
+			return nil, err
+		}
+		gm.OnReady(w.start)
+		gm.OnShutdown(w.shutdown)
+	}
+
+	// Send the events to the notifiers once the proxy is ready
+	for _, conf := range config.Alerts {
+		a, err := newAlert(conf, gm.events)
+		if err != nil {
+			return nil, err
+		}
+		gm.OnReady(a.start)
+		gm.OnShutdown(a.shutdown)
+	}
+
+	// Join the cluster once the proxy is ready
+	if config.Cluster.Enable {
+		c, err := newCluster(gm, config.Cluster)
+		if err != nil {
+			return nil, err
+		}
+		gm.cluster = c
+		gm.OnReady(c.start)
+		gm.OnShutdown(c.shutdown)
+	}
+
+	// Shed the lowest priority traffic when under pressure
+	if config.LoadShedding.Enable {
+		s := newShedder(config.LoadShedding)
+		gm.Use(s.middleware)
+		gm.OnReady(s.start)
+		gm.OnShutdown(s.shutdown)
+	}
+
+	// Load the scripts which are run before the request is routed
+	for _, conf := range config.Scripts {
+		sc, err := newScript(conf)
+		if err != nil {
+			return nil, err
+		}
+		gm.Use(sc.middleware)
+	}
+
+	// Enable any of the configured plugins
+	for _, plugin := range config.Plugins {
+		if err := gm.enablePlugin(plugin); err != nil {
+			return nil, err
+		}
+	}
 	return gm, nil
 }
 
+// newProxyHandler will create the handler for the host configuration which
+// signs the requests and limits the concurrent requests when configured
+func (gm *Proxy) newProxyHandler(conf HostConfig) (http.Handler, error) {
+	rp, err := gm.newReverseProxy(conf)
+	if err != nil {
+		return nil, err
+	}
+	var handler http.Handler = rp
+	if conf.Sign.Secret != "" {
+		s := newSigner(conf.Sign, gm.signedBodies)
+		rp.Director = s.director(rp.Director)
+		handler = s.handler(rp)
+	}
+	if conf.MaxConns > 0 {
+		handler = newLimiter(conf, handler)
+	}
+	if conf.Sticky.Cookie != "" && len(conf.Hosts) > 0 {
+		handler = startSessions(conf.Sticky.Cookie, handler)
+	}
+	if conf.RateLimit.Requests > 0 {
+		if handler, err = newRateLimiter(conf, gm.state, gm.events, handler); err != nil {
+			return nil, err
+		}
+	}
+	return handler, nil
+}
+
+// newReverseProxy will create the reverse proxy for the host configuration
+func (gm *Proxy) newReverseProxy(conf HostConfig) (*httputil.ReverseProxy, error) {
+	var upstreams []*url.URL
+	for _, host := range append([]string{conf.Host}, conf.Hosts...) {
+		if host == "" {
+			continue
+		}
+		u, err := url.Parse(host)
+		if err != nil {
+			return nil, err
+		}
+		upstreams = append(upstreams, u)
+	}
+	var rp *httputil.ReverseProxy
+	var err error
+	switch len(upstreams) {
+	case 0:
+		return nil, fmt.Errorf("No upstream host has been provided for: %s", conf.Proxy)
+	case 1:
+		rp = httputil.NewSingleHostReverseProxy(upstreams[0])
+	default:
+		rp, err = newBalancedProxy(conf, upstreams, gm.state)
+	}
+	if rp != nil {
+		if rp.Transport, err = newUpstreamTransport(conf); err != nil {
+			return nil, err
+		}
+		rp.BufferPool = gm.buffers
+		rp.ErrorHandler = gm.upstreamFailed
+	}
+	return rp, err
+}
+
 // AddHostHandler will add the handler that will be used for the specified
-// host allowing you to run a Go application within the proxy
-func (gm *Proxy) AddHostHandler(host string, handler http.Handler) error {
-	if host == "" {
-		return fmt.Errorf("The host cannot be empty")
+// host (and any additional hosts) allowing you to run a Go application within
+// the proxy. The www/apex counterpart of each host and any configured aliases
+// are also handled unless they have their own handler or proxy.
+func (gm *Proxy) AddHostHandler(host string, handler http.Handler, hosts ...string) error {
+	hosts = append([]string{host}, hosts...)
+	for _, h := range hosts {
+		if h == "" {
+			return fmt.Errorf("The host cannot be empty")
+		}
+	}
+	if gm.handlers == nil {
+		return fmt.Errorf("Setup() must be called")
+	}
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+	for _, h := range hosts {
+		gm.handlers[strings.ToLower(h)] = handler
+		gm.events.Publish(Event{Type: EventRouteAdded, Host: h, Route: "handler " + h})
+	}
+	return nil
+}
+
+// AddHostMatcher will add the handler that will be used for any host that
+// the matcher returns true for (e.g. every subdomain of a domain). Matchers
+// are checked in the order added and only once no handler or proxy has been
+// found for the exact host.
+func (gm *Proxy) AddHostMatcher(match func(host string) bool, handler http.Handler) error {
+	if match == nil {
+		return fmt.Errorf("The matcher cannot be nil")
 	}
 	if gm.handlers == nil {
 		return fmt.Errorf("Setup() must be called")
 	}
-	gm.handlers[host] = handler
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+	gm.matchers = append(gm.matchers, hostMatcher{match: match, handler: handler})
+	gm.events.Publish(Event{Type: EventRouteAdded, Route: fmt.Sprintf("matcher matcher #%d", len(gm.matchers))})
+	return nil
+}
+
+// upstreamFailed will publish the failure before responding with a bad
+// gateway as the default reverse proxy error handler does
+func (gm *Proxy) upstreamFailed(resp http.ResponseWriter, req *http.Request, err error) {
+	logger.Warn("Proxy error: %s: %s", req.URL.Host, err.Error())
+	if gm.errorLogs != nil {
+		gm.errorLogs.log(canonicalHost(req), "upstream", fmt.Sprintf("%s %s: %s", req.Method, req.URL.String(), err.Error()))
+	}
+	if unreachable, ok := req.Context().Value(unreachableContextKey{}).(*int32); ok {
+		atomic.StoreInt32(unreachable, 1)
+	}
+	event, _ := req.Context().Value(routeContextKey{}).(Event)
+	event.Type = EventUpstreamFailed
+	event.Upstream = req.URL.Host
+	event.Error = err.Error()
+	gm.events.Publish(event)
+	resp.WriteHeader(http.StatusBadGateway)
+}
+
+// isRouted will return true if the host has been configured (as a proxy,
+// alias, handler, matcher or static host) rather than only being served by
+// the default proxy or static directory
+func (gm *Proxy) isRouted(host string) bool {
+	gm.mu.RLock()
+	host = gm.resolveHost(host)
+	_, hExists := gm.handlers[host]
+	_, pExists := gm.proxies[host]
+	_, sExists := gm.statics[host]
+	if !hExists && !pExists && !sExists {
+		_, _, _, hExists = gm.matchHandler(host)
+	}
+	gm.mu.RUnlock()
+	return hExists || pExists || sExists || gm.isStaticHost(host)
+}
+
+// isStaticHost will return true if the static directory has a directory for
+// the host
+func (gm *Proxy) isStaticHost(host string) bool {
+	if gm.config.StaticDir == "" {
+		return false
+	}
+	info, err := os.Stat(path.Join(gm.config.StaticDir, host))
+	return err == nil && info.IsDir()
+}
+
+// hostMatcher is a handler for any host matching the function
+type hostMatcher struct {
+	match   func(host string) bool
+	handler http.Handler
+}
+
+// matchHandler will return the handler of the first matcher that matches
+// the host (the lock must be held) along with the route type and name
+func (gm *Proxy) matchHandler(host string) (string, string, http.Handler, bool) {
+	for i, m := range gm.matchers {
+		if m.match(host) {
+			return "matcher", fmt.Sprintf("matcher #%d", i+1), m.handler, true
+		}
+	}
+	return "", "", nil, false
+}
+
+// canonicalHostKey is used to store the canonical host of the request within
+// the context
+type canonicalHostKey struct{}
+
+// resolvedHost is the canonical host of the requested host
+type resolvedHost struct {
+	requested string
+	host      string
+}
+
+// withCanonicalHost will resolve the host the request is routed to before
+// the middleware is run so that every per-host feature applies to the
+// aliases and the www/apex counterparts of the hosts
+func (gm *Proxy) withCanonicalHost(req *http.Request) *http.Request {
+	requested := strings.ToLower(requestHost(req))
+	gm.mu.RLock()
+	host := gm.resolveHost(requested)
+	gm.mu.RUnlock()
+	return req.WithContext(context.WithValue(req.Context(), canonicalHostKey{}, resolvedHost{requested: requested, host: host}))
+}
+
+// resolveHost will return the host the requests for the (lower case) host
+// are routed as: the host of an alias or the www/apex counterpart of a host
+// that only has a handler for its counterpart (the lock must be held)
+func (gm *Proxy) resolveHost(host string) string {
+	if canonical, exists := gm.aliases[host]; exists {
+		host = canonical
+	}
+	_, hExists := gm.handlers[host]
+	_, pExists := gm.proxies[host]
+	_, sExists := gm.statics[host]
+	if !hExists && !pExists && !sExists {
+		if _, exists := gm.handlers[counterpartHost(host)]; exists {
+			return counterpartHost(host)
+		}
+	}
+	return host
+}
+
+// canonicalHost will return the (lower case) host the request is routed as
+// which is resolved before the middleware is run. The requested host is
+// returned when it has not been resolved (or has since been changed).
+func canonicalHost(req *http.Request) string {
+	requested := strings.ToLower(requestHost(req))
+	if r, ok := req.Context().Value(canonicalHostKey{}).(resolvedHost); ok && r.requested == requested {
+		return r.host
+	}
+	return requested
+}
+
+// counterpartHost will return the apex host for a www host and the www host
+// for any other host
+func counterpartHost(host string) string {
+	if strings.HasPrefix(host, "www.") {
+		return host[len("www."):]
+	}
+	return "www." + host
+}
+
+// AddProxy will add (or replace) the proxy for the host at runtime
+func (gm *Proxy) AddProxy(conf HostConfig) error {
+	if conf.Proxy == "" {
+		return fmt.Errorf("The proxy host cannot be empty")
+	}
+	rp, err := gm.newProxyHandler(conf)
+	if err != nil {
+		return err
+	}
+	gm.mu.Lock()
+	gm.proxies[strings.ToLower(conf.Proxy)] = rp
+	gm.config.Proxies = append(removeHostConfig(gm.config.Proxies, conf.Proxy), conf)
+	gm.mu.Unlock()
+	gm.events.Publish(Event{Type: EventRouteAdded, Host: conf.Proxy, Route: "proxy " + conf.Proxy, Upstream: conf.Host})
+	if gm.cluster != nil {
+		gm.cluster.publish(func(confs []HostConfig) []HostConfig {
+			return append(removeHostConfig(confs, conf.Proxy), conf)
+		})
+	}
+	return nil
+}
+
+// RemoveProxy will remove the proxy for the host at runtime
+func (gm *Proxy) RemoveProxy(host string) {
+	gm.mu.Lock()
+	delete(gm.proxies, strings.ToLower(host))
+	gm.config.Proxies = removeHostConfig(gm.config.Proxies, host)
+	gm.mu.Unlock()
+	gm.events.Publish(Event{Type: EventRouteRemoved, Host: host, Route: "proxy " + host})
+	if gm.cluster != nil {
+		gm.cluster.publish(func(confs []HostConfig) []HostConfig {
+			return removeHostConfig(confs, host)
+		})
+	}
+}
+
+// removeHostConfig will return a copy of the configs without the host
+func removeHostConfig(configs []HostConfig, host string) []HostConfig {
+	var result []HostConfig
+	for _, conf := range configs {
+		if conf.Proxy != host {
+			result = append(result, conf)
+		}
+	}
+	return result
+}
+
+// Use will add middleware that wraps every request handled by the proxy.
+// The middleware is applied in the order it was added and must be added
+// before Service is called.
+func (gm *Proxy) Use(middleware func(http.Handler) http.Handler) {
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+	gm.middleware = append(gm.middleware, middleware)
+}
+
+// Config will return a copy of the currently active configuration
+func (gm *Proxy) Config() Configuration {
+	gm.mu.RLock()
+	defer gm.mu.RUnlock()
+	return gm.config
+}
+
+// setTracing will record whether the trace log level is enabled
+func (gm *Proxy) setTracing(level string) {
+	var tracing int32
+	if strings.EqualFold(level, "trace") {
+		tracing = 1
+	}
+	atomic.StoreInt32(&gm.tracing, tracing)
+}
+
+// trace will log how the request was handled. The level is checked first
+// to avoid formatting the URL for every request when tracing is disabled.
+func (gm *Proxy) trace(kind, name string, req *http.Request) {
+	if atomic.LoadInt32(&gm.tracing) == 1 {
+		logger.Trace("%s: %v: Path: %s", kind, name, req.URL.String())
+	}
+}
+
+// ReopenLogs will reopen the log files written by the proxy (such as the
+// access log) so that they can be rotated without restarting
+func (gm *Proxy) ReopenLogs() error {
+	if gm.accessLog != nil {
+		if err := gm.accessLog.reopen(); err != nil {
+			return err
+		}
+	}
+	if gm.errorLogs != nil {
+		return gm.errorLogs.reopen()
+	}
+	return nil
+}
+
+// SetLogLevel will change the global log level at runtime
+func (gm *Proxy) SetLogLevel(level string) error {
+	level = strings.ToLower(level)
+	switch level {
+	case "fatal", "error", "warn", "info", "debug", "trace":
+	default:
+		return fmt.Errorf("Unknown log level: %s", level)
+	}
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+	golog.LogLevel(level)
+	gm.config.LogLevel = level
+	gm.setTracing(level)
+	logger.Info("Log level changed to: %s", level)
 	return nil
 }
 
 // Service will start the server and handle the requests
 func (gm *Proxy) Service() (err error) {
 
+	// Wrap the root handler with the middleware (the first added is outermost)
+	// which are given the canonical host of each request
+	handler := gm.proxyHandler
+	for i := len(gm.middleware) - 1; i >= 0; i-- {
+		handler = gm.middleware[i](handler)
+	}
+	middleware := handler
+	handler = http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		middleware.ServeHTTP(resp, gm.withCanonicalHost(req))
+	})
+
 	// Initialise the server if one has not been provided
 	gm.rs = &http.Server{
 		Addr:    gm.config.Addr,
-		Handler: gm.proxyHandler,
+		Handler: handler,
+	}
+	if gm.fingerprints != nil || gm.errorLogs != nil || gm.config.Strict.Enable {
+		gm.rs.ConnState = func(c net.Conn, state http.ConnState) {
+			if gm.fingerprints != nil {
+				gm.fingerprints.connState(c, state)
+			}
+			if gm.errorLogs != nil {
+				gm.errorLogs.connState(c, state)
+			}
+			if gm.config.Strict.Enable {
+				strictConnState(c, state)
+			}
+		}
+	}
+	if gm.errorLogs != nil {
+		gm.rs.ErrorLog = log.New(gm.errorLogs, "", log.LstdFlags)
+	}
+	if gm.config.Strict.Enable {
+		gm.rs.ConnContext = strictConnContext
+		gm.rs.Handler = http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			restoreTLS(req)
+			handler.ServeHTTP(closeUnlessUpgraded(resp, req), req)
+		})
 	}
 
 	// Attempt to start the service
@@ -99,11 +761,12 @@ func (gm *Proxy) Service() (err error) {
 		err = fmt.Errorf("Setup() must be called")
 	} else {
 		logger.Info("Starting Proxy server at address: %s", gm.config.Addr)
-		gm.exit = make(chan error)
 
-		// Launch the server
+		// Launch the server (once closed the exit is sent by the shutdown)
 		go func() {
-			gm.exit <- gm.Listen()
+			if err := gm.Listen(); err != http.ErrServerClosed {
+				gm.exit <- err
+			}
 		}()
 
 		// Block until we receive the exit
@@ -113,33 +776,45 @@ func (gm *Proxy) Service() (err error) {
 	return
 }
 
-// Listen will create the handler using the configuration to determine whether to use
-// SSL (you have to specifically disable SSL) and whether you provide your own
-// cert files or to use letsencrypt to automatically get the certs (by default)
+// Listen will create the listeners and the redirect/admin servers and then
+// serve the requests until the proxy is shutdown
 func (gm *Proxy) Listen() error {
 	addr := ParseHost(gm.config.Addr)
 	logger.Info("Address: %s", addr)
-	var ln net.Listener
-	var err error
+	tlsConfig, err := gm.tlsConfig()
+	if err != nil {
+		logger.Fatal("Cannot get SSL listener: %s", err.Error())
+	}
 
-	// If the certificates have been provided then use them otherwise
-	// use the auto letsencrypt
-	if gm.config.SSL.Default.CertFile != "" && gm.config.SSL.Default.KeyFile != "" {
-		ln, err = TLS(addr, gm.config.SSL.Default.CertFile, gm.config.SSL.Default.KeyFile)
-	} else if !gm.config.SSL.DisableLetsEncrypt {
-		if gm.config.Prod {
-			ln, err = LETSENCRYPTPROD(addr)
-		} else {
-			ln, err = LETSENCRYPT(addr)
+	if tlsConfig != nil && (gm.fingerprints != nil || gm.errorLogs != nil) {
+		tlsConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			if gm.fingerprints != nil {
+				gm.fingerprints.capture(hello)
+			}
+			if gm.errorLogs != nil {
+				gm.errorLogs.captureServerName(hello)
+			}
+			return nil, nil
 		}
-	} else {
-
-		// Fall back to a standard listener
-		ln, err = TCP4(addr)
 	}
+	if tlsConfig != nil && gm.clientAuth != nil {
+		gm.clientAuth.configure(tlsConfig)
+	}
+
+	// Open the listeners (more than one when using SO_REUSEPORT)
+	lns, err := gm.listeners(addr)
 	if err != nil {
 		logger.Fatal("Cannot get SSL listener: %s", err.Error())
 	}
+	for i, ln := range lns {
+		if tlsConfig != nil {
+			ln = tls.NewListener(ln, tlsConfig)
+		}
+		if gm.config.Strict.Enable {
+			ln = newStrictListener(ln, gm.config.Strict.MaxHeaderBytes)
+		}
+		lns[i] = ln
+	}
 
 	// If we should redirect the traffic
 	if gm.config.SSL.RedirectHTTP.Enable {
@@ -151,36 +826,211 @@ func (gm *Proxy) Listen() error {
 
 		// We will need to start a second http server to redirect the traffic to
 		// the SSL version
-		gm.vs = &http.Server{
-			Addr: gm.config.SSL.RedirectHTTP.Addr,
-			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var redirect http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+			// What is the host that has been used? We need to redirect this request
+			// to the correct HTTPS URI
+			realHost := r.Host
+			if i := strings.Index(realHost, ":"); i != -1 {
+				realHost = realHost[:i]
+			}
+			redirectTo := "https://" + realHost + realSSLPort + r.RequestURI
+			logger.Debug("Forwarding non-SSL request %s -> https", "http://"+r.Host+r.RequestURI)
+			http.Redirect(w, r, redirectTo, http.StatusMovedPermanently)
+		})
 
-				// What is the host that has been used? We need to redirect this request
-				// to the correct HTTPS URI
-				realHost := r.Host
-				if i := strings.Index(realHost, ":"); i != -1 {
-					realHost = realHost[:i]
-				}
-				redirectTo := "https://" + realHost + realSSLPort + r.RequestURI
-				logger.Debug("Forwarding non-SSL request %s -> https", "http://"+r.Host+r.RequestURI)
-				http.Redirect(w, r, redirectTo, http.StatusMovedPermanently)
-			}),
+		// The HTTP-01 challenges must be answered before redirecting
+		if gm.acme != nil {
+			redirect = gm.acme.httpHandler(redirect)
+		}
+		gm.vs = &http.Server{
+			Addr:    gm.config.SSL.RedirectHTTP.Addr,
+			Handler: redirect,
 		}
 
 		// Attempt to listen to the server
+		vln, err := net.Listen("tcp", gm.vs.Addr)
+		if err != nil {
+			return fmt.Errorf("Cannot get SSL forwarding listener: %s", err.Error())
+		}
+		if gm.config.Strict.Enable {
+			vln = newStrictListener(vln, gm.config.Strict.MaxHeaderBytes)
+		}
 		go func() {
 			logger.Info("Starting SSL forwarding server at address: %s", gm.vs.Addr)
-			if err = gm.vs.ListenAndServe(); err != nil {
+			if err := gm.vs.Serve(vln); err != nil && err != http.ErrServerClosed {
 				logger.Fatal("Cannot get SSL listener: %s", err.Error())
 			}
 		}()
 	}
-	return gm.rs.Serve(ln)
+
+	// If the admin server should be started
+	if gm.config.Admin.Addr != "" {
+		if gm.config.Admin.Internal {
+			if err := checkInternalAddr(gm.config.Admin.Addr); err != nil {
+				return err
+			}
+		}
+		adminTLS, err := gm.adminTLSConfig(tlsConfig)
+		if err != nil {
+			return fmt.Errorf("Cannot get admin TLS configuration: %s", err.Error())
+		}
+		adminHandler, err := gm.adminHandler()
+		if err != nil {
+			return fmt.Errorf("Cannot get admin handler: %s", err.Error())
+		}
+		gm.as = &http.Server{
+			Addr:    gm.config.Admin.Addr,
+			Handler: adminHandler,
+		}
+		aln, err := net.Listen("tcp", gm.as.Addr)
+		if err != nil {
+			return fmt.Errorf("Cannot get admin listener: %s", err.Error())
+		}
+		if adminTLS != nil {
+			aln = tls.NewListener(aln, adminTLS)
+		}
+		go func() {
+			logger.Info("Starting admin server at address: %s", gm.as.Addr)
+			if err := gm.as.Serve(aln); err != nil && err != http.ErrServerClosed {
+				logger.Error("Admin server has stopped: %s", err.Error())
+			}
+		}()
+	}
+
+	// Each additional listener is served separately
+	for _, ln := range lns[1:] {
+		go func(ln net.Listener) {
+			if err := gm.rs.Serve(ln); err != nil && err != http.ErrServerClosed {
+				logger.Error("Listener has stopped: %s", err.Error())
+			}
+		}(ln)
+	}
+
+	// All the listeners are bound so the proxy is ready to serve
+	gm.markReady()
+	return gm.rs.Serve(lns[0])
+}
+
+// tlsConfig will return the TLS configuration using the configuration to
+// determine whether to use SSL (you have to specifically disable SSL) and
+// whether you provide your own cert files, the local CA or to use letsencrypt
+// to automatically get the certs (by default). Nil is returned when SSL has
+// been disabled.
+func (gm *Proxy) tlsConfig() (*tls.Config, error) {
+
+	// If the certificates have been provided then use them otherwise
+	// use the auto letsencrypt
+	if gm.config.SSL.Default.CertFile != "" && gm.config.SSL.Default.KeyFile != "" {
+		return fileTLSConfig(gm.config.SSL.Default.CertFile, gm.config.SSL.Default.KeyFile)
+	} else if gm.config.SSL.LocalCA.Enable {
+
+		// Issue the certificates using the local development CA
+		ca, err := newLocalCA(gm.config.SSL.LocalCA)
+		if err != nil {
+			return nil, err
+		}
+		ca.routed = gm.isRouted
+		if gm.config.Prod {
+			logger.Warn("The local CA is enabled in production - the certificates will not be trusted by the clients")
+		}
+		logger.Info("Issuing the certificates using the local CA - run 'gomost ca' for how to trust it")
+		return &tls.Config{GetCertificate: ca.GetCertificate}, nil
+	} else if gm.config.SSL.DisableLetsEncrypt {
+
+		// Fall back to a standard listener
+		return nil, nil
+	} else if !gm.config.Prod {
+		return letsencryptTLSConfig()
+	}
+	var shared autocert.Cache
+	if gm.cluster != nil {
+		shared = gm.cluster.certCache()
+	}
+	var err error
+	if gm.acme, err = newACMEManager(gm.config.SSL.ACME, shared); err != nil {
+		return nil, err
+	}
+	gm.acme.events = gm.events
+	if gm.cluster != nil {
+		gm.acme.followCluster(gm.cluster)
+	}
+	return gm.acme.tlsConfig(), nil
+}
+
+// listeners will open the TCP listeners for the address. When reuseport
+// is configured multiple listeners are opened on the same port using
+// SO_REUSEPORT allowing the kernel to balance the connections between them
+// to avoid the contention of a single accept loop.
+func (gm *Proxy) listeners(addr string) ([]net.Listener, error) {
+	n := gm.config.ReusePort
+	if n == 0 {
+		ln, err := TCP4(addr)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{ln}, nil
+	} else if n < 0 {
+		n = runtime.NumCPU()
+	}
+	lns := make([]net.Listener, 0, n)
+	for i := 0; i < n; i++ {
+		ln, err := reusePortListener(addr)
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return nil, err
+		}
+		lns = append(lns, ln)
+	}
+	logger.Info("Opened %d listeners using SO_REUSEPORT", n)
+	return lns, nil
+}
+
+// OnShutdown will add a callback that is called during the shutdown once the
+// in-flight requests have completed. The callbacks are called in the order
+// they were added and the context expires with the drain timeout.
+func (gm *Proxy) OnShutdown(f func(context.Context) error) {
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+	gm.onShutdown = append(gm.onShutdown, f)
+}
+
+// OnReady will add a callback that is called once all the listeners have
+// been bound and the proxy is serving requests
+func (gm *Proxy) OnReady(f func()) {
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+	gm.onReady = append(gm.onReady, f)
+}
+
+// Ready will return a channel that is closed once all the listeners have
+// been bound and the proxy is serving requests
+func (gm *Proxy) Ready() <-chan struct{} {
+	return gm.ready
+}
+
+// markReady will signal that the proxy is ready and call the callbacks
+func (gm *Proxy) markReady() {
+	gm.readyOnce.Do(func() {
+		logger.Info("Proxy is ready")
+		close(gm.ready)
+		gm.mu.RLock()
+		callbacks := gm.onReady
+		gm.mu.RUnlock()
+		for _, f := range callbacks {
+			f()
+		}
+	})
 }
 
-// Shutdown will force the Service function to exit
+// Shutdown will stop accepting new connections and wait for the in-flight
+// requests to complete before forcing the Service function to exit
 func (gm *Proxy) Shutdown() {
-	gm.exit <- nil
+	gm.shutdown.Do(func() {
+		gm.exit <- gm.drain()
+	})
 }
 
 // Proxy not really a proxy, it's just
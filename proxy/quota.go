@@ -0,0 +1,509 @@
+// Copyright 2016 Landonia Ltd. All rights reserved.
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// The quota periods
+const (
+	QuotaDay   = "day"
+	QuotaMonth = "month"
+)
+
+// The actions taken once a quota has been exceeded
+const (
+	QuotaReject   = "reject"
+	QuotaThrottle = "throttle"
+	QuotaNotify   = "notify"
+)
+
+const (
+	// DefaultQuotaDelay is the milliseconds a throttled request is delayed
+	DefaultQuotaDelay = 1000
+	// DefaultQuotaRate is the KB per second a throttled response is written at
+	DefaultQuotaRate = 64
+	// quotaSaveInterval is how often the usage is saved to the file
+	quotaSaveInterval = time.Minute
+	// quotaMeterBytes is the bytes a request transfers before they are added
+	// to the usage
+	quotaMeterBytes = 64 << 10
+)
+
+// QuotaUsage is the usage of a host within a period
+type QuotaUsage struct {
+	Period   string `yaml:"period"`   // The period being counted (e.g. 2016-04-01 or 2016-04)
+	Requests int64  `yaml:"requests"` // The requests handled
+	Bytes    int64  `yaml:"bytes"`    // The bytes received and sent
+}
+
+// QuotaStats is the usage of a host with the quotas that have been exceeded
+type QuotaStats struct {
+	Host     string     `yaml:"host"`
+	Day      QuotaUsage `yaml:"day"`
+	Month    QuotaUsage `yaml:"month"`
+	Exceeded []string   `yaml:"exceeded,omitempty"` // The quotas exceeded (e.g. 1000 requests per day)
+}
+
+// hostUsage is the daily and monthly usage of a host
+type hostUsage struct {
+	Day   QuotaUsage `yaml:"day"`
+	Month QuotaUsage `yaml:"month"`
+}
+
+// quotas will count the requests and bytes transferred by each host with a
+// quota and reject, throttle or notify once a quota has been exceeded. The
+// periods are calendar days and months in UTC.
+type quotas struct {
+	file     string
+	events   *Events
+	byHost   map[string][]QuotaConfig // The quotas by host
+	mu       sync.Mutex               // Guards the usage
+	usage    map[string]*hostUsage    // The usage by host
+	notified map[string]string        // The period each exceeded quota was last published for
+	stop     chan struct{}
+}
+
+// newQuotas will validate the quotas and load any saved usage
+func newQuotas(conf QuotasConfig, events *Events) (*quotas, error) {
+	q := &quotas{
+		file:     conf.File,
+		events:   events,
+		byHost:   make(map[string][]QuotaConfig),
+		usage:    make(map[string]*hostUsage),
+		notified: make(map[string]string),
+		stop:     make(chan struct{}),
+	}
+	for _, limit := range conf.Limits {
+		if limit.Period == "" {
+			limit.Period = QuotaDay
+		}
+		if limit.Period != QuotaDay && limit.Period != QuotaMonth {
+			return nil, fmt.Errorf("Unknown quota period: %s", limit.Period)
+		}
+		if limit.Action == "" {
+			limit.Action = QuotaReject
+		}
+		if limit.Action != QuotaReject && limit.Action != QuotaThrottle && limit.Action != QuotaNotify {
+			return nil, fmt.Errorf("Unknown quota action: %s", limit.Action)
+		}
+		if limit.Requests <= 0 && limit.Transfer <= 0 {
+			return nil, fmt.Errorf("The quota requests or transfer must be provided for %s", strings.Join(limit.Hosts, ", "))
+		}
+		if limit.Delay <= 0 {
+			limit.Delay = DefaultQuotaDelay
+		}
+		if limit.Rate <= 0 {
+			limit.Rate = DefaultQuotaRate
+		}
+		for _, host := range limit.Hosts {
+			host = strings.ToLower(host)
+			q.byHost[host] = append(q.byHost[host], limit)
+		}
+	}
+	if q.file != "" {
+		b, err := os.ReadFile(q.file)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("Could not read quota usage: %s", err.Error())
+		}
+		if err = yaml.Unmarshal(b, &q.usage); err != nil {
+			return nil, fmt.Errorf("Could not parse quota usage: %s", err.Error())
+		}
+		if q.usage == nil {
+			q.usage = make(map[string]*hostUsage)
+		}
+	}
+	return q, nil
+}
+
+// middleware will count the usage of the hosts with a quota and apply the
+// action of any quota that has been exceeded
+func (q *quotas) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		host := canonicalHost(req)
+		limits := q.byHost[host]
+		if len(limits) == 0 {
+			next.ServeHTTP(resp, req)
+			return
+		}
+		now := time.Now()
+		limit, admitted := q.admit(host, limits, now)
+		if !admitted {
+			logger.Debug("Rejecting request to %s: the %s quota has been exceeded", req.Host, limit.Period)
+			resp.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(quotaPeriodEnd(limit.Period, now).Sub(now).Seconds()))))
+			http.Error(resp, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+		meter := &quotaMeter{q: q, host: host}
+		defer meter.flush()
+		rec := &quotaRecorder{statusRecorder: statusRecorder{ResponseWriter: resp, status: http.StatusOK}, meter: meter}
+		if limit != nil && limit.Action == QuotaThrottle {
+			timer := time.NewTimer(time.Duration(limit.Delay) * time.Millisecond)
+			select {
+			case <-timer.C:
+			case <-req.Context().Done():
+				timer.Stop()
+				return
+			}
+			rec.rate = limit.Rate * 1024
+		}
+		if req.Body != nil && req.Body != http.NoBody {
+			req.Body = &countingReader{ReadCloser: req.Body, meter: meter}
+		}
+		next.ServeHTTP(rec, req)
+	})
+}
+
+// admit will count the request against the quotas of the host unless it
+// must be rejected. The request is counted while the usage is checked so
+// that concurrent requests cannot all be admitted at the limit. It returns
+// the exceeded quota with the most restrictive action (nil if none have
+// been exceeded) and whether the request is admitted. The quotas are
+// published the first time they are exceeded within each period.
+func (q *quotas) admit(host string, limits []QuotaConfig, now time.Time) (*QuotaConfig, bool) {
+	var exceeded *QuotaConfig
+	var events []Event
+	q.mu.Lock()
+	for i := range limits {
+		limit := &limits[i]
+		u := q.current(host, limit.Period, now)
+		if !quotaExceeded(*limit, *u) {
+			continue
+		}
+		if exceeded == nil || quotaSeverity(limit.Action) > quotaSeverity(exceeded.Action) {
+			exceeded = limit
+		}
+		key := host + " " + strconv.Itoa(i)
+		if q.notified[key] != u.Period {
+			q.notified[key] = u.Period
+			events = append(events, Event{Type: EventQuotaExceeded, Host: host, Detail: quotaName(*limit) + " (" + limit.Action + ")"})
+		}
+	}
+	admitted := exceeded == nil || exceeded.Action != QuotaReject
+	if admitted {
+		for _, period := range []string{QuotaDay, QuotaMonth} {
+			q.current(host, period, now).Requests++
+		}
+	}
+	q.mu.Unlock()
+	for _, event := range events {
+		logger.Warn("The %s quota of %s has been exceeded", event.Detail, host)
+		q.events.Publish(event)
+	}
+	return exceeded, admitted
+}
+
+// addBytes will record the bytes transferred
+func (q *quotas) addBytes(host string, n int64, now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, period := range []string{QuotaDay, QuotaMonth} {
+		q.current(host, period, now).Bytes += n
+	}
+}
+
+// current will return the usage of the host for the current period starting
+// a new count when the period has ended. The lock must be held.
+func (q *quotas) current(host, period string, now time.Time) *QuotaUsage {
+	hu, exists := q.usage[host]
+	if !exists {
+		hu = &hostUsage{}
+		q.usage[host] = hu
+	}
+	u := &hu.Day
+	if period == QuotaMonth {
+		u = &hu.Month
+	}
+	if key := quotaPeriod(period, now); u.Period != key {
+		*u = QuotaUsage{Period: key}
+	}
+	return u
+}
+
+// stats will return the usage of each host with a quota
+func (q *quotas) stats() []QuotaStats {
+	now := time.Now()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var stats []QuotaStats
+	for host, limits := range q.byHost {
+		s := QuotaStats{
+			Host:  host,
+			Day:   *q.current(host, QuotaDay, now),
+			Month: *q.current(host, QuotaMonth, now),
+		}
+		for _, limit := range limits {
+			if quotaExceeded(limit, *q.current(host, limit.Period, now)) {
+				s.Exceeded = append(s.Exceeded, quotaName(limit))
+			}
+		}
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Host < stats[j].Host })
+	return stats
+}
+
+// reset will clear the usage of the host
+func (q *quotas) reset(host string) {
+	host = strings.ToLower(host)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.usage, host)
+	for key := range q.notified {
+		if strings.HasPrefix(key, host+" ") {
+			delete(q.notified, key)
+		}
+	}
+}
+
+// start will save the usage to the file at each interval until shutdown
+func (q *quotas) start() {
+	if q.file == "" {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(quotaSaveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-q.stop:
+				return
+			case <-ticker.C:
+				if err := q.save(); err != nil {
+					logger.Error(err.Error())
+				}
+			}
+		}
+	}()
+}
+
+// shutdown will stop saving the usage and save it a final time
+func (q *quotas) shutdown(ctx context.Context) error {
+	close(q.stop)
+	if q.file == "" {
+		return nil
+	}
+	return q.save()
+}
+
+// save will write the usage to the file replacing it atomically
+func (q *quotas) save() error {
+	q.mu.Lock()
+	b, err := yaml.Marshal(q.usage)
+	q.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("Could not marshal quota usage: %s", err.Error())
+	}
+	tmp := q.file + ".tmp"
+	if err = os.WriteFile(tmp, b, 0600); err == nil {
+		err = os.Rename(tmp, q.file)
+	}
+	if err != nil {
+		return fmt.Errorf("Could not save quota usage: %s", err.Error())
+	}
+	return nil
+}
+
+// quotaExceeded will return true if the usage has reached the quota
+func quotaExceeded(limit QuotaConfig, u QuotaUsage) bool {
+	return (limit.Requests > 0 && u.Requests >= limit.Requests) ||
+		(limit.Transfer > 0 && u.Bytes >= limit.Transfer<<20)
+}
+
+// quotaSeverity orders the actions from the least to the most restrictive
+func quotaSeverity(action string) int {
+	switch action {
+	case QuotaReject:
+		return 2
+	case QuotaThrottle:
+		return 1
+	}
+	return 0
+}
+
+// quotaName will describe the quota (e.g. 1000 requests per day)
+func quotaName(limit QuotaConfig) string {
+	var parts []string
+	if limit.Requests > 0 {
+		parts = append(parts, fmt.Sprintf("%d requests", limit.Requests))
+	}
+	if limit.Transfer > 0 {
+		parts = append(parts, fmt.Sprintf("%dMB", limit.Transfer))
+	}
+	return strings.Join(parts, " or ") + " per " + limit.Period
+}
+
+// quotaPeriod will return the key of the period containing the time
+func quotaPeriod(period string, t time.Time) string {
+	if period == QuotaMonth {
+		return t.UTC().Format("2006-01")
+	}
+	return t.UTC().Format("2006-01-02")
+}
+
+// quotaPeriodEnd will return when the period containing the time ends
+func quotaPeriodEnd(period string, t time.Time) time.Time {
+	t = t.UTC()
+	if period == QuotaMonth {
+		return time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+}
+
+// quotaMeter counts the bytes transferred by a request adding them to the
+// usage as they flow so that long lived streams and upgraded connections
+// are counted while they are open rather than once they have finished
+type quotaMeter struct {
+	q       *quotas
+	host    string
+	pending int64 // The bytes counted but not yet added to the usage
+}
+
+// count will add the bytes adding them to the usage once enough are pending
+func (m *quotaMeter) count(n int) {
+	if n > 0 && atomic.AddInt64(&m.pending, int64(n)) >= quotaMeterBytes {
+		m.flush()
+	}
+}
+
+// flush will add any pending bytes to the usage
+func (m *quotaMeter) flush() {
+	if n := atomic.SwapInt64(&m.pending, 0); n > 0 {
+		m.q.addBytes(m.host, n, time.Now())
+	}
+}
+
+// quotaRecorder counts the bytes written and writes them at the rate (in
+// bytes per second) once the host is being throttled
+type quotaRecorder struct {
+	statusRecorder
+	meter *quotaMeter
+	rate  int
+}
+
+// Write will count the bytes delaying each write so that the response is
+// sent at the rate
+func (r *quotaRecorder) Write(b []byte) (int, error) {
+	n, err := r.statusRecorder.Write(b)
+	r.meter.count(n)
+	if r.rate > 0 && n > 0 {
+		r.statusRecorder.Flush()
+		time.Sleep(time.Duration(n) * time.Second / time.Duration(r.rate))
+	}
+	return n, err
+}
+
+// Hijack will take over the connection counting the bytes sent in both
+// directions until it is closed
+func (r *quotaRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(r.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Any bytes already buffered are counted and read before the connection
+	buffered, _ := brw.Reader.Peek(brw.Reader.Buffered())
+	r.meter.count(len(buffered))
+	cc := &quotaConn{Conn: conn, meter: r.meter}
+	reader := io.MultiReader(bytes.NewReader(append([]byte(nil), buffered...)), cc)
+	return cc, bufio.NewReadWriter(bufio.NewReader(reader), bufio.NewWriter(cc)), nil
+}
+
+// quotaConn counts the bytes of a hijacked connection
+type quotaConn struct {
+	net.Conn
+	meter *quotaMeter
+}
+
+// Read will count the bytes read
+func (c *quotaConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.meter.count(n)
+	return n, err
+}
+
+// Write will count the bytes written
+func (c *quotaConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.meter.count(n)
+	return n, err
+}
+
+// Close will add the remaining bytes to the usage
+func (c *quotaConn) Close() error {
+	c.meter.flush()
+	return c.Conn.Close()
+}
+
+// countingReader counts the bytes read from the request body
+type countingReader struct {
+	io.ReadCloser
+	meter *quotaMeter
+}
+
+// Read will count the bytes read
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.meter.count(n)
+	return n, err
+}
+
+// QuotaUsage will return the usage of each host with a quota
+func (gm *Proxy) QuotaUsage() []QuotaStats {
+	if gm.quotas == nil {
+		return nil
+	}
+	return gm.quotas.stats()
+}
+
+// adminQuotas will write the usage of each host with a quota or reset the
+// usage of the host parameter. As the usage may be billed the credentials
+// limited to specific hosts cannot reset it.
+func (gm *Proxy) adminQuotas(resp http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		host := req.FormValue("host")
+		if cred, _ := req.Context().Value(adminContextKey{}).(*AdminCredential); cred != nil && len(cred.Hosts) > 0 {
+			http.Error(resp, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		if gm.quotas != nil {
+			gm.quotas.reset(host)
+		}
+	default:
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	stats := []QuotaStats{}
+	for _, s := range gm.QuotaUsage() {
+		if adminCanAccess(req, s.Host) {
+			stats = append(stats, s)
+		}
+	}
+	b, err := yaml.Marshal(stats)
+	if err != nil {
+		logger.Error("Could not marshal quota usage: %s", err.Error())
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/x-yaml")
+	resp.Write(b)
+}
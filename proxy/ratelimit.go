@@ -0,0 +1,107 @@
+// Copyright 2016 Landonia Ltd. All rights reserved.
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// DefaultRateLimitWindow is the seconds of each rate limit window
+	DefaultRateLimitWindow = 60
+	// DefaultBanDuration is the seconds a client is banned for
+	DefaultBanDuration = 3600
+)
+
+// rateLimiter will restrict the requests each client can make to the host
+// within each window rejecting the others with a 429. Clients that keep
+// exceeding the limit are banned and rejected with a 403 until the ban
+// expires. The counters and bans are kept within the state store so that
+// they are shared by the replicas when the store is shared.
+type rateLimiter struct {
+	host     string
+	conf     RateLimitConfig
+	key      func(*http.Request) string
+	window   time.Duration
+	duration time.Duration
+	state    stateStore
+	events   *Events
+	next     http.Handler
+}
+
+// newRateLimiter will create the rate limiter for the host configuration
+func newRateLimiter(conf HostConfig, state stateStore, events *Events, next http.Handler) (*rateLimiter, error) {
+	key, err := hashKey(conf.RateLimit.Key)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid rate limit key: %s", err.Error())
+	}
+	return &rateLimiter{
+		host:     conf.Proxy,
+		conf:     conf.RateLimit,
+		key:      key,
+		window:   seconds(conf.RateLimit.Window, DefaultRateLimitWindow),
+		duration: seconds(conf.RateLimit.Ban.Duration, DefaultBanDuration),
+		state:    state,
+		events:   events,
+		next:     next,
+	}, nil
+}
+
+// ServeHTTP will forward the request if the client is within the limit. The
+// requests are allowed when the store cannot be reached so that an outage
+// of a shared store does not take down the proxy.
+func (rl *rateLimiter) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	client := rl.key(req)
+	ctx := req.Context()
+	now := time.Now()
+	window := now.Truncate(rl.window)
+	key := "rate+" + rl.host + "+" + client + "+" + strconv.FormatInt(window.Unix(), 10)
+
+	// The ban is checked and the request counted at once so that a shared
+	// store is only called once for each request
+	count, err := rl.state.incrUnless(ctx, key, "ban+"+rl.host+"+"+client, rl.window)
+	if err != nil {
+		logger.Warn("Could not count the requests to %s: %s", rl.host, err.Error())
+	} else if count == 0 {
+		logger.Debug("Rejecting request to %s: %s is banned", rl.host, client)
+		resp.WriteHeader(http.StatusForbidden)
+		return
+	} else if count > int64(rl.conf.Requests) {
+		logger.Debug("Rejecting request to %s: %s is over the rate limit", rl.host, client)
+		if rl.conf.Ban.After > 0 {
+			rl.strike(ctx, client)
+		}
+		retry := int(window.Add(rl.window).Sub(now)/time.Second) + 1
+		resp.Header().Set("Retry-After", strconv.Itoa(retry))
+		resp.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+	rl.next.ServeHTTP(resp, req)
+}
+
+// strike will count the rejection of the client banning the client once
+// it has been rejected too many times within the ban duration
+func (rl *rateLimiter) strike(ctx context.Context, client string) {
+	strikes, err := rl.state.incr(ctx, "strike+"+rl.host+"+"+client, rl.duration)
+	if err != nil {
+		logger.Warn("Could not count the rejections of %s: %s", rl.host, err.Error())
+		return
+	} else if strikes != int64(rl.conf.Ban.After) {
+		return
+	}
+	if err := rl.state.set(ctx, "ban+"+rl.host+"+"+client, time.Now().Add(rl.duration).Format(time.RFC3339), rl.duration); err != nil {
+		logger.Warn("Could not ban %s from %s: %s", client, rl.host, err.Error())
+		return
+	}
+	logger.Info("Banned %s from %s for %s", client, rl.host, rl.duration)
+	rl.events.Publish(Event{
+		Type:   EventBanApplied,
+		Host:   rl.host,
+		Route:  "proxy " + rl.host,
+		Detail: fmt.Sprintf("%s banned for %s after %d rejected requests", client, rl.duration, strikes),
+	})
+}
@@ -0,0 +1,317 @@
+// Copyright 2016 Landonia Ltd. All rights reserved.
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	// DefaultRedisTimeout is the milliseconds to wait for each redis command
+	DefaultRedisTimeout = 2000
+	// DefaultRedisPoolSize is the most connections opened to redis
+	DefaultRedisPoolSize = 10
+
+	// redisMinBackoff and redisMaxBackoff bound how long the commands fail
+	// without trying redis after it could not be connected to
+	redisMinBackoff = time.Second
+	redisMaxBackoff = 30 * time.Second
+)
+
+// errRedisUnavailable is returned without trying redis while backing off
+var errRedisUnavailable = errors.New("redis is unavailable")
+
+// redisCache will store the entries in redis allowing the cluster state, the
+// leader lease, the ACME challenges and the certificates to be shared
+// between the replicas (it is also the connection of the redis state store).
+// The connections are pooled and any connection that fails a command is
+// closed. Once redis cannot be connected to, the commands fail immediately
+// for a backoff (doubling while it remains down) with a single command
+// trying to reconnect after each backoff so that an outage does not hold up
+// the requests.
+type redisCache struct {
+	addr     string
+	password string
+	db       int
+	prefix   string
+	useTLS   bool
+	timeout  time.Duration
+	slots    chan struct{}
+	idle     chan *redisConn
+	mu       sync.Mutex
+	backoff  time.Duration
+	retry    time.Time
+}
+
+// redisConn is a single connection to redis
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// newRedisCache will create a cache using the addr, password, db, prefix,
+// tls and timeout options
+func newRedisCache(options map[string]string) (autocert.Cache, error) {
+	return newRedis(options)
+}
+
+// newRedis will create the connection pool using the options
+func newRedis(options map[string]string) (*redisCache, error) {
+	rc := &redisCache{
+		addr:     options["addr"],
+		password: options["password"],
+		prefix:   options["prefix"],
+		useTLS:   options["tls"] == "true",
+		timeout:  DefaultRedisTimeout * time.Millisecond,
+	}
+	if rc.addr == "" {
+		rc.addr = "127.0.0.1:6379"
+	}
+	if db := options["db"]; db != "" {
+		var err error
+		if rc.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("The redis db option must be a number: %s", err.Error())
+		}
+	}
+	if timeout := options["timeout"]; timeout != "" {
+		ms, err := strconv.Atoi(timeout)
+		if err != nil {
+			return nil, fmt.Errorf("The redis timeout option must be a number: %s", err.Error())
+		}
+		rc.timeout = time.Duration(ms) * time.Millisecond
+	}
+	size := DefaultRedisPoolSize
+	if poolSize := options["poolsize"]; poolSize != "" {
+		var err error
+		if size, err = strconv.Atoi(poolSize); err != nil || size < 1 {
+			return nil, fmt.Errorf("The redis poolsize option must be a positive number: %q", poolSize)
+		}
+	}
+	rc.slots = make(chan struct{}, size)
+	rc.idle = make(chan *redisConn, size)
+	return rc, nil
+}
+
+// Get returns the certificate data for the specified key
+func (rc *redisCache) Get(ctx context.Context, key string) ([]byte, error) {
+	b, err := rc.do(ctx, "GET", rc.prefix+key)
+	if err != nil {
+		return nil, err
+	} else if b == nil {
+		return nil, autocert.ErrCacheMiss
+	}
+	return b, nil
+}
+
+// Put stores the data in the cache under the specified key. The
+// certificates and the cluster state are kept until they are replaced while
+// the entries that expire are stored using PutExpiring.
+func (rc *redisCache) Put(ctx context.Context, key string, data []byte) error {
+	_, err := rc.do(ctx, "SET", rc.prefix+key, string(data))
+	return err
+}
+
+// PutExpiring stores the data in the cache until the ttl has passed
+func (rc *redisCache) PutExpiring(ctx context.Context, key string, data []byte, ttl time.Duration) error {
+	_, err := rc.do(ctx, "SET", rc.prefix+key, string(data), "PX", milliseconds(ttl))
+	return err
+}
+
+// redisCompareAndSwap replaces the entry only if it is missing (when the
+// first argument is 0) or matches the second argument
+const redisCompareAndSwap = `local v = redis.call('GET', KEYS[1])
+if v == false then
+  if ARGV[1] ~= '0' then return 0 end
+elseif ARGV[1] ~= '1' or v ~= ARGV[2] then
+  return 0
+end
+redis.call('SET', KEYS[1], ARGV[3])
+return 1`
+
+// CompareAndSwap will store the data only if the current entry is old
+func (rc *redisCache) CompareAndSwap(ctx context.Context, key string, old, data []byte) (bool, error) {
+	exists := "1"
+	if old == nil {
+		exists = "0"
+	}
+	b, err := rc.do(ctx, "EVAL", redisCompareAndSwap, "1", rc.prefix+key, exists, string(old), string(data))
+	return string(b) == "1", err
+}
+
+// Delete removes a certificate data from the cache under the specified key
+func (rc *redisCache) Delete(ctx context.Context, key string) error {
+	_, err := rc.do(ctx, "DEL", rc.prefix+key)
+	return err
+}
+
+// do will send the command using an idle connection (or a new one when
+// there are none) returning the bulk string reply (nil if the reply is nil)
+func (rc *redisCache) do(ctx context.Context, args ...string) ([]byte, error) {
+	if err := rc.available(); err != nil {
+		return nil, err
+	}
+	select {
+	case rc.slots <- struct{}{}:
+		defer func() { <-rc.slots }()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	var conn *redisConn
+	select {
+	case conn = <-rc.idle:
+	default:
+		var err error
+		if conn, err = rc.connect(ctx); err != nil {
+			rc.failed(err)
+			return nil, fmt.Errorf("Could not connect to redis: %s", err.Error())
+		}
+		rc.connected()
+	}
+	b, err := conn.command(ctx, rc.timeout, args...)
+	if _, isReply := err.(redisError); err != nil && !isReply {
+
+		// The connection is in an unknown state so it cannot be reused
+		conn.Close()
+		return nil, err
+	}
+
+	// There is always room as every open connection holds a slot
+	rc.idle <- conn
+	return b, err
+}
+
+// available will return an error while backing off allowing a single
+// command through to reconnect once the backoff has passed
+func (rc *redisCache) available() error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.backoff == 0 {
+		return nil
+	}
+	now := time.Now()
+	if now.Before(rc.retry) {
+		return errRedisUnavailable
+	}
+	rc.retry = now.Add(rc.timeout)
+	return nil
+}
+
+// failed will back off after redis could not be connected to
+func (rc *redisCache) failed(err error) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.backoff == 0 {
+		rc.backoff = redisMinBackoff
+	} else if rc.backoff *= 2; rc.backoff > redisMaxBackoff {
+		rc.backoff = redisMaxBackoff
+	}
+	rc.retry = time.Now().Add(rc.backoff)
+	logger.Warn("Could not connect to redis at %s, retrying in %s: %s", rc.addr, rc.backoff, err.Error())
+}
+
+// connected will stop backing off once redis has been connected to
+func (rc *redisCache) connected() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.backoff != 0 {
+		rc.backoff = 0
+		logger.Info("Reconnected to redis at %s", rc.addr)
+	}
+}
+
+// connect will open a connection then authenticate and select the db
+func (rc *redisCache) connect(ctx context.Context) (*redisConn, error) {
+	dialer := &net.Dialer{Timeout: rc.timeout}
+	var conn net.Conn
+	var err error
+	if rc.useTLS {
+		conn, err = (&tls.Dialer{NetDialer: dialer}).DialContext(ctx, "tcp", rc.addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", rc.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{Conn: conn, r: bufio.NewReader(conn)}
+	if rc.password != "" {
+		if _, err = c.command(ctx, rc.timeout, "AUTH", rc.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if rc.db != 0 {
+		if _, err = c.command(ctx, rc.timeout, "SELECT", strconv.Itoa(rc.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// command will write the command and read the reply
+func (c *redisConn) command(ctx context.Context, timeout time.Duration, args ...string) ([]byte, error) {
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	c.SetDeadline(deadline)
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		buf = append(buf, "$"+strconv.Itoa(len(arg))+"\r\n"...)
+		buf = append(buf, arg...)
+		buf = append(buf, "\r\n"...)
+	}
+	if _, err := c.Write(buf); err != nil {
+		return nil, err
+	}
+	return c.reply()
+}
+
+// reply will read a single reply returning the bulk string (or the simple
+// string/integer as text)
+func (c *redisConn) reply() ([]byte, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	} else if len(line) < 3 {
+		return nil, fmt.Errorf("Invalid redis reply: %q", line)
+	}
+	line = line[:len(line)-2]
+	switch line[0] {
+	case '+', ':':
+		return []byte(line[1:]), nil
+	case '-':
+		return nil, redisError(line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid redis bulk length: %q", line)
+		} else if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+	return nil, fmt.Errorf("Unexpected redis reply: %q", line)
+}
+
+// redisError is an error returned by the redis server
+type redisError string
+
+func (re redisError) Error() string {
+	return "redis: " + string(re)
+}
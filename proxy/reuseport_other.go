@@ -0,0 +1,17 @@
+// Copyright 2016 Landonia Ltd. All rights reserved.
+
+//go:build !linux
+// +build !linux
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+)
+
+// reusePortListener is only supported on linux where the kernel balances
+// the connections between the listeners
+func reusePortListener(addr string) (net.Listener, error) {
+	return nil, fmt.Errorf("SO_REUSEPORT listeners are only supported on linux")
+}
@@ -0,0 +1,130 @@
+// Copyright 2016 Landonia Ltd. All rights reserved.
+
+package proxy
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Route is a single entry within the resolved routing table
+type Route struct {
+	Host   string      `yaml:"host" json:"host"`                       // The host (or * for every host)
+	Match  string      `yaml:"match" json:"match"`                     // The match type (rule, file, wellknown, handler, matcher, alias, proxy, static, default, redirect)
+	Path   string      `yaml:"path" json:"path"`                       // The path or expression matched
+	Target string      `yaml:"target" json:"target"`                   // Where the request is sent
+	TLS    string      `yaml:"tls" json:"tls"`                         // The source of the TLS certificate
+	Stats  *RouteStats `yaml:"stats,omitempty" json:"stats,omitempty"` // The live counters (only provided by the admin server)
+}
+
+// Routes will return the routing table resolved from the configuration and
+// the registered handlers in the order that they are matched
+func (gm *Proxy) Routes() []Route {
+	gm.mu.RLock()
+	defer gm.mu.RUnlock()
+	var routes []Route
+	for _, r := range gm.rules {
+		target := r.conf.Host
+		if r.conf.File != "" {
+			target = r.conf.File
+		}
+		routes = append(routes, Route{Host: "*", Match: "rule", Path: r.conf.Match, Target: target})
+	}
+	for _, f := range gm.config.Files {
+		hosts := f.Hosts
+		if len(hosts) == 0 {
+			hosts = []string{"*"}
+		}
+		target := "inline"
+		if f.File != "" {
+			target = f.File
+		}
+		for _, host := range hosts {
+			routes = append(routes, Route{Host: host, Match: "file", Path: f.Path, Target: target})
+		}
+	}
+	for _, conf := range gm.config.WellKnown {
+		hosts := conf.Hosts
+		if len(hosts) == 0 {
+			hosts = []string{"*"}
+		}
+		target := conf.Upstream
+		if target == "" {
+			target = conf.Dir
+		}
+		for _, host := range hosts {
+			routes = append(routes, Route{Host: host, Match: "wellknown", Path: conf.Path, Target: target})
+		}
+	}
+	var hosts []Route
+	for host := range gm.handlers {
+		hosts = append(hosts, Route{Host: host, Match: "handler", Target: "local"})
+	}
+	for _, conf := range gm.config.Proxies {
+		target := strings.Join(append([]string{conf.Host}, conf.Hosts...), ",")
+		hosts = append(hosts, Route{Host: conf.Proxy, Match: "proxy", Target: target})
+	}
+	for alias, host := range gm.aliases {
+		hosts = append(hosts, Route{Host: alias, Match: "alias", Target: host})
+	}
+	for _, conf := range gm.config.StaticHosts {
+		for _, host := range conf.Hosts {
+			hosts = append(hosts, Route{Host: host, Match: "static", Target: conf.DocRoot})
+		}
+	}
+	if gm.config.StaticDir != "" {
+		if entries, err := os.ReadDir(gm.config.StaticDir); err == nil {
+			for _, entry := range entries {
+				if entry.IsDir() {
+					hosts = append(hosts, Route{Host: entry.Name(), Match: "static", Target: gm.config.StaticDir})
+				}
+			}
+		}
+	}
+	sort.SliceStable(hosts, func(i, j int) bool { return hosts[i].Host < hosts[j].Host })
+	routes = append(routes, hosts...)
+	for i := range gm.matchers {
+		routes = append(routes, Route{Host: fmt.Sprintf("matcher #%d", i+1), Match: "matcher", Target: "local"})
+	}
+	if gm.config.DefaultProxy != "" {
+		routes = append(routes, Route{Host: "*", Match: "default", Target: gm.config.DefaultProxy})
+	} else if gm.config.StaticDir != "" {
+		routes = append(routes, Route{Host: "*", Match: "static", Target: gm.config.StaticDir})
+	}
+	if gm.config.SSL.RedirectHTTP.Enable {
+		routes = append(routes, Route{Host: "*", Match: "redirect", Target: "https", TLS: "none"})
+	}
+	for i := range routes {
+		if routes[i].TLS == "" {
+			routes[i].TLS = gm.tlsSource(routes[i].Host)
+		}
+	}
+	return routes
+}
+
+// tlsSource will describe where the certificate for the host is obtained
+func (gm *Proxy) tlsSource(host string) string {
+	ssl := gm.config.SSL
+	if ssl.Default.CertFile != "" && ssl.Default.KeyFile != "" {
+		return "file " + ssl.Default.CertFile
+	} else if ssl.LocalCA.Enable {
+		return "local CA"
+	} else if ssl.DisableLetsEncrypt {
+		return "none"
+	} else if !gm.config.Prod {
+		return "letsencrypt (development)"
+	}
+	if canonical, exists := gm.aliases[strings.ToLower(host)]; exists {
+		host = canonical
+	}
+	for _, account := range ssl.ACME.Accounts {
+		for _, h := range account.Hosts {
+			if strings.EqualFold(h, host) {
+				return "acme account " + account.Name
+			}
+		}
+	}
+	return "acme default account"
+}
@@ -0,0 +1,208 @@
+// Copyright 2016 Landonia Ltd. All rights reserved.
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// explainHeader is sent by trusted clients to have the routing decision
+	// returned within the response headers
+	explainHeader = "X-Gomost-Explain"
+	// routeHeader is returned to trusted clients with the matched route
+	routeHeader = "X-Gomost-Route"
+	// upstreamHealthThreshold is the consecutive failed (or successful)
+	// requests before the upstream of a route is considered down (or up)
+	upstreamHealthThreshold = 3
+)
+
+// routeContextKey is used to store the route of the request within the
+// context so the upstream failures can be attributed to it
+type routeContextKey struct{}
+
+// unreachableContextKey is used to store the flag that is set when the
+// proxy could not reach the upstream of the route
+type unreachableContextKey struct{}
+
+// RouteStats are the live counters of a route
+type RouteStats struct {
+	Requests  int64   `yaml:"requests" json:"requests"`   // The requests handled
+	Errors    int64   `yaml:"errors" json:"errors"`       // The responses with a 5xx status
+	InFlight  int64   `yaml:"inflight" json:"inflight"`   // The requests currently being handled
+	LatencyMS float64 `yaml:"latencyms" json:"latencyms"` // The average milliseconds to handle a request
+	Health    string  `yaml:"health" json:"health"`       // Whether the upstream is up, down or unknown
+	LastSeen  string  `yaml:"lastseen" json:"lastseen"`   // When the last request was handled
+}
+
+// routeCounter holds the counters of a single route
+type routeCounter struct {
+	requests int64
+	errors   int64
+	inFlight int64
+	latency  int64 // The total nanoseconds
+	lastSeen int64 // The unix nanoseconds
+	down     int32 // Set to 1 while the upstream is considered down
+	streak   int64 // The consecutive requests that disagree with the health
+}
+
+// routeStats are the counters for every route that has handled a request
+type routeStats struct {
+	mu       sync.RWMutex
+	counters map[string]*routeCounter // The counters by route type and name
+}
+
+// newRouteStats will create the route counters
+func newRouteStats() *routeStats {
+	return &routeStats{counters: make(map[string]*routeCounter)}
+}
+
+// counter will return the counter for the route creating it if required
+func (rs *routeStats) counter(kind, name string) *routeCounter {
+	key := kind + "|" + name
+	rs.mu.RLock()
+	c, exists := rs.counters[key]
+	rs.mu.RUnlock()
+	if exists {
+		return c
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if c, exists = rs.counters[key]; !exists {
+		c = &routeCounter{}
+		rs.counters[key] = c
+	}
+	return c
+}
+
+// get will return the statistics of the route
+func (rs *routeStats) get(kind, name string) RouteStats {
+	rs.mu.RLock()
+	c, exists := rs.counters[kind+"|"+name]
+	rs.mu.RUnlock()
+	stats := RouteStats{Health: "unknown"}
+	if !exists {
+		return stats
+	}
+	stats.Requests = atomic.LoadInt64(&c.requests)
+	stats.Errors = atomic.LoadInt64(&c.errors)
+	stats.InFlight = atomic.LoadInt64(&c.inFlight)
+	if stats.Requests > 0 {
+		stats.LatencyMS = float64(atomic.LoadInt64(&c.latency)) / float64(stats.Requests) / float64(time.Millisecond)
+		stats.LastSeen = time.Unix(0, atomic.LoadInt64(&c.lastSeen)).UTC().Format(time.RFC3339)
+
+		stats.Health = "up"
+		if atomic.LoadInt32(&c.down) == 1 {
+			stats.Health = "down"
+		}
+	}
+	return stats
+}
+
+// dispatch will forward the request to the handler of the route recording
+// the counters and explaining the decision to trusted clients. When the
+// host was requested using an alias the request is also counted for the
+// alias.
+func (gm *Proxy) dispatch(resp http.ResponseWriter, req *http.Request, kind, name, reason string, handler http.Handler, alias ...string) {
+	gm.trace(kind, name, req)
+	if req.Header.Get(explainHeader) != "" {
+		req.Header.Del(explainHeader)
+		if gm.isTrusted(req) {
+			resp.Header().Set(routeHeader, kind+" "+name)
+			resp.Header().Set(explainHeader, reason)
+		}
+	}
+	counters := []*routeCounter{gm.stats.counter(kind, name)}
+	for _, a := range alias {
+		counters = append(counters, gm.stats.counter("alias", a))
+	}
+	for _, counter := range counters {
+		atomic.AddInt64(&counter.inFlight, 1)
+	}
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: resp, status: http.StatusOK}
+	route := kind + " " + name
+	unreachable := new(int32)
+	ctx := context.WithValue(req.Context(), unreachableContextKey{}, unreachable)
+	if gm.echoing || gm.events.active() {
+		ctx = context.WithValue(ctx, routeContextKey{}, Event{Host: req.Host, Route: route})
+	}
+	req = req.WithContext(ctx)
+	if gm.events.active() {
+		gm.events.Publish(Event{Type: EventRequestStarted, Time: start, Host: req.Host, Route: route, Request: req})
+		defer func() {
+			gm.events.Publish(Event{Type: EventRequestCompleted, Host: req.Host, Route: route,
+				Status: rec.status, Duration: time.Since(start), Request: req})
+		}()
+	}
+	defer func() {
+		failed := atomic.LoadInt32(unreachable) == 1
+		for i, counter := range counters {
+			atomic.AddInt64(&counter.inFlight, -1)
+			atomic.AddInt64(&counter.requests, 1)
+			atomic.AddInt64(&counter.latency, int64(time.Since(start)))
+			atomic.StoreInt64(&counter.lastSeen, time.Now().UnixNano())
+			if rec.status >= 500 {
+				atomic.AddInt64(&counter.errors, 1)
+			}
+
+			// Publish when the upstream of the route goes down or comes back
+			// up (the aliases share the upstream so only the route publishes)
+			if changed, down := counter.observe(int64(rec.status), failed); changed && i == 0 {
+				event := Event{Type: EventUpstreamUp, Route: route, Status: rec.status}
+				if down {
+					event.Type = EventUpstreamDown
+				}
+				gm.events.Publish(event)
+			}
+		}
+		if rec.status >= 500 && gm.errorLogs != nil {
+			gm.errorLogs.log(canonicalHost(req), "5xx", fmt.Sprintf("%s %s %d (%s %s)", req.Method, req.RequestURI, rec.status, kind, name))
+		}
+	}()
+	handler.ServeHTTP(rec, req)
+}
+
+// observe will record the outcome of the request returning true (and the
+// new health) when the health of the upstream changes. The health only
+// changes once the outcome has disagreed with it for the threshold of
+// consecutive requests so that an occasional 502 or 504 returned by the
+// upstream itself does not flap the health. The upstream is considered down
+// straight away when the proxy could not reach it.
+func (c *routeCounter) observe(status int64, unreachable bool) (bool, bool) {
+	failed := unreachable || isUpstreamDown(status)
+	down := atomic.LoadInt32(&c.down) == 1
+	if failed == down {
+		atomic.StoreInt64(&c.streak, 0)
+		return false, down
+	}
+	if !unreachable && atomic.AddInt64(&c.streak, 1) < upstreamHealthThreshold {
+		return false, down
+	}
+	var from, to int32 = 0, 1
+	if down {
+		from, to = 1, 0
+	}
+	if !atomic.CompareAndSwapInt32(&c.down, from, to) {
+		return false, !down
+	}
+	atomic.StoreInt64(&c.streak, 0)
+	return true, failed
+}
+
+// isUpstreamDown will return true if the status is returned by the proxy
+// when the upstream cannot be reached
+func isUpstreamDown(status int64) bool {
+	return status == http.StatusBadGateway || status == http.StatusGatewayTimeout
+}
+
+// isTrusted will return true if the client is allowed to see how the request
+// was routed
+func (gm *Proxy) isTrusted(req *http.Request) bool {
+	return containsIP(gm.trusted, requestRemoteIP(req))
+}
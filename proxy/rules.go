@@ -0,0 +1,436 @@
+// Copyright 2016 Landonia Ltd. All rights reserved.
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// rule will forward any request matching the compiled expression (or serve
+// the file)
+type rule struct {
+	conf    RuleConfig
+	match   func(*http.Request) bool
+	handler http.Handler
+}
+
+// newRule will compile the rule expression and create the reverse proxy
+func (gm *Proxy) newRule(conf RuleConfig) (*rule, error) {
+	match, err := CompileRule(conf.Match)
+	if err != nil {
+		return nil, fmt.Errorf("Could not compile rule %q: %s", conf.Match, err.Error())
+	}
+	if conf.File != "" {
+		if conf.Host != "" {
+			return nil, fmt.Errorf("Either a host or a file must be provided for rule %q", conf.Match)
+		}
+		return &rule{conf: conf, match: match, handler: http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			resp.Header().Set("Cache-Control", "no-store")
+			http.ServeFile(resp, req, conf.File)
+		})}, nil
+	}
+	rp, err := gm.newReverseProxy(HostConfig{Host: conf.Host})
+	if err != nil {
+		return nil, err
+	}
+	return &rule{conf: conf, match: match, handler: rp}, nil
+}
+
+// CompileRule will compile the routing expression returning a function that
+// reports whether a request matches. Expressions are made up of:
+//
+//	host, path, method, scheme, remoteaddr     - request values
+//	header("Name"), query("name"), cookie("name") - request values by name
+//	"text" or 'text', true, false              - literals
+//	value.startsWith("a"), .endsWith, .contains - string tests
+//	schedule("* 9-17 * * mon-fri")             - true during the cron schedule
+//	==, !=, &&, ||, ! and parentheses          - operators
+//
+// For example: host == "api.example.com" && path.startsWith("/v2")
+func CompileRule(src string) (func(*http.Request) bool, error) {
+	p := &ruleParser{src: src}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, fmt.Errorf("Unexpected %q at position %d", p.tok.text, p.tok.pos)
+	}
+	if e.bool == nil {
+		return nil, fmt.Errorf("The expression must be a boolean")
+	}
+	return e.bool, nil
+}
+
+// ruleExpr is a compiled expression which is either a string or a boolean
+type ruleExpr struct {
+	str  func(*http.Request) string
+	bool func(*http.Request) bool
+}
+
+// The token types
+const (
+	tokEOF = iota
+	tokIdent
+	tokString
+	tokOp
+)
+
+// ruleToken is a single token within the expression
+type ruleToken struct {
+	kind int
+	text string
+	pos  int
+}
+
+// ruleParser is a recursive descent parser for the rule expressions
+type ruleParser struct {
+	src string
+	pos int
+	tok ruleToken
+}
+
+// next will read the next token
+func (p *ruleParser) next() error {
+	for p.pos < len(p.src) && unicode.IsSpace(rune(p.src[p.pos])) {
+		p.pos++
+	}
+	start := p.pos
+	if p.pos >= len(p.src) {
+		p.tok = ruleToken{kind: tokEOF, pos: start}
+		return nil
+	}
+	c := p.src[p.pos]
+	switch {
+	case c == '"' || c == '\'':
+		var sb strings.Builder
+		for p.pos++; p.pos < len(p.src) && p.src[p.pos] != c; p.pos++ {
+			if p.src[p.pos] == '\\' && p.pos+1 < len(p.src) {
+				p.pos++
+			}
+			sb.WriteByte(p.src[p.pos])
+		}
+		if p.pos >= len(p.src) {
+			return fmt.Errorf("Unterminated string at position %d", start)
+		}
+		p.pos++
+		p.tok = ruleToken{kind: tokString, text: sb.String(), pos: start}
+	case c == '_' || unicode.IsLetter(rune(c)):
+		for p.pos < len(p.src) && (p.src[p.pos] == '_' || unicode.IsLetter(rune(p.src[p.pos])) || unicode.IsDigit(rune(p.src[p.pos]))) {
+			p.pos++
+		}
+		p.tok = ruleToken{kind: tokIdent, text: p.src[start:p.pos], pos: start}
+	default:
+		for _, op := range []string{"==", "!=", "&&", "||", "!", "(", ")", ",", "."} {
+			if strings.HasPrefix(p.src[p.pos:], op) {
+				p.pos += len(op)
+				p.tok = ruleToken{kind: tokOp, text: op, pos: start}
+				return nil
+			}
+		}
+		return fmt.Errorf("Unexpected %q at position %d", c, start)
+	}
+	return nil
+}
+
+// accept will consume the operator if it is the current token
+func (p *ruleParser) accept(op string) (bool, error) {
+	if p.tok.kind == tokOp && p.tok.text == op {
+		return true, p.next()
+	}
+	return false, nil
+}
+
+// expect will consume the operator or return an error
+func (p *ruleParser) expect(op string) error {
+	if ok, err := p.accept(op); err != nil || ok {
+		return err
+	}
+	return fmt.Errorf("Expected %q at position %d", op, p.tok.pos)
+}
+
+// parseOr parses: and ('||' and)*
+func (p *ruleParser) parseOr() (ruleExpr, error) {
+	left, err := p.parseAnd()
+	for err == nil {
+		var ok bool
+		if ok, err = p.accept("||"); err != nil || !ok {
+			break
+		}
+		var right ruleExpr
+		if right, err = p.parseAnd(); err == nil {
+			if left.bool == nil || right.bool == nil {
+				return left, fmt.Errorf("The || operator requires boolean values")
+			}
+			l, r := left.bool, right.bool
+			left = ruleExpr{bool: func(req *http.Request) bool { return l(req) || r(req) }}
+		}
+	}
+	return left, err
+}
+
+// parseAnd parses: unary ('&&' unary)*
+func (p *ruleParser) parseAnd() (ruleExpr, error) {
+	left, err := p.parseUnary()
+	for err == nil {
+		var ok bool
+		if ok, err = p.accept("&&"); err != nil || !ok {
+			break
+		}
+		var right ruleExpr
+		if right, err = p.parseUnary(); err == nil {
+			if left.bool == nil || right.bool == nil {
+				return left, fmt.Errorf("The && operator requires boolean values")
+			}
+			l, r := left.bool, right.bool
+			left = ruleExpr{bool: func(req *http.Request) bool { return l(req) && r(req) }}
+		}
+	}
+	return left, err
+}
+
+// parseUnary parses: '!' unary | comparison
+func (p *ruleParser) parseUnary() (ruleExpr, error) {
+	if ok, err := p.accept("!"); err != nil {
+		return ruleExpr{}, err
+	} else if ok {
+		e, err := p.parseUnary()
+		if err != nil {
+			return e, err
+		}
+		if e.bool == nil {
+			return e, fmt.Errorf("The ! operator requires a boolean value")
+		}
+		b := e.bool
+		return ruleExpr{bool: func(req *http.Request) bool { return !b(req) }}, nil
+	}
+	return p.parseComparison()
+}
+
+// parseComparison parses: postfix (('==' | '!=') postfix)?
+func (p *ruleParser) parseComparison() (ruleExpr, error) {
+	left, err := p.parsePostfix()
+	if err != nil || p.tok.kind != tokOp || (p.tok.text != "==" && p.tok.text != "!=") {
+		return left, err
+	}
+	op := p.tok.text
+	if err = p.next(); err != nil {
+		return left, err
+	}
+	right, err := p.parsePostfix()
+	if err != nil {
+		return right, err
+	}
+	var eq func(*http.Request) bool
+	switch {
+	case left.str != nil && right.str != nil:
+		l, r := left.str, right.str
+		eq = func(req *http.Request) bool { return l(req) == r(req) }
+	case left.bool != nil && right.bool != nil:
+		l, r := left.bool, right.bool
+		eq = func(req *http.Request) bool { return l(req) == r(req) }
+	default:
+		return left, fmt.Errorf("Cannot compare a string with a boolean")
+	}
+	if op == "!=" {
+		return ruleExpr{bool: func(req *http.Request) bool { return !eq(req) }}, nil
+	}
+	return ruleExpr{bool: eq}, nil
+}
+
+// parsePostfix parses: primary ('.' method '(' string ')')*
+func (p *ruleParser) parsePostfix() (ruleExpr, error) {
+	e, err := p.parsePrimary()
+	for err == nil {
+		var ok bool
+		if ok, err = p.accept("."); err != nil || !ok {
+			break
+		}
+		if p.tok.kind != tokIdent {
+			return e, fmt.Errorf("Expected a method at position %d", p.tok.pos)
+		}
+		method := p.tok.text
+		if e.str == nil {
+			return e, fmt.Errorf("The %s method requires a string value", method)
+		}
+		var arg string
+		if err = p.next(); err == nil {
+			arg, err = p.parseArg()
+		}
+		if err != nil {
+			return e, err
+		}
+		var test func(string, string) bool
+		switch method {
+		case "startsWith":
+			test = strings.HasPrefix
+		case "endsWith":
+			test = strings.HasSuffix
+		case "contains":
+			test = strings.Contains
+		default:
+			return e, fmt.Errorf("Unknown method: %s", method)
+		}
+		s := e.str
+		e = ruleExpr{bool: func(req *http.Request) bool { return test(s(req), arg) }}
+	}
+	return e, err
+}
+
+// parseArg parses: '(' string ')'
+func (p *ruleParser) parseArg() (string, error) {
+	if err := p.expect("("); err != nil {
+		return "", err
+	}
+	if p.tok.kind != tokString {
+		return "", fmt.Errorf("Expected a string at position %d", p.tok.pos)
+	}
+	arg := p.tok.text
+	if err := p.next(); err != nil {
+		return "", err
+	}
+	return arg, p.expect(")")
+}
+
+// parsePrimary parses: string | true | false | value | function | '(' or ')'
+func (p *ruleParser) parsePrimary() (ruleExpr, error) {
+	tok := p.tok
+	switch tok.kind {
+	case tokString:
+		return ruleExpr{str: func(*http.Request) string { return tok.text }}, p.next()
+	case tokOp:
+		if tok.text != "(" {
+			break
+		}
+		if err := p.next(); err != nil {
+			return ruleExpr{}, err
+		}
+		e, err := p.parseOr()
+		if err != nil {
+			return e, err
+		}
+		return e, p.expect(")")
+	case tokIdent:
+		if err := p.next(); err != nil {
+			return ruleExpr{}, err
+		}
+		switch tok.text {
+		case "true", "false":
+			b := tok.text == "true"
+			return ruleExpr{bool: func(*http.Request) bool { return b }}, nil
+		case "host":
+			return ruleExpr{str: requestHost}, nil
+		case "path":
+			return ruleExpr{str: func(req *http.Request) string { return req.URL.Path }}, nil
+		case "method":
+			return ruleExpr{str: func(req *http.Request) string { return req.Method }}, nil
+		case "scheme":
+			return ruleExpr{str: requestScheme}, nil
+		case "remoteaddr":
+			return ruleExpr{str: requestRemoteIP}, nil
+		case "schedule":
+			expr, err := p.parseArg()
+			if err != nil {
+				return ruleExpr{}, err
+			}
+			s, err := parseSchedule(expr)
+			if err != nil {
+				return ruleExpr{}, err
+			}
+			return ruleExpr{bool: func(*http.Request) bool { return s.matches(time.Now()) }}, nil
+		case "header", "query", "cookie":
+			name, err := p.parseArg()
+			if err != nil {
+				return ruleExpr{}, err
+			}
+			return ruleExpr{str: namedValue(tok.text, name)}, nil
+		}
+		return ruleExpr{}, fmt.Errorf("Unknown value %q at position %d", tok.text, tok.pos)
+	case tokEOF:
+		return ruleExpr{}, fmt.Errorf("Unexpected end of expression")
+	}
+	return ruleExpr{}, fmt.Errorf("Unexpected %q at position %d", tok.text, tok.pos)
+}
+
+// namedValue will return the function to extract the named value
+func namedValue(kind, name string) func(*http.Request) string {
+	switch kind {
+	case "header":
+		return func(req *http.Request) string { return req.Header.Get(name) }
+	case "query":
+		return func(req *http.Request) string { return req.URL.Query().Get(name) }
+	}
+	return func(req *http.Request) string {
+		if c, err := req.Cookie(name); err == nil {
+			return c.Value
+		}
+		return ""
+	}
+}
+
+// requestHost will return the requested host without the port
+func requestHost(req *http.Request) string {
+	if host, _, err := net.SplitHostPort(req.Host); err == nil {
+		return host
+	}
+	return req.Host
+}
+
+// requestScheme will return the scheme used for the request
+func requestScheme(req *http.Request) string {
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// requestRemoteIP will return the IP of the client
+func requestRemoteIP(req *http.Request) string {
+	if ip, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return ip
+	}
+	return req.RemoteAddr
+}
+
+// parseCIDRs will parse the IPs and CIDRs (an IP is treated as a single
+// address CIDR)
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			if strings.Contains(cidr, ":") {
+				cidr += "/128"
+			} else {
+				cidr += "/32"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+// containsIP will return true if the IP is within any of the networks
+func containsIP(nets []*net.IPNet, ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, ipnet := range nets {
+		if ipnet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,137 @@
+// Copyright 2016 Landonia Ltd. All rights reserved.
+
+package proxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// scheduleNames are the names that can be used for the months and weekdays
+var scheduleNames = []map[string]int{
+	3: {"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6, "jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12},
+	4: {"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6},
+}
+
+// scheduleBounds are the minimum and maximum of each field (a weekday of 7
+// is also Sunday)
+var scheduleBounds = [][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+
+// schedule is a parsed cron expression which matches the minutes within
+// the schedule
+type schedule struct {
+	fields [5]uint64 // The bits set for the minutes, hours, days, months and weekdays
+	anyDay bool      // True if the day of the month is *
+	anyDow bool      // True if the weekday is *
+	loc    *time.Location
+}
+
+// parseSchedule will parse the cron expression made up of the minute, hour,
+// day of the month, month and weekday fields. Each field can be *, a value,
+// a range (1-5), a step (*/15 or 8-18/2) or a list of them (mon,wed,fri).
+// The expression is evaluated using the local time unless it starts with
+// CRON_TZ=<zone> (e.g. CRON_TZ=Europe/London * 9-17 * * mon-fri).
+func parseSchedule(expr string) (*schedule, error) {
+	s := &schedule{loc: time.Local}
+	fields := strings.Fields(expr)
+	if len(fields) > 0 && (strings.HasPrefix(fields[0], "CRON_TZ=") || strings.HasPrefix(fields[0], "TZ=")) {
+		loc, err := time.LoadLocation(fields[0][strings.Index(fields[0], "=")+1:])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid schedule time zone: %s", err.Error())
+		}
+		s.loc, fields = loc, fields[1:]
+	}
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("The schedule must have 5 fields (minute hour day month weekday): %s", expr)
+	}
+	for i, field := range fields {
+		bits, err := parseScheduleField(strings.ToLower(field), i)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid schedule field %q: %s", field, err.Error())
+		}
+		s.fields[i] = bits
+	}
+	if s.fields[4]&(1<<7) != 0 {
+		s.fields[4] |= 1
+	}
+	s.anyDay, s.anyDow = fields[2] == "*", fields[4] == "*"
+	return s, nil
+}
+
+// parseScheduleField will return the bits set for the values of the field
+func parseScheduleField(field string, i int) (uint64, error) {
+	min, max := scheduleBounds[i][0], scheduleBounds[i][1]
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if slash := strings.Index(part, "/"); slash >= 0 {
+			n, err := strconv.Atoi(part[slash+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step %q", part[slash+1:])
+			}
+			part, step = part[:slash], n
+		}
+		start, end := min, max
+		if part != "*" {
+			var err error
+			bounds := strings.SplitN(part, "-", 2)
+			if start, err = scheduleValue(bounds[0], i); err != nil {
+				return 0, err
+			}
+			end = start
+			if len(bounds) == 2 {
+				if end, err = scheduleValue(bounds[1], i); err != nil {
+					return 0, err
+				}
+			} else if step > 1 {
+				end = max
+			}
+		}
+		if start < min || end > max {
+			return 0, fmt.Errorf("%s is not within %d-%d", part, min, max)
+		}
+		if start > end {
+			return 0, fmt.Errorf("%s is not a valid range", part)
+		}
+		for v := start; v <= end; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// scheduleValue will parse the number or name of the field
+func scheduleValue(value string, i int) (int, error) {
+	if i < len(scheduleNames) {
+		if v, exists := scheduleNames[i][value]; exists {
+			return v, nil
+		}
+	}
+	v, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", value)
+	}
+	return v, nil
+}
+
+// matches will return true if the minute of the time is within the
+// schedule. As with cron when both the day of the month and the weekday are
+// restricted either can match.
+func (s *schedule) matches(t time.Time) bool {
+	t = t.In(s.loc)
+	day := s.fields[2]&(1<<uint(t.Day())) != 0
+	dow := s.fields[4]&(1<<uint(t.Weekday())) != 0
+	switch {
+	case s.anyDay && s.anyDow:
+	case s.anyDay:
+		day = dow
+	case !s.anyDow:
+		day = day || dow
+	}
+	return s.fields[0]&(1<<uint(t.Minute())) != 0 &&
+		s.fields[1]&(1<<uint(t.Hour())) != 0 &&
+		s.fields[3]&(1<<uint(t.Month())) != 0 &&
+		day
+}
@@ -0,0 +1,81 @@
+// Copyright 2016 Landonia Ltd. All rights reserved.
+
+package proxy
+
+//go:generate go run schemagen.go
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// Schema will return the JSON Schema of the configuration format allowing
+// editors and CI pipelines to validate and autocomplete the configuration.
+// The schema is built from the yaml tags of the Configuration and the
+// descriptions are generated from the field comments using go generate.
+func Schema() ([]byte, error) {
+	schema := schemaOf(reflect.TypeOf(Configuration{}), "Configuration")
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	schema["title"] = "gomost configuration"
+	return json.MarshalIndent(schema, "", "  ")
+}
+
+// schemaOf will return the schema of the type where the key is used to find
+// the descriptions of the struct fields
+func schemaOf(t reflect.Type, key string) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaOf(t.Elem(), key)
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemaOf(t.Elem(), key)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaOf(t.Elem(), key)}
+	case reflect.Struct:
+		properties := make(map[string]interface{})
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+			if f.PkgPath != "" || name == "-" {
+				continue
+			} else if name == "" {
+				name = strings.ToLower(f.Name)
+			}
+
+			// Named types have their own descriptions
+			fieldKey := key + "." + f.Name
+			childKey := fieldKey
+			if ft := indirectType(f.Type); ft.Name() != "" && ft.Kind() == reflect.Struct {
+				childKey = ft.Name()
+			}
+			s := schemaOf(f.Type, childKey)
+			if desc, exists := schemaDescriptions[fieldKey]; exists {
+				s["description"] = desc
+			}
+			properties[name] = s
+		}
+		return map[string]interface{}{
+			"type":                 "object",
+			"properties":           properties,
+			"additionalProperties": false,
+		}
+	}
+	return map[string]interface{}{}
+}
+
+// indirectType will return the element type of any pointer, slice or map
+func indirectType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Map {
+		t = t.Elem()
+	}
+	return t
+}
@@ -0,0 +1,209 @@
+// Code generated by schemagen.go; DO NOT EDIT.
+
+package proxy
+
+// schemaDescriptions are the descriptions of the configuration fields
+var schemaDescriptions = map[string]string{
+	"ACMEAccount.Directory":                   "The CA directory URL (LetsEncrypt by default)",
+	"ACMEAccount.EAB":                         "The external account binding of the account",
+	"ACMEAccount.Email":                       "The email of the account",
+	"ACMEAccount.Hosts":                       "The hosts that will use this account",
+	"ACMEAccount.Name":                        "The unique name used to store the account key",
+	"ACMEConfig.Accounts":                     "The accounts to use for specific hosts",
+	"ACMEConfig.Cache":                        "The certificate cache backend (shared between instances)",
+	"ACMEConfig.CacheDir":                     "The certificate cache directory",
+	"ACMEConfig.Directory":                    "The CA directory URL (LetsEncrypt by default)",
+	"ACMEConfig.EAB":                          "The external account binding of the default account",
+	"ACMEConfig.Email":                        "The email of the default account",
+	"AdminCredential.Hosts":                   "The only hosts that can be viewed or changed (all if empty)",
+	"AdminCredential.Name":                    "The name of the credential",
+	"AdminCredential.Password":                "The basic auth password (or bcrypt hash)",
+	"AdminCredential.Role":                    "Either read or write to also allow changes (required)",
+	"AdminCredential.Scopes":                  "The endpoints that can be used (e.g. routes, proxies or * for all)",
+	"AdminCredential.Subject":                 "The client certificate subject attributes, any of which must match (e.g. OU=Ops)",
+	"AdminCredential.Token":                   "The bearer token",
+	"AdminCredential.Username":                "The basic auth username",
+	"AdminTLSConfig.CertFile":                 "The certfile path",
+	"AdminTLSConfig.ClientCAFile":             "The CA certificates used to verify the client certificates",
+	"AdminTLSConfig.KeyFile":                  "The keyfile path",
+	"AdminTLSConfig.RequireClientCert":        "True if every client must provide a verified certificate",
+	"AdminTLSConfig.Reuse":                    "True to reuse the main certificate when no files are provided",
+	"AlertConfig.Events":                      "The event types to send (all except the request events if empty)",
+	"AlertConfig.Interval":                    "The minimum seconds between alerts for the same event type and host (300 by default)",
+	"AlertConfig.Options":                     "The options passed to the notifier",
+	"AlertConfig.Type":                        "The registered notifier (slack, email or pagerduty)",
+	"CacheConfig.Options":                     "The options passed to the cache",
+	"CacheConfig.Type":                        "The registered cache type (dir by default)",
+	"CaptureConfig.Dir":                       "The directory the HAR files are written to (./captures by default)",
+	"CaptureConfig.MaxBody":                   "The KB of each body recorded (64 by default)",
+	"CaptureConfig.MaxCount":                  "The maximum requests a capture can record (1000 by default)",
+	"CaptureConfig.Redact":                    "The headers, cookies and query parameters redacted (Authorization, Proxy-Authorization, Cookie and Set-Cookie are always redacted)",
+	"ClientAuthConfig.CAFile":                 "The CA certificates used to verify the clients (disabled if empty)",
+	"ClientAuthConfig.Hosts":                  "The hosts that require an authorised certificate",
+	"ClientAuthConfig.SubjectHeader":          "The request header used to forward the verified subject",
+	"ClientCertRule.Host":                     "The host requiring a certificate",
+	"ClientCertRule.Issuer":                   "The issuer attributes, any of which must match",
+	"ClientCertRule.SAN":                      "The subject alternative names, any of which must match",
+	"ClientCertRule.Subject":                  "The subject attributes, any of which must match (e.g. OU=Ops)",
+	"ClusterConfig.Enable":                    "True if the instance should join the cluster",
+	"ClusterConfig.Interval":                  "The seconds between checking the store for changes",
+	"ClusterConfig.Node":                      "The unique name of the node (hostname by default)",
+	"ClusterConfig.Store":                     "The store shared by all the nodes",
+	"Configuration.AccessLog":                 "The file to write the access log to (disabled if empty)",
+	"Configuration.Addr":                      "The host to locally bind",
+	"Configuration.Admin":                     "The admin information",
+	"Configuration.Admin.Addr":                "The address of the admin server (disabled if empty)",
+	"Configuration.Admin.Capture":             "The request capture information",
+	"Configuration.Admin.Credentials":         "The credentials allowed to use the admin server (open if empty)",
+	"Configuration.Admin.Internal":            "True if the admin server must be bound to a loopback or private address",
+	"Configuration.Admin.TLS":                 "The TLS information of the admin server",
+	"Configuration.Admin.Trusted":             "The client IPs/CIDRs that can use the X-Gomost-Explain header",
+	"Configuration.Alerts":                    "The notifiers the events are sent to",
+	"Configuration.Aliases":                   "The alternative hosts that are routed as the host",
+	"Configuration.BufferSize":                "The KB of each buffer used to copy the proxied responses",
+	"Configuration.Cluster":                   "The cluster information",
+	"Configuration.DefaultProxy":              "The upstream for any host that is not routed (disabled if empty)",
+	"Configuration.EchoHosts":                 "The hosts that echo back the request they receive (e.g. debug.localhost)",
+	"Configuration.ErrorLogs":                 "The files the errors of each host are written to",
+	"Configuration.Files":                     "The files served directly for the hosts",
+	"Configuration.Fingerprint":               "The TLS fingerprint information",
+	"Configuration.LoadShedding":              "The load shedding information",
+	"Configuration.LogFile":                   "The file the log is written to instead of stdout (not supported on windows)",
+	"Configuration.LogLevel":                  "The log level to use",
+	"Configuration.Maintenance":               "The scheduled maintenance windows of hosts",
+	"Configuration.MemoryBudget":              "The MB available to the caches and buffers (unlimited if 0)",
+	"Configuration.OIDC":                      "Require the users of hosts to sign in with an OIDC provider",
+	"Configuration.Plugins":                   "The plugins to enable",
+	"Configuration.Prod":                      "Whether in production (this will change the SSL handler)",
+	"Configuration.Proxies":                   "The proxy information",
+	"Configuration.Quotas":                    "The request and transfer quotas of hosts",
+	"Configuration.ReusePort":                 "The listeners to open using SO_REUSEPORT (one per CPU if -1)",
+	"Configuration.Rules":                     "The expression routing rules",
+	"Configuration.SSL":                       "The ssl information",
+	"Configuration.SSL.ACME":                  "The ACME account information",
+	"Configuration.SSL.ClientAuth":            "The client certificate (mTLS) information",
+	"Configuration.SSL.Default.CertFile":      "The certfile path",
+	"Configuration.SSL.Default.KeyFile":       "The keyfile path",
+	"Configuration.SSL.DisableLetsEncrypt":    "True if LetsEncrypt auto SSL should not be used",
+	"Configuration.SSL.LocalCA":               "The local CA used to issue development certificates",
+	"Configuration.SSL.RedirectHTTP.Addr":     "The address of the redirect",
+	"Configuration.SSL.RedirectHTTP.Enable":   "If true this will setup a second server to redirect HTTP -> HTTPS",
+	"Configuration.Scripts":                   "The scripted request/response hooks",
+	"Configuration.Shutdown":                  "The shutdown information",
+	"Configuration.Shutdown.DrainTimeout":     "The seconds to wait for in-flight requests before forcing connections closed",
+	"Configuration.Shutdown.LongLivedTimeout": "The seconds to wait for websocket/event stream connections to finish",
+	"Configuration.State":                     "The store of the rate limits, bans and sticky sessions",
+	"Configuration.StaticDir":                 "The static hosts root directory",
+	"Configuration.StaticHosts":               "The explicitly configured static hosts",
+	"Configuration.Strict":                    "The strict request parsing information",
+	"Configuration.Webhooks":                  "The webhooks the events are sent to",
+	"Configuration.WellKnown":                 "The /.well-known paths routed explicitly",
+	"EABConfig.HMACKey":                       "The base64url encoded HMAC key provided by the CA",
+	"EABConfig.KeyID":                         "The key identifier provided by the CA",
+	"ErrorLogConfig.File":                     "The file the errors are written to",
+	"ErrorLogConfig.Hosts":                    "The hosts writing to the file",
+	"FileConfig.Content":                      "The content of the file",
+	"FileConfig.ContentType":                  "The content type (from the path extension by default)",
+	"FileConfig.File":                         "The local file to serve instead of the content",
+	"FileConfig.Hosts":                        "The hosts serving the file (every host if empty)",
+	"FileConfig.Path":                         "The request path (e.g. /robots.txt)",
+	"FingerprintConfig.Enable":                "True if the fingerprints should be captured",
+	"FingerprintConfig.JA3Header":             "The request header used to forward the JA3 fingerprint",
+	"FingerprintConfig.JA4Header":             "The request header used to forward the JA4 fingerprint",
+	"HostConfig.ForwardProxy":                 "The HTTP proxy used to reach the upstreams (HTTP_PROXY/HTTPS_PROXY/NO_PROXY by default or direct)",
+	"HostConfig.HashKey":                      "The hash strategy key: ip (default), header:Name or cookie:Name",
+	"HostConfig.Hosts":                        "Additional upstream hosts to balance the requests between",
+	"HostConfig.MaxConns":                     "The maximum concurrent requests to the upstreams (unlimited if 0)",
+	"HostConfig.Protocol":                     "The protocol used to the upstreams: http1, http2 or h2c (HTTP/2 when negotiated using TLS by default)",
+	"HostConfig.Queue":                        "The queue information",
+	"HostConfig.Queue.Depth":                  "The maximum requests waiting when at the limit (rejected immediately if 0)",
+	"HostConfig.Queue.Timeout":                "The milliseconds a request can wait before being rejected",
+	"HostConfig.RateLimit":                    "Limit the requests of each client",
+	"HostConfig.SOCKS5":                       "The SOCKS5 proxy the upstreams are dialed through",
+	"HostConfig.Sign":                         "Sign the requests sent to the upstreams",
+	"HostConfig.Sticky":                       "Send the requests of a session to the same upstream",
+	"HostConfig.Strategy":                     "The balancing strategy: roundrobin (default) or hash",
+	"LoadSheddingConfig.Enable":               "True if the load shedding is enabled",
+	"LoadSheddingConfig.Interval":             "The milliseconds between each check",
+	"LoadSheddingConfig.MaxGoroutines":        "The goroutine threshold (ignored if 0)",
+	"LoadSheddingConfig.MaxInFlight":          "The in-flight requests threshold (ignored if 0)",
+	"LoadSheddingConfig.MaxLatency":           "The average latency milliseconds threshold (ignored if 0)",
+	"LoadSheddingConfig.MaxMemory":            "The heap MB threshold (ignored if 0)",
+	"LoadSheddingConfig.Priorities":           "The priority of each host (0 by default, higher is shed last)",
+	"LocalCAConfig.Dir":                       "The directory the CA is created within (./localca by default)",
+	"LocalCAConfig.Enable":                    "True if the certificates should be issued by the local CA",
+	"LocalCAConfig.Hosts":                     "The hosts (or wildcards such as *.dev.test) certificates are issued for (the configured hosts if empty)",
+	"MaintenanceConfig.Allow":                 "The client IPs/CIDRs that can still use the hosts to verify them",
+	"MaintenanceConfig.Duration":              "The minutes the maintenance lasts",
+	"MaintenanceConfig.Hosts":                 "The hosts under maintenance",
+	"MaintenanceConfig.Start":                 "When the maintenance starts (RFC 3339 e.g. 2016-10-02T22:00:00Z)",
+	"MaintenanceConfig.Template":              "The html/template file of the maintenance page (a basic page by default)",
+	"OIDCConfig.Allow":                        "The emails or @domains allowed (any user if empty)",
+	"OIDCConfig.CallbackPath":                 "The path the provider redirects back to (/oauth2/callback by default)",
+	"OIDCConfig.ClientID":                     "The client id registered with the provider",
+	"OIDCConfig.ClientSecret":                 "The client secret registered with the provider",
+	"OIDCConfig.CookieDomain":                 "The parent domain the session cookie is shared with (the host only by default)",
+	"OIDCConfig.CookieName":                   "The session cookie name (_gomost_auth by default)",
+	"OIDCConfig.CookieSecret":                 "The secret the session cookie is encrypted with",
+	"OIDCConfig.Headers":                      "The claim forwarded to the upstream by header (X-Forwarded-User: sub and X-Forwarded-Email: email by default)",
+	"OIDCConfig.Hosts":                        "The hosts requiring authentication",
+	"OIDCConfig.Issuer":                       "The issuer URL of the provider",
+	"OIDCConfig.Scopes":                       "The scopes requested (openid, email and profile by default)",
+	"OIDCConfig.Session":                      "The minutes each session lasts (720 by default)",
+	"OIDCConfig.SignOutPath":                  "The path that clears the session (/oauth2/sign_out by default)",
+	"OIDCConfig.Store":                        "The registered cache the sessions are stored in (within the cookie by default)",
+	"PluginConfig.Name":                       "The registered name of the plugin",
+	"PluginConfig.Options":                    "The options passed to the plugin",
+	"QuotaConfig.Action":                      "Either reject (429), throttle or notify once exceeded (default reject)",
+	"QuotaConfig.Delay":                       "The milliseconds each throttled request is delayed (default 1000)",
+	"QuotaConfig.Hosts":                       "The hosts the quota applies to (each host is counted separately)",
+	"QuotaConfig.Period":                      "Either day or month (calendar periods in UTC, default day)",
+	"QuotaConfig.Rate":                        "The KB per second each throttled response is written at (default 64)",
+	"QuotaConfig.Requests":                    "The maximum requests within the period (0 for no limit)",
+	"QuotaConfig.Transfer":                    "The maximum megabytes received and sent within the period (0 for no limit)",
+	"QuotasConfig.File":                       "The file the usage is saved to so that it survives restarts",
+	"QuotasConfig.Limits":                     "The quotas",
+	"RateLimitConfig.Ban":                     "The ban information",
+	"RateLimitConfig.Ban.After":               "Ban a client once this many requests have been rejected within the duration (disabled if 0)",
+	"RateLimitConfig.Ban.Duration":            "The seconds a client is banned for (3600 by default)",
+	"RateLimitConfig.Key":                     "The key identifying the client: ip (default), header:Name or cookie:Name",
+	"RateLimitConfig.Requests":                "The requests each client can make within the window (unlimited if 0)",
+	"RateLimitConfig.Window":                  "The seconds of each window (60 by default)",
+	"RuleConfig.File":                         "The file served instead of forwarding (e.g. a closed page)",
+	"RuleConfig.Host":                         "The host the request is forwarded to",
+	"RuleConfig.Match":                        "The expression the request must match",
+	"SOCKS5Config.Addr":                       "The host:port of the SOCKS5 proxy",
+	"SOCKS5Config.Password":                   "The password if the proxy requires authentication",
+	"SOCKS5Config.Username":                   "The username if the proxy requires authentication",
+	"ScriptConfig.File":                       "The Starlark script file",
+	"ScriptConfig.Hosts":                      "The hosts the script applies to (all if empty)",
+	"ScriptConfig.MaxSteps":                   "The maximum steps each hook can execute",
+	"ScriptConfig.Timeout":                    "The milliseconds each hook can execute for",
+	"SignConfig.Header":                       "The header the signature is sent in (X-Gomost-Signature by default)",
+	"SignConfig.MaxBody":                      "The KB of a request body that can be signed (1024 by default, larger bodies are rejected with a 413)",
+	"SignConfig.Secret":                       "The shared secret (signing is disabled if empty)",
+	"StateConfig.Options":                     "The options of the store (the same as the redis cache)",
+	"StateConfig.Type":                        "The store: memory (default) or redis (shared by the replicas)",
+	"StaticHostConfig.Cache":                  "The Cache-Control header of the responses (e.g. public, max-age=3600)",
+	"StaticHostConfig.Deny":                   "The path patterns that are never served (e.g. .git or *.bak)",
+	"StaticHostConfig.DocRoot":                "The directory containing the files",
+	"StaticHostConfig.Hosts":                  "The hosts serving the files",
+	"StaticHostConfig.Index":                  "The file served for a directory (index.html by default)",
+	"StaticHostConfig.Listing":                "True to list the directories without an index",
+	"StaticHostConfig.SPA":                    "True to serve the index for any path that is not a file",
+	"StickyConfig.Cookie":                     "The cookie identifying the session (disabled if empty)",
+	"StickyConfig.TTL":                        "The seconds a session is kept since its last request (3600 by default)",
+	"StrictConfig.Enable":                     "True if the requests should be strictly checked",
+	"StrictConfig.MaxHeaderBytes":             "The maximum size of the request head",
+	"WebhookConfig.Events":                    "The event types to send (all except the request events if empty)",
+	"WebhookConfig.Headers":                   "The headers sent with each request (e.g. Authorization)",
+	"WebhookConfig.Retries":                   "The times a failed delivery is retried (3 by default, -1 to disable)",
+	"WebhookConfig.Template":                  "The payload template (the event as JSON if empty)",
+	"WebhookConfig.Timeout":                   "The milliseconds to wait for each delivery (5000 by default)",
+	"WebhookConfig.URL":                       "The URL the events are posted to",
+	"WellKnownConfig.ContentType":             "The content type of the files (from the extension or application/json by default)",
+	"WellKnownConfig.Dir":                     "The directory the files are served from (relative to /.well-known)",
+	"WellKnownConfig.Hosts":                   "The hosts the path is routed for (every host if empty)",
+	"WellKnownConfig.Path":                    "The path (and any path below it) e.g. /.well-known/apple-app-site-association",
+	"WellKnownConfig.Upstream":                "The upstream the requests are forwarded to",
+}
@@ -0,0 +1,80 @@
+// Copyright 2016 Landonia Ltd. All rights reserved.
+
+//go:build ignore
+// +build ignore
+
+// schemagen will generate the descriptions used by the configuration schema
+// from the comments of the fields within config.go
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+func main() {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "config.go", nil, parser.ParseComments)
+	if err != nil {
+		log.Fatalf("Could not parse config.go: %s", err.Error())
+	}
+	descriptions := make(map[string]string)
+	for _, decl := range f.Decls {
+		gd, ok := decl.(*ast.GenDecl)
+		if !ok || gd.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gd.Specs {
+			ts := spec.(*ast.TypeSpec)
+			if st, ok := ts.Type.(*ast.StructType); ok {
+				describe(ts.Name.Name, st, descriptions)
+			}
+		}
+	}
+	keys := make([]string, 0, len(descriptions))
+	for key := range descriptions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	buf.WriteString("// Code generated by schemagen.go; DO NOT EDIT.\n\n")
+	buf.WriteString("package proxy\n\n")
+	buf.WriteString("// schemaDescriptions are the descriptions of the configuration fields\n")
+	buf.WriteString("var schemaDescriptions = map[string]string{\n")
+	for _, key := range keys {
+		fmt.Fprintf(&buf, "\t%q: %q,\n", key, descriptions[key])
+	}
+	buf.WriteString("}\n")
+	b, err := format.Source(buf.Bytes())
+	if err != nil {
+		log.Fatalf("Could not format the descriptions: %s", err.Error())
+	}
+	if err := os.WriteFile("schema_descriptions.go", b, 0644); err != nil {
+		log.Fatalf("Could not write the descriptions: %s", err.Error())
+	}
+}
+
+// describe will add the comment of each field using the key of the struct
+// and recurse into any anonymous structs
+func describe(key string, st *ast.StructType, descriptions map[string]string) {
+	for _, field := range st.Fields.List {
+		for _, name := range field.Names {
+			fieldKey := key + "." + name.Name
+			if field.Comment != nil {
+				descriptions[fieldKey] = strings.TrimSpace(field.Comment.Text())
+			}
+			if nested, ok := field.Type.(*ast.StructType); ok {
+				describe(fieldKey, nested, descriptions)
+			}
+		}
+	}
+}
@@ -0,0 +1,253 @@
+// Copyright 2016 Landonia Ltd. All rights reserved.
+
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.starlark.net/starlark"
+)
+
+const (
+	// DefaultScriptMaxSteps is the maximum steps a script hook can execute
+	DefaultScriptMaxSteps = 100000
+	// DefaultScriptTimeout is the milliseconds a script hook can execute for
+	DefaultScriptTimeout = 50
+)
+
+// script is a loaded Starlark script providing the hooks for the hosts
+type script struct {
+	conf       ScriptConfig
+	hosts      map[string]bool
+	onRequest  starlark.Callable
+	onResponse starlark.Callable
+}
+
+// newScript will load the script and find the hook functions. Scripts may
+// define either or both of:
+//
+//	def on_request(req):   # req is a dict of method, host, path, query and headers
+//	    return None        # or a dict of status, headers and body to respond with
+//
+//	def on_response(resp): # resp is a dict of status and headers
+//	    resp["headers"]["X-Frame-Options"] = "DENY"
+//
+// Any changes made to the dictionaries are applied to the request/response.
+func newScript(conf ScriptConfig) (*script, error) {
+	thread := &starlark.Thread{Name: conf.File}
+	globals, err := starlark.ExecFile(thread, conf.File, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Could not load script %s: %s", conf.File, err.Error())
+	}
+
+	// The hooks are called concurrently so the globals are frozen to stop
+	// the requests sharing (and racing on) any mutable state
+	globals.Freeze()
+	s := &script{conf: conf, hosts: make(map[string]bool)}
+	for _, host := range conf.Hosts {
+		s.hosts[strings.ToLower(host)] = true
+	}
+	s.onRequest, _ = globals["on_request"].(starlark.Callable)
+	s.onResponse, _ = globals["on_response"].(starlark.Callable)
+	if s.onRequest == nil && s.onResponse == nil {
+		return nil, fmt.Errorf("Script %s does not define on_request or on_response", conf.File)
+	}
+	return s, nil
+}
+
+// call will execute the hook within the configured resource limits
+func (s *script) call(fn starlark.Callable, arg *starlark.Dict) (starlark.Value, error) {
+	thread := &starlark.Thread{Name: s.conf.File}
+	steps := s.conf.MaxSteps
+	if steps == 0 {
+		steps = DefaultScriptMaxSteps
+	}
+	thread.SetMaxExecutionSteps(steps)
+	timeout := s.conf.Timeout
+	if timeout <= 0 {
+		timeout = DefaultScriptTimeout
+	}
+	timer := time.AfterFunc(time.Duration(timeout)*time.Millisecond, func() {
+		thread.Cancel("timeout exceeded")
+	})
+	defer timer.Stop()
+	return starlark.Call(thread, fn, starlark.Tuple{arg}, nil)
+}
+
+// middleware will run the hooks for any of the configured hosts
+func (s *script) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if len(s.hosts) > 0 && !s.hosts[canonicalHost(req)] {
+			next.ServeHTTP(resp, req)
+			return
+		}
+		if s.onRequest != nil {
+			d := requestDict(req)
+			v, err := s.call(s.onRequest, d)
+			if err != nil {
+				logger.Error("Script %s on_request failed: %s", s.conf.File, err.Error())
+				resp.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			applyRequestDict(req, d)
+
+			// A returned dict will short circuit the request
+			if r, ok := v.(*starlark.Dict); ok {
+				writeResponseDict(resp, r)
+				return
+			}
+		}
+		if s.onResponse != nil {
+			resp = &scriptResponseWriter{ResponseWriter: resp, script: s}
+		}
+		next.ServeHTTP(resp, req)
+	})
+}
+
+// scriptResponseWriter will call the response hook before the header is
+// written
+type scriptResponseWriter struct {
+	http.ResponseWriter
+	script  *script
+	written bool
+}
+
+// WriteHeader will call the hook allowing the status and headers to change
+func (w *scriptResponseWriter) WriteHeader(status int) {
+	if w.written {
+		return
+	}
+	w.written = true
+	d := starlark.NewDict(2)
+	d.SetKey(starlark.String("status"), starlark.MakeInt(status))
+	d.SetKey(starlark.String("headers"), headerDict(w.Header()))
+	if _, err := w.script.call(w.script.onResponse, d); err != nil {
+		logger.Error("Script %s on_response failed: %s", w.script.conf.File, err.Error())
+	} else {
+		if v, found, _ := d.Get(starlark.String("status")); found {
+			if s, err := starlark.AsInt32(v); err == nil {
+				status = s
+			}
+		}
+		if v, found, _ := d.Get(starlark.String("headers")); found {
+			if h, ok := v.(*starlark.Dict); ok {
+				replaceHeader(w.Header(), h)
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write will ensure the header has been written
+func (w *scriptResponseWriter) Write(b []byte) (int, error) {
+	if !w.written {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush will flush the underlying writer if supported
+func (w *scriptResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		if !w.written {
+			w.WriteHeader(http.StatusOK)
+		}
+		f.Flush()
+	}
+}
+
+// Unwrap will return the underlying writer
+func (w *scriptResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// requestDict will create the dict passed to the request hook
+func requestDict(req *http.Request) *starlark.Dict {
+	d := starlark.NewDict(5)
+	d.SetKey(starlark.String("method"), starlark.String(req.Method))
+	d.SetKey(starlark.String("host"), starlark.String(req.Host))
+	d.SetKey(starlark.String("path"), starlark.String(req.URL.Path))
+	d.SetKey(starlark.String("query"), starlark.String(req.URL.RawQuery))
+	d.SetKey(starlark.String("headers"), headerDict(req.Header))
+	return d
+}
+
+// applyRequestDict will apply any changes made by the hook to the request
+func applyRequestDict(req *http.Request, d *starlark.Dict) {
+	if s, ok := dictString(d, "host"); ok {
+		req.Host = s
+	}
+	if s, ok := dictString(d, "path"); ok && s != req.URL.Path {
+		req.URL.Path = s
+		req.URL.RawPath = ""
+	}
+	if s, ok := dictString(d, "query"); ok {
+		req.URL.RawQuery = s
+	}
+	if v, found, _ := d.Get(starlark.String("headers")); found {
+		if h, ok := v.(*starlark.Dict); ok {
+			replaceHeader(req.Header, h)
+		}
+	}
+}
+
+// writeResponseDict will write the response returned by the hook
+func writeResponseDict(resp http.ResponseWriter, d *starlark.Dict) {
+	status := http.StatusOK
+	if v, found, _ := d.Get(starlark.String("status")); found {
+		if s, err := starlark.AsInt32(v); err == nil {
+			status = s
+		}
+	}
+	if v, found, _ := d.Get(starlark.String("headers")); found {
+		if h, ok := v.(*starlark.Dict); ok {
+			replaceHeader(resp.Header(), h)
+		}
+	}
+	body, _ := dictString(d, "body")
+	resp.WriteHeader(status)
+	resp.Write([]byte(body))
+}
+
+// headerDict will convert the header into a dict of name to value
+func headerDict(h http.Header) *starlark.Dict {
+	d := starlark.NewDict(len(h))
+	for name := range h {
+		d.SetKey(starlark.String(name), starlark.String(h.Get(name)))
+	}
+	return d
+}
+
+// replaceHeader will replace the header values with those from the dict
+func replaceHeader(h http.Header, d *starlark.Dict) {
+	seen := make(map[string]bool)
+	for _, item := range d.Items() {
+		name, ok1 := starlark.AsString(item[0])
+		value, ok2 := starlark.AsString(item[1])
+		if !ok1 || !ok2 {
+			continue
+		}
+		name = http.CanonicalHeaderKey(name)
+		seen[name] = true
+		if h.Get(name) != value {
+			h.Set(name, value)
+		}
+	}
+	for name := range h {
+		if !seen[name] {
+			h.Del(name)
+		}
+	}
+}
+
+// dictString will return the string value of the key
+func dictString(d *starlark.Dict, key string) (string, bool) {
+	v, found, _ := d.Get(starlark.String(key))
+	if !found {
+		return "", false
+	}
+	return starlark.AsString(v)
+}
@@ -0,0 +1,152 @@
+// Copyright 2016 Landonia Ltd. All rights reserved.
+
+package proxy
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultShedInterval is the milliseconds between each pressure check
+	DefaultShedInterval = 1000
+	// shedRecovery is the fraction of a threshold the signals must fall below
+	// before the shedding is reduced to avoid flapping
+	shedRecovery = 0.8
+	// latencyWeight is the weight of each new sample in the average latency
+	latencyWeight = 0.1
+)
+
+// shedder monitors the proxy for resource pressure and rejects the lowest
+// priority traffic while any of the thresholds are exceeded. Each interval
+// spent under pressure sheds the next priority tier (the highest tier is
+// never shed) and each interval spent below the thresholds restores one.
+type shedder struct {
+	conf       LoadSheddingConfig
+	priorities []int          // The distinct priorities in ascending order
+	byHost     map[string]int // The priority of each (lower case) host
+	level      int32          // The requests with a priority below priorities[level] are shed
+	inFlight   int64          // The requests currently being handled
+	latency    uint64         // The average request latency (math.Float64bits of ms)
+	stop       chan struct{}
+}
+
+// newShedder will create the shedder using the configuration
+func newShedder(conf LoadSheddingConfig) *shedder {
+	seen := map[int]bool{0: true}
+	priorities := []int{0}
+	byHost := make(map[string]int)
+	for host, p := range conf.Priorities {
+		byHost[strings.ToLower(host)] = p
+		if !seen[p] {
+			seen[p] = true
+			priorities = append(priorities, p)
+		}
+	}
+	sort.Ints(priorities)
+	return &shedder{conf: conf, priorities: priorities, byHost: byHost, stop: make(chan struct{})}
+}
+
+// middleware will reject the request when its host is being shed otherwise
+// it records the in-flight requests and latency
+func (s *shedder) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if s.byHost[canonicalHost(req)] < s.priorities[atomic.LoadInt32(&s.level)] {
+			logger.Debug("Shedding request to %s: under resource pressure", req.Host)
+			resp.Header().Set("Retry-After", "5")
+			resp.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		// The request is no longer in flight even when the handler panics
+		// (such as the reverse proxy aborting with http.ErrAbortHandler)
+		atomic.AddInt64(&s.inFlight, 1)
+		defer atomic.AddInt64(&s.inFlight, -1)
+		start := time.Now()
+		next.ServeHTTP(resp, req)
+		if !isLongLived(req) {
+			s.record(time.Since(start))
+		}
+	})
+}
+
+// record will add the latency sample to the moving average
+func (s *shedder) record(d time.Duration) {
+	sample := float64(d) / float64(time.Millisecond)
+	for {
+		old := atomic.LoadUint64(&s.latency)
+		avg := math.Float64frombits(old)
+		avg += latencyWeight * (sample - avg)
+		if atomic.CompareAndSwapUint64(&s.latency, old, math.Float64bits(avg)) {
+			return
+		}
+	}
+}
+
+// start will begin monitoring the pressure until shutdown
+func (s *shedder) start() {
+	interval := s.conf.Interval
+	if interval <= 0 {
+		interval = DefaultShedInterval
+	}
+	go func() {
+		ticker := time.NewTicker(time.Duration(interval) * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				s.check()
+			}
+		}
+	}()
+}
+
+// shutdown will stop monitoring the pressure
+func (s *shedder) shutdown(ctx context.Context) error {
+	close(s.stop)
+	return nil
+}
+
+// check will compare the signals to the thresholds and adjust the level
+func (s *shedder) check() {
+	pressure := s.pressure()
+	level := atomic.LoadInt32(&s.level)
+	switch {
+	case pressure > 1 && int(level) < len(s.priorities)-1:
+		level++
+		logger.Warn("Under resource pressure - shedding requests with priority below %d", s.priorities[level])
+	case pressure < shedRecovery && level > 0:
+		level--
+		logger.Info("Resource pressure reduced - shedding requests with priority below %d", s.priorities[level])
+	default:
+		return
+	}
+	atomic.StoreInt32(&s.level, level)
+}
+
+// pressure will return the highest ratio of a signal to its threshold
+func (s *shedder) pressure() float64 {
+	var pressure float64
+	ratio := func(value float64, threshold int) {
+		if threshold > 0 {
+			pressure = math.Max(pressure, value/float64(threshold))
+		}
+	}
+	ratio(float64(runtime.NumGoroutine()), s.conf.MaxGoroutines)
+	ratio(float64(atomic.LoadInt64(&s.inFlight)), s.conf.MaxInFlight)
+	ratio(math.Float64frombits(atomic.LoadUint64(&s.latency)), s.conf.MaxLatency)
+	if s.conf.MaxMemory > 0 {
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		ratio(float64(ms.HeapInuse)/(1<<20), s.conf.MaxMemory)
+	}
+	return pressure
+}
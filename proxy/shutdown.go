@@ -0,0 +1,131 @@
+// Copyright 2016 Landonia Ltd. All rights reserved.
+
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultDrainTimeout is the seconds to wait for in-flight requests
+	DefaultDrainTimeout = 30
+	// DefaultLongLivedTimeout is the seconds to wait for long lived requests
+	DefaultLongLivedTimeout = 5
+)
+
+// drain will perform the shutdown phases. The servers stop accepting new
+// connections, long lived requests are given their own timeout to finish
+// and the in-flight requests have until the drain timeout before any
+// remaining connections are forced closed. Finally the shutdown callbacks
+// are called with whatever remains of the drain timeout.
+func (gm *Proxy) drain() error {
+	conf := gm.Config().Shutdown
+	drainTimeout := seconds(conf.DrainTimeout, DefaultDrainTimeout)
+	longLivedTimeout := seconds(conf.LongLivedTimeout, DefaultLongLivedTimeout)
+	logger.Info("Draining connections (timeout: %s, long lived timeout: %s)", drainTimeout, longLivedTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+
+	// Cancel the long lived requests once their timeout has expired
+	timer := time.AfterFunc(longLivedTimeout, gm.longLived.cancel)
+	defer timer.Stop()
+
+	// Stop all the servers accepting new connections and wait for them to
+	// become idle
+	var wg sync.WaitGroup
+	for _, s := range []*http.Server{gm.rs, gm.vs, gm.as} {
+		if s == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(s *http.Server) {
+			defer wg.Done()
+			if err := s.Shutdown(ctx); err != nil {
+				logger.Warn("Drain timeout exceeded - forcing connections closed at address: %s", s.Addr)
+				s.Close()
+			}
+		}(s)
+	}
+	wg.Wait()
+
+	// Hijacked connections are not tracked by the server so wait for the
+	// long lived requests separately
+	if !gm.longLived.wait(ctx) {
+		logger.Warn("Drain timeout exceeded - forcing long lived requests closed")
+	}
+	gm.longLived.cancel()
+
+	// Allow any callbacks to perform their own shutdown
+	gm.mu.RLock()
+	callbacks := gm.onShutdown
+	gm.mu.RUnlock()
+	for _, f := range callbacks {
+		if err := f(ctx); err != nil {
+			logger.Error("Shutdown callback failed: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// seconds will return the duration or the default when not provided
+func seconds(value, def int) time.Duration {
+	if value <= 0 {
+		value = def
+	}
+	return time.Duration(value) * time.Second
+}
+
+// isLongLived will return true if the request is for a websocket or event
+// stream that would be expected to remain open
+func isLongLived(req *http.Request) bool {
+	return strings.EqualFold(req.Header.Get("Upgrade"), "websocket") ||
+		strings.Contains(req.Header.Get("Accept"), "text/event-stream")
+}
+
+// longLivedTracker keeps track of the long lived requests so that they can
+// be cancelled independently of the rest of the in-flight requests
+type longLivedTracker struct {
+	count  int64              // The number of active requests
+	ctx    context.Context    // Cancelled when the requests should be closed
+	cancel context.CancelFunc // Cancels the context
+}
+
+// newLongLivedTracker will return a new tracker
+func newLongLivedTracker() *longLivedTracker {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &longLivedTracker{ctx: ctx, cancel: cancel}
+}
+
+// track will return the request with a context that is cancelled when the
+// long lived requests are closed along with a function that must be called
+// once the request has completed
+func (t *longLivedTracker) track(req *http.Request) (*http.Request, func()) {
+	atomic.AddInt64(&t.count, 1)
+	ctx, cancel := context.WithCancel(req.Context())
+	stop := context.AfterFunc(t.ctx, cancel)
+	return req.WithContext(ctx), func() {
+		stop()
+		cancel()
+		atomic.AddInt64(&t.count, -1)
+	}
+}
+
+// wait will block until there are no long lived requests remaining returning
+// false if the context expires first
+func (t *longLivedTracker) wait(ctx context.Context) bool {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for atomic.LoadInt64(&t.count) > 0 {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+	return true
+}
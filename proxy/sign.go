@@ -0,0 +1,126 @@
+// Copyright 2016 Landonia Ltd. All rights reserved.
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// DefaultSignatureHeader is the header the request signature is sent in
+	DefaultSignatureHeader = "X-Gomost-Signature"
+	// DefaultSignMaxBody is the KB of a request body that can be signed
+	DefaultSignMaxBody = 1024
+	// signReadSize is the bytes read (and reserved) at a time from the body
+	signReadSize = 32 << 10
+)
+
+// signContextKey is the context key of the hex SHA-256 of the request body
+type signContextKey struct{}
+
+// signer will sign the proxied requests with the shared secret of the host
+// so that the upstream can verify that the request came through the proxy.
+//
+// The header value is `t=<unix timestamp>,v1=<hex HMAC-SHA256>` where the
+// HMAC is calculated over the method, request URI, hex SHA-256 of the body
+// and the timestamp each separated by a newline.
+type signer struct {
+	secret  []byte
+	header  string
+	maxBody int64
+	memory  *memoryConsumer
+}
+
+// newSigner will create the signer for the configuration. The bodies are
+// reserved from the memory budget while they are buffered.
+func newSigner(conf SignConfig, memory *memoryConsumer) *signer {
+	header := conf.Header
+	if header == "" {
+		header = DefaultSignatureHeader
+	}
+	maxBody := conf.MaxBody
+	if maxBody <= 0 {
+		maxBody = DefaultSignMaxBody
+	}
+	return &signer{secret: []byte(conf.Secret), header: header, maxBody: int64(maxBody) << 10, memory: memory}
+}
+
+// handler will read the body into memory so that its hash can be signed
+// rejecting the request when the body is too large, cannot be read or
+// there is no memory available to buffer it
+func (s *signer) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		bodyHash := sha256.New()
+		if req.Body != nil && req.Body != http.NoBody {
+			if req.ContentLength > s.maxBody {
+				http.Error(resp, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+				return
+			}
+			var body bytes.Buffer
+			var reserved int64
+			defer func() { s.memory.release(reserved) }()
+			chunk := make([]byte, signReadSize)
+			for {
+				n, err := req.Body.Read(chunk)
+				if n > 0 {
+					if int64(body.Len()+n) > s.maxBody {
+						http.Error(resp, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+						return
+					}
+					if !s.memory.reserve(int64(n)) {
+						logger.Warn("Rejecting signed request to %s: the memory budget has been exhausted", req.Host)
+						http.Error(resp, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+						return
+					}
+					reserved += int64(n)
+					body.Write(chunk[:n])
+				}
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					http.Error(resp, "Could not read the request body", http.StatusBadRequest)
+					return
+				}
+			}
+			req.Body.Close()
+			bodyHash.Write(body.Bytes())
+			req.Body = io.NopCloser(bytes.NewReader(body.Bytes()))
+			req.ContentLength = int64(body.Len())
+			req.TransferEncoding = nil
+		}
+		ctx := context.WithValue(req.Context(), signContextKey{}, hex.EncodeToString(bodyHash.Sum(nil)))
+		next.ServeHTTP(resp, req.WithContext(ctx))
+	})
+}
+
+// director will sign the request once the director has rewritten it for
+// the upstream
+func (s *signer) director(director func(*http.Request)) func(*http.Request) {
+	return func(req *http.Request) {
+		director(req)
+		s.sign(req, time.Now())
+	}
+}
+
+// sign will add the signature header to the request using the hash of the
+// body read by the handler
+func (s *signer) sign(req *http.Request, now time.Time) {
+	bodyHash, ok := req.Context().Value(signContextKey{}).(string)
+	if !ok {
+		empty := sha256.Sum256(nil)
+		bodyHash = hex.EncodeToString(empty[:])
+	}
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	mac := hmac.New(sha256.New, s.secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s", req.Method, req.URL.RequestURI(), bodyHash, timestamp)
+	req.Header.Set(s.header, "t="+timestamp+",v1="+hex.EncodeToString(mac.Sum(nil)))
+}
@@ -54,12 +54,24 @@ func TLS(addr, certFile, keyFile string) (net.Listener, error) {
 		return nil, errCertKeyMissing
 	}
 
+	tlsConfig, err := fileTLSConfig(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := TCP4(addr)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(ln, tlsConfig), nil
+}
+
+// fileTLSConfig returns the tls.Config using the provided cert files
+func fileTLSConfig(certFile, keyFile string) (*tls.Config, error) {
 	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
 	if err != nil {
 		return nil, errParseTLS.Format(certFile, keyFile, err)
 	}
-
-	return CERT(addr, cert)
+	return certTLSConfig(cert), nil
 }
 
 // CERT returns a listener which contans tls.Config with the provided certificate, use for ssl
@@ -69,11 +81,15 @@ func CERT(addr string, cert tls.Certificate) (net.Listener, error) {
 		return nil, err
 	}
 
-	tlsConfig := &tls.Config{
+	return tls.NewListener(ln, certTLSConfig(cert)), nil
+}
+
+// certTLSConfig returns the tls.Config with the provided certificate
+func certTLSConfig(cert tls.Certificate) *tls.Config {
+	return &tls.Config{
 		Certificates:             []tls.Certificate{cert},
 		PreferServerCipherSuites: true,
 	}
-	return tls.NewListener(ln, tlsConfig), nil
 }
 
 // LETSENCRYPT returns a new Automatic TLS Listener using letsencrypt.org service
@@ -93,16 +109,24 @@ func LETSENCRYPT(addr string) (net.Listener, error) {
 		return nil, err
 	}
 
-	var m letsencrypt.Manager
-	if err = m.CacheFile("./letsencrypt.cache"); err != nil {
+	tlsConfig, err := letsencryptTLSConfig()
+	if err != nil {
 		return nil, err
 	}
-
-	tlsConfig := &tls.Config{GetCertificate: m.GetCertificate}
 	tlsLn := tls.NewListener(ln, tlsConfig)
 	return tlsLn, nil
 }
 
+// letsencryptTLSConfig returns the tls.Config using the letsencrypt manager
+// which supports localhost domains for testing
+func letsencryptTLSConfig() (*tls.Config, error) {
+	var m letsencrypt.Manager
+	if err := m.CacheFile("./letsencrypt.cache"); err != nil {
+		return nil, err
+	}
+	return &tls.Config{GetCertificate: m.GetCertificate}, nil
+}
+
 // LETSENCRYPTPROD returns a new Automatic TLS Listener using letsencrypt.org service
 // receives two parameters, the first is the domain of the server
 // and the second is optionally, the cache directory, if you skip it then the cache directory is "./certcache"
@@ -0,0 +1,188 @@
+// Copyright 2016 Landonia Ltd. All rights reserved.
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// statePruneInterval is how often the expired entries are removed from
+	// the memory store
+	statePruneInterval = time.Minute
+)
+
+// stateStore holds the rate limit counters, the bans and the sticky
+// sessions. The memory store is local to the instance whereas the redis
+// store is shared so that the limits, bans and sessions apply across every
+// replica.
+type stateStore interface {
+
+	// incr will increment the counter returning the new count (the counter
+	// expires once the ttl has passed since it was created)
+	incr(ctx context.Context, key string, ttl time.Duration) (int64, error)
+
+	// incrUnless will increment the counter in the same way as incr unless
+	// the other key has a value in which case the counter is left alone and
+	// 0 is returned (allowing both to be checked with a single round trip)
+	incrUnless(ctx context.Context, key, unless string, ttl time.Duration) (int64, error)
+
+	// get will return the value (empty if it does not exist or has expired)
+	get(ctx context.Context, key string) (string, error)
+
+	// set will store the value until the ttl has passed
+	set(ctx context.Context, key, value string, ttl time.Duration) error
+}
+
+// newStateStore will create the configured store (memory by default)
+func newStateStore(conf StateConfig) (stateStore, error) {
+	switch conf.Type {
+	case "", "memory":
+		return &memoryState{entries: make(map[string]*stateEntry)}, nil
+	case "redis":
+		rc, err := newRedis(conf.Options)
+		if err != nil {
+			return nil, err
+		}
+		return &redisState{rc: rc}, nil
+	}
+	return nil, fmt.Errorf("Unknown state store: %s", conf.Type)
+}
+
+// memoryState is the store local to the instance
+type memoryState struct {
+	mu      sync.Mutex
+	entries map[string]*stateEntry
+	pruned  time.Time
+}
+
+// stateEntry is a value or counter held until it expires
+type stateEntry struct {
+	value   string
+	count   int64
+	expires time.Time
+}
+
+// incr will increment the counter returning the new count
+func (ms *memoryState) incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	e := ms.entry(key)
+	if e == nil {
+		e = &stateEntry{expires: time.Now().Add(ttl)}
+		ms.entries[key] = e
+	}
+	e.count++
+	return e.count, nil
+}
+
+// incrUnless will increment the counter unless the other key has a value
+func (ms *memoryState) incrUnless(ctx context.Context, key, unless string, ttl time.Duration) (int64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if e := ms.entry(unless); e != nil && e.value != "" {
+		return 0, nil
+	}
+	e := ms.entry(key)
+	if e == nil {
+		e = &stateEntry{expires: time.Now().Add(ttl)}
+		ms.entries[key] = e
+	}
+	e.count++
+	return e.count, nil
+}
+
+// get will return the value
+func (ms *memoryState) get(ctx context.Context, key string) (string, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if e := ms.entry(key); e != nil {
+		return e.value, nil
+	}
+	return "", nil
+}
+
+// set will store the value
+func (ms *memoryState) set(ctx context.Context, key, value string, ttl time.Duration) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.entries[key] = &stateEntry{value: value, expires: time.Now().Add(ttl)}
+	return nil
+}
+
+// entry will return the entry if it has not expired removing any expired
+// entries every prune interval (the lock must be held)
+func (ms *memoryState) entry(key string) *stateEntry {
+	now := time.Now()
+	if now.Sub(ms.pruned) > statePruneInterval {
+		for k, e := range ms.entries {
+			if now.After(e.expires) {
+				delete(ms.entries, k)
+			}
+		}
+		ms.pruned = now
+	}
+	if e, exists := ms.entries[key]; exists && now.Before(e.expires) {
+		return e
+	}
+	return nil
+}
+
+// redisIncr increments the counter setting the expiry when it is created
+const redisIncr = `local n = redis.call('INCR', KEYS[1])
+if n == 1 then redis.call('PEXPIRE', KEYS[1], ARGV[1]) end
+return n`
+
+// redisIncrUnless increments the counter in the same way as redisIncr
+// unless the second key exists
+const redisIncrUnless = `if redis.call('EXISTS', KEYS[2]) == 1 then return 0 end
+local n = redis.call('INCR', KEYS[1])
+if n == 1 then redis.call('PEXPIRE', KEYS[1], ARGV[1]) end
+return n`
+
+// redisState is the store shared by the replicas using redis
+type redisState struct {
+	rc *redisCache
+}
+
+// incr will increment the counter returning the new count
+func (rs *redisState) incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	b, err := rs.rc.do(ctx, "EVAL", redisIncr, "1", rs.rc.prefix+"state+"+key, milliseconds(ttl))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(b), 10, 64)
+}
+
+// incrUnless will increment the counter unless the other key has a value
+func (rs *redisState) incrUnless(ctx context.Context, key, unless string, ttl time.Duration) (int64, error) {
+	b, err := rs.rc.do(ctx, "EVAL", redisIncrUnless, "2", rs.rc.prefix+"state+"+key, rs.rc.prefix+"state+"+unless, milliseconds(ttl))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(b), 10, 64)
+}
+
+// get will return the value
+func (rs *redisState) get(ctx context.Context, key string) (string, error) {
+	b, err := rs.rc.do(ctx, "GET", rs.rc.prefix+"state+"+key)
+	return string(b), err
+}
+
+// set will store the value
+func (rs *redisState) set(ctx context.Context, key, value string, ttl time.Duration) error {
+	_, err := rs.rc.do(ctx, "SET", rs.rc.prefix+"state+"+key, value, "PX", milliseconds(ttl))
+	return err
+}
+
+// milliseconds will format the duration as whole milliseconds (at least 1)
+func milliseconds(d time.Duration) string {
+	if ms := d.Milliseconds(); ms > 0 {
+		return strconv.FormatInt(ms, 10)
+	}
+	return "1"
+}
@@ -0,0 +1,108 @@
+// Copyright 2016 Landonia Ltd. All rights reserved.
+
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultStaticIndex is the file served for a directory
+const DefaultStaticIndex = "index.html"
+
+// staticHost will serve the files of an explicitly configured static host
+type staticHost struct {
+	conf  StaticHostConfig
+	files http.Handler
+}
+
+// newStaticHost will check the docroot of the static host
+func newStaticHost(conf StaticHostConfig) (*staticHost, error) {
+	if conf.DocRoot == "" {
+		return nil, fmt.Errorf("The docroot of static host %s cannot be empty", strings.Join(conf.Hosts, ","))
+	}
+	if info, err := os.Stat(conf.DocRoot); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("The docroot %s is not a directory", conf.DocRoot)
+	}
+	for _, pattern := range conf.Deny {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid deny pattern %q: %s", pattern, err.Error())
+		}
+	}
+	if conf.Index == "" {
+		conf.Index = DefaultStaticIndex
+	}
+	return &staticHost{conf: conf, files: http.FileServer(http.Dir(conf.DocRoot))}, nil
+}
+
+// ServeHTTP will serve the requested file, the index of a directory or the
+// SPA fallback
+func (sh *staticHost) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		resp.Header().Set("Allow", "GET, HEAD")
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	name := path.Clean("/" + req.URL.Path)
+	if sh.denied(name) {
+		http.NotFound(resp, req)
+		return
+	}
+	file := filepath.Join(sh.conf.DocRoot, filepath.FromSlash(name))
+	info, err := os.Stat(file)
+	if err == nil && info.IsDir() {
+		if index := filepath.Join(file, sh.conf.Index); isFile(index) {
+			file = index
+		} else if sh.conf.Listing {
+			sh.setCache(resp)
+			sh.files.ServeHTTP(resp, req)
+			return
+		} else {
+			err = os.ErrNotExist
+		}
+	}
+	if err != nil {
+		if !sh.conf.SPA {
+			http.NotFound(resp, req)
+			return
+		}
+
+		// Any path that is not a file is handled by the single page app
+		file = filepath.Join(sh.conf.DocRoot, sh.conf.Index)
+	}
+	sh.setCache(resp)
+	http.ServeFile(resp, req, file)
+}
+
+// setCache will add the configured cache policy to the response
+func (sh *staticHost) setCache(resp http.ResponseWriter) {
+	if sh.conf.Cache != "" {
+		resp.Header().Set("Cache-Control", sh.conf.Cache)
+	}
+}
+
+// denied will return true if the path or any of its elements match a deny
+// pattern (e.g. .git or *.bak)
+func (sh *staticHost) denied(name string) bool {
+	for _, pattern := range sh.conf.Deny {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+		for _, element := range strings.Split(name, "/") {
+			if matched, _ := path.Match(pattern, element); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isFile will return true if the path is a regular file
+func isFile(name string) bool {
+	info, err := os.Stat(name)
+	return err == nil && info.Mode().IsRegular()
+}
@@ -0,0 +1,385 @@
+// Copyright 2016 Landonia Ltd. All rights reserved.
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+const (
+	// DefaultStrictMaxHeaderBytes is the maximum size of a request head
+	DefaultStrictMaxHeaderBytes = 16 << 10
+)
+
+// strictConnKey is the context key of the strict connection
+type strictConnKey struct{}
+
+// The states of the request stream
+const (
+	stateHead = iota
+	stateBody
+	stateChunkSize
+	stateChunkData
+	stateChunkEnd
+	stateTrailer
+	stateUpgrade
+)
+
+// criticalHeaders must only appear once within a request
+var criticalHeaders = map[string]bool{
+	"host":              true,
+	"content-length":    true,
+	"transfer-encoding": true,
+	"authorization":     true,
+	"content-type":      true,
+	"expect":            true,
+	"upgrade":           true,
+}
+
+// strictListener wraps the accepted connections so that the raw requests
+// can be checked before they are parsed. The Go parser silently accepts
+// ambiguous requests (such as folded headers or a Content-Length alongside
+// a Transfer-Encoding) which may be interpreted differently by the servers
+// in a multi-hop setup allowing requests to be smuggled.
+type strictListener struct {
+	net.Listener
+	maxHeaderBytes int
+}
+
+// newStrictListener will wrap the listener
+func newStrictListener(ln net.Listener, maxHeaderBytes int) net.Listener {
+	if maxHeaderBytes <= 0 {
+		maxHeaderBytes = DefaultStrictMaxHeaderBytes
+	}
+	return &strictListener{Listener: ln, maxHeaderBytes: maxHeaderBytes}
+}
+
+// Accept will wrap the next connection
+func (sl *strictListener) Accept() (net.Conn, error) {
+	c, err := sl.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	sc := &strictConn{Conn: c, scanner: requestScanner{maxHeaderBytes: sl.maxHeaderBytes}}
+	sc.tlsConn, _ = c.(*tls.Conn)
+	sc.scanner.reset()
+	return sc, nil
+}
+
+// strictConn checks the requests as they are read rejecting the connection
+// when an ambiguous request is found
+type strictConn struct {
+	net.Conn
+	tlsConn  *tls.Conn
+	scanner  requestScanner
+	hijacked int32 // Set to 1 once the connection has been hijacked (e.g. upgraded)
+	err      error
+}
+
+// Read will check the bytes before they are returned to the server. Once
+// hijacked the connection no longer carries requests so it is not checked.
+// An ambiguous request closes the connection rather than being answered as
+// the server may still be writing the response of an earlier request.
+func (sc *strictConn) Read(p []byte) (int, error) {
+	if sc.err != nil {
+		return 0, sc.err
+	}
+	n, err := sc.Conn.Read(p)
+	if n > 0 && atomic.LoadInt32(&sc.hijacked) == 0 {
+		if status, serr := sc.scanner.scan(p[:n]); serr != nil {
+			logger.Warn("Rejecting request from %s (%d): %s", sc.RemoteAddr(), status, serr.Error())
+			sc.err = serr
+			sc.Conn.Close()
+			return 0, serr
+		}
+	}
+	return n, err
+}
+
+// strictConnContext will add the connection to the context so that the TLS
+// state can be restored (the server cannot see the TLS connection)
+func strictConnContext(ctx context.Context, c net.Conn) context.Context {
+	if sc, ok := c.(*strictConn); ok {
+		return context.WithValue(ctx, strictConnKey{}, sc)
+	}
+	return ctx
+}
+
+// closeUnlessUpgraded will close the connection once the response has been
+// written unless the request is upgraded. The scanner stops checking the
+// connection after an upgrade (or CONNECT) request so any bytes sent behind
+// it must never be read as another request.
+func closeUnlessUpgraded(resp http.ResponseWriter, req *http.Request) http.ResponseWriter {
+	if req.ProtoMajor != 1 || (req.Method != http.MethodConnect && req.Header.Get("Upgrade") == "") {
+		return resp
+	}
+	return &upgradeResponse{ResponseWriter: resp}
+}
+
+// upgradeResponse closes the connection after any response written by the
+// handler (an upgraded connection is hijacked instead)
+type upgradeResponse struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+// WriteHeader will close the connection after the final response
+func (r *upgradeResponse) WriteHeader(status int) {
+	if status >= 200 && !r.wroteHeader {
+		r.wroteHeader = true
+		r.Header().Set("Connection", "close")
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Write will write the header if it has not been written
+func (r *upgradeResponse) Write(b []byte) (int, error) {
+	if !r.wroteHeader {
+		r.WriteHeader(http.StatusOK)
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Flush will flush the underlying writer if supported
+func (r *upgradeResponse) Flush() {
+	if !r.wroteHeader {
+		r.WriteHeader(http.StatusOK)
+	}
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap will return the underlying writer
+func (r *upgradeResponse) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// strictConnState will record when a strict connection has been hijacked
+// so that the bytes that follow an upgrade are no longer checked
+func strictConnState(c net.Conn, state http.ConnState) {
+	if sc, ok := c.(*strictConn); ok && state == http.StateHijacked {
+		atomic.StoreInt32(&sc.hijacked, 1)
+	}
+}
+
+// restoreTLS will set the TLS state of a request read from a strict TLS
+// connection
+func restoreTLS(req *http.Request) {
+	if req.TLS != nil {
+		return
+	}
+	if sc, ok := req.Context().Value(strictConnKey{}).(*strictConn); ok && sc.tlsConn != nil {
+		state := sc.tlsConn.ConnectionState()
+		req.TLS = &state
+	}
+}
+
+// requestScanner follows the stream of requests on the connection checking
+// each request head and skipping over the bodies
+type requestScanner struct {
+	maxHeaderBytes int
+	state          int
+	line           []byte
+	headBytes      int
+	requestLine    bool
+	http10         bool
+	upgrade        bool
+	counts         map[string]int
+	contentLength  int64
+	remaining      int64
+}
+
+// scan will check the bytes returning the status and error if a request
+// should be rejected
+func (rs *requestScanner) scan(b []byte) (int, error) {
+	for len(b) > 0 {
+		switch rs.state {
+		case stateUpgrade:
+
+			// The bytes that follow an upgrade request belong to the upgraded
+			// protocol. When the request is not upgraded the connection is
+			// closed once responded to (see closeUnlessUpgraded) so they can
+			// never be read as another request.
+			return 0, nil
+		case stateBody, stateChunkData:
+			n := int64(len(b))
+			if n > rs.remaining {
+				n = rs.remaining
+			}
+			rs.remaining -= n
+			b = b[n:]
+			if rs.remaining == 0 {
+				if rs.state == stateBody {
+					rs.endRequest()
+				} else {
+					rs.state = stateChunkEnd
+				}
+			}
+			continue
+		}
+
+		// The remaining states are line based
+		i := bytes.IndexByte(b, '\n')
+		n := len(b)
+		if i != -1 {
+			n = i + 1
+		}
+		rs.line = append(rs.line, b[:n]...)
+		b = b[n:]
+
+		// Only the bytes of the request head and trailer count towards the
+		// maximum while the chunk lines are limited individually
+		if rs.state == stateHead || rs.state == stateTrailer {
+			if rs.headBytes += n; rs.headBytes > rs.maxHeaderBytes {
+				return http.StatusRequestHeaderFieldsTooLarge, fmt.Errorf("Request head exceeds %d bytes", rs.maxHeaderBytes)
+			}
+		} else if len(rs.line) > rs.maxHeaderBytes {
+			return http.StatusBadRequest, fmt.Errorf("Chunk line exceeds %d bytes", rs.maxHeaderBytes)
+		}
+		if i == -1 {
+			continue
+		}
+		if !bytes.HasSuffix(rs.line, []byte("\r\n")) {
+			return http.StatusBadRequest, fmt.Errorf("Bare LF line ending")
+		}
+		line := rs.line[:len(rs.line)-2]
+		rs.line = rs.line[:0]
+		if status, err := rs.processLine(line); err != nil {
+			return status, err
+		}
+	}
+	return 0, nil
+}
+
+// endRequest will follow the upgraded protocol once the body of an upgrade
+// request has been read otherwise it prepares for the next request
+func (rs *requestScanner) endRequest() {
+	if rs.upgrade {
+		rs.state = stateUpgrade
+	} else {
+		rs.reset()
+	}
+}
+
+// reset will prepare for the next request head
+func (rs *requestScanner) reset() {
+	rs.state = stateHead
+	rs.headBytes = 0
+	rs.requestLine = true
+	rs.http10 = false
+	rs.upgrade = false
+	rs.counts = make(map[string]int)
+	rs.contentLength = -1
+}
+
+// processLine will check the complete line (without the CRLF)
+func (rs *requestScanner) processLine(line []byte) (int, error) {
+	switch rs.state {
+	case stateHead:
+		if rs.requestLine {
+
+			// Empty lines before the request line are ignored
+			if len(line) == 0 {
+				rs.headBytes = 0
+				return 0, nil
+			}
+			rs.requestLine = false
+			rs.upgrade = bytes.HasPrefix(line, []byte("CONNECT "))
+			rs.http10 = bytes.HasSuffix(line, []byte(" HTTP/1.0"))
+			return 0, nil
+		} else if len(line) == 0 {
+			return rs.endHead()
+		}
+		return rs.processHeader(line)
+	case stateChunkSize:
+		if i := bytes.IndexByte(line, ';'); i != -1 {
+			line = line[:i]
+		}
+		size, err := strconv.ParseInt(string(line), 16, 64)
+		if err != nil || size < 0 || len(line) == 0 {
+			return http.StatusBadRequest, fmt.Errorf("Invalid chunk size")
+		}
+		if size == 0 {
+			rs.state = stateTrailer
+			rs.headBytes = 0
+		} else {
+			rs.state = stateChunkData
+			rs.remaining = size
+		}
+	case stateChunkEnd:
+		if len(line) != 0 {
+			return http.StatusBadRequest, fmt.Errorf("Invalid chunk ending")
+		}
+		rs.state = stateChunkSize
+	case stateTrailer:
+		if len(line) == 0 {
+			rs.endRequest()
+		} else if line[0] == ' ' || line[0] == '\t' {
+			return http.StatusBadRequest, fmt.Errorf("Obsolete line folding")
+		}
+	}
+	return 0, nil
+}
+
+// processHeader will check the header line
+func (rs *requestScanner) processHeader(line []byte) (int, error) {
+	if line[0] == ' ' || line[0] == '\t' {
+		return http.StatusBadRequest, fmt.Errorf("Obsolete line folding")
+	}
+	i := bytes.IndexByte(line, ':')
+	if i <= 0 {
+		return http.StatusBadRequest, fmt.Errorf("Malformed header")
+	}
+	if c := line[i-1]; c == ' ' || c == '\t' {
+		return http.StatusBadRequest, fmt.Errorf("Whitespace before header colon")
+	}
+	name := string(bytes.ToLower(line[:i]))
+	value := string(bytes.TrimSpace(line[i+1:]))
+	if criticalHeaders[name] {
+		if rs.counts[name]++; rs.counts[name] > 1 {
+			return http.StatusBadRequest, fmt.Errorf("Duplicate %s header", name)
+		}
+	}
+	switch name {
+	case "content-length":
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 0 || value[0] == '+' {
+			return http.StatusBadRequest, fmt.Errorf("Invalid Content-Length")
+		}
+		rs.contentLength = n
+	case "transfer-encoding":
+		if value != "chunked" {
+			return http.StatusBadRequest, fmt.Errorf("Unsupported Transfer-Encoding: %s", value)
+		}
+	case "upgrade":
+		rs.upgrade = true
+	}
+	return 0, nil
+}
+
+// endHead will check the complete head and determine how the body is sent
+func (rs *requestScanner) endHead() (int, error) {
+	chunked := rs.counts["transfer-encoding"] > 0
+	switch {
+	case chunked && rs.contentLength >= 0:
+		return http.StatusBadRequest, fmt.Errorf("Both Content-Length and Transfer-Encoding provided")
+	case chunked && rs.http10:
+		return http.StatusBadRequest, fmt.Errorf("Transfer-Encoding provided with HTTP/1.0")
+	case chunked:
+		rs.state = stateChunkSize
+	case rs.contentLength > 0:
+		rs.state = stateBody
+		rs.remaining = rs.contentLength
+	default:
+		rs.endRequest()
+	}
+	return 0, nil
+}
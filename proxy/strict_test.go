@@ -0,0 +1,96 @@
+// Copyright 2016 Landonia Ltd. All rights reserved.
+
+package proxy
+
+import (
+	"net/http"
+	"testing"
+)
+
+// scannerTests are the raw request streams along with the status the
+// scanner must reject them with (0 if accepted) and the state it must be
+// left in once accepted
+var scannerTests = []struct {
+	name   string
+	input  string
+	status int
+	state  int
+}{
+	{"simple request", "GET / HTTP/1.1\r\nHost: a.test\r\n\r\n", 0, stateHead},
+	{"leading empty lines", "\r\n\r\nGET / HTTP/1.1\r\nHost: a.test\r\n\r\n", 0, stateHead},
+	{"pipelined requests", "GET / HTTP/1.1\r\nHost: a.test\r\n\r\nGET /b HTTP/1.1\r\nHost: a.test\r\n\r\n", 0, stateHead},
+	{"content length body", "POST / HTTP/1.1\r\nHost: a.test\r\nContent-Length: 5\r\n\r\nhello", 0, stateHead},
+	{"body is not parsed", "POST / HTTP/1.1\r\nHost: a.test\r\nContent-Length: 13\r\n\r\n Bad : header", 0, stateHead},
+	{"partial body", "POST / HTTP/1.1\r\nHost: a.test\r\nContent-Length: 10\r\n\r\nhello", 0, stateBody},
+	{"content length and transfer encoding", "POST / HTTP/1.1\r\nHost: a.test\r\nContent-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", http.StatusBadRequest, 0},
+	{"transfer encoding and content length", "POST / HTTP/1.1\r\nHost: a.test\r\nTransfer-Encoding: chunked\r\nContent-Length: 5\r\n\r\n0\r\n\r\n", http.StatusBadRequest, 0},
+	{"transfer encoding with HTTP/1.0", "POST / HTTP/1.0\r\nHost: a.test\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", http.StatusBadRequest, 0},
+	{"unsupported transfer encoding", "POST / HTTP/1.1\r\nHost: a.test\r\nTransfer-Encoding: gzip, chunked\r\n\r\n", http.StatusBadRequest, 0},
+	{"signed content length", "POST / HTTP/1.1\r\nHost: a.test\r\nContent-Length: +5\r\n\r\nhello", http.StatusBadRequest, 0},
+	{"invalid content length", "POST / HTTP/1.1\r\nHost: a.test\r\nContent-Length: 5, 5\r\n\r\nhello", http.StatusBadRequest, 0},
+	{"duplicate content length", "POST / HTTP/1.1\r\nHost: a.test\r\nContent-Length: 5\r\nContent-Length: 5\r\n\r\nhello", http.StatusBadRequest, 0},
+	{"duplicate host", "GET / HTTP/1.1\r\nHost: a.test\r\nhost: b.test\r\n\r\n", http.StatusBadRequest, 0},
+	{"duplicate transfer encoding", "POST / HTTP/1.1\r\nHost: a.test\r\nTransfer-Encoding: chunked\r\nTransfer-Encoding: chunked\r\n\r\n", http.StatusBadRequest, 0},
+	{"duplicate non critical header", "GET / HTTP/1.1\r\nHost: a.test\r\nAccept: a\r\nAccept: b\r\n\r\n", 0, stateHead},
+	{"obsolete line folding", "GET / HTTP/1.1\r\nHost: a.test\r\nX-Test: a\r\n b\r\n\r\n", http.StatusBadRequest, 0},
+	{"obsolete line folding with tab", "GET / HTTP/1.1\r\nHost: a.test\r\nX-Test: a\r\n\tb\r\n\r\n", http.StatusBadRequest, 0},
+	{"whitespace before colon", "GET / HTTP/1.1\r\nHost : a.test\r\n\r\n", http.StatusBadRequest, 0},
+	{"missing colon", "GET / HTTP/1.1\r\nHost a.test\r\n\r\n", http.StatusBadRequest, 0},
+	{"bare LF", "GET / HTTP/1.1\nHost: a.test\r\n\r\n", http.StatusBadRequest, 0},
+	{"chunked body", "POST / HTTP/1.1\r\nHost: a.test\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\na;ext=1\r\n0123456789\r\n0\r\n\r\n", 0, stateHead},
+	{"chunked body with trailer", "POST / HTTP/1.1\r\nHost: a.test\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\nX-Trailer: a\r\n\r\n", 0, stateHead},
+	{"invalid chunk size", "POST / HTTP/1.1\r\nHost: a.test\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n", http.StatusBadRequest, 0},
+	{"empty chunk size", "POST / HTTP/1.1\r\nHost: a.test\r\nTransfer-Encoding: chunked\r\n\r\n\r\n", http.StatusBadRequest, 0},
+	{"negative chunk size", "POST / HTTP/1.1\r\nHost: a.test\r\nTransfer-Encoding: chunked\r\n\r\n-5\r\n", http.StatusBadRequest, 0},
+	{"chunk data too long", "POST / HTTP/1.1\r\nHost: a.test\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nhello\r\n", http.StatusBadRequest, 0},
+	{"folded trailer", "POST / HTTP/1.1\r\nHost: a.test\r\nTransfer-Encoding: chunked\r\n\r\n0\r\nX-Trailer: a\r\n b\r\n\r\n", http.StatusBadRequest, 0},
+	{"upgrade", "GET / HTTP/1.1\r\nHost: a.test\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n", 0, stateUpgrade},
+	{"data after upgrade", "GET / HTTP/1.1\r\nHost: a.test\r\nUpgrade: websocket\r\n\r\n\x81\x05 not : http\n", 0, stateUpgrade},
+	{"upgrade with body", "POST / HTTP/1.1\r\nHost: a.test\r\nUpgrade: h2c\r\nContent-Length: 5\r\n\r\nhello", 0, stateUpgrade},
+	{"upgrade with partial body", "POST / HTTP/1.1\r\nHost: a.test\r\nUpgrade: h2c\r\nContent-Length: 10\r\n\r\nhello", 0, stateBody},
+	{"upgrade with chunked body", "POST / HTTP/1.1\r\nHost: a.test\r\nUpgrade: h2c\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n", 0, stateUpgrade},
+	{"connect", "CONNECT a.test:443 HTTP/1.1\r\nHost: a.test:443\r\n\r\n", 0, stateUpgrade},
+	{"duplicate upgrade", "GET / HTTP/1.1\r\nHost: a.test\r\nUpgrade: websocket\r\nUpgrade: h2c\r\n\r\n", http.StatusBadRequest, 0},
+}
+
+// TestRequestScanner will check the scanner accepts or rejects each request
+// stream whether it is read at once or a byte at a time
+func TestRequestScanner(t *testing.T) {
+	for _, test := range scannerTests {
+		for _, size := range []int{len(test.input), 1} {
+			rs := requestScanner{maxHeaderBytes: DefaultStrictMaxHeaderBytes}
+			rs.reset()
+			status := 0
+			for b := []byte(test.input); len(b) > 0 && status == 0; {
+				n := size
+				if n > len(b) {
+					n = len(b)
+				}
+				status, _ = rs.scan(b[:n])
+				b = b[n:]
+			}
+			if status != test.status {
+				t.Errorf("%s (reading %d bytes at a time): expected status %d but was %d", test.name, size, test.status, status)
+			} else if status == 0 && rs.state != test.state {
+				t.Errorf("%s (reading %d bytes at a time): expected state %d but was %d", test.name, size, test.state, rs.state)
+			}
+		}
+	}
+}
+
+// TestRequestScannerMaxHeaderBytes will check the request head is limited
+// while the bodies are not
+func TestRequestScannerMaxHeaderBytes(t *testing.T) {
+	rs := requestScanner{maxHeaderBytes: 64}
+	rs.reset()
+	body := make([]byte, 1024)
+	for i := range body {
+		body[i] = 'a'
+	}
+	if status, err := rs.scan([]byte("POST / HTTP/1.1\r\nContent-Length: 1024\r\n\r\n" + string(body))); err != nil {
+		t.Fatalf("Expected the body to be allowed but was rejected with %d: %s", status, err.Error())
+	}
+	if status, _ := rs.scan([]byte("GET / HTTP/1.1\r\nX-Long: " + string(body[:64]) + "\r\n\r\n")); status != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("Expected the long head to be rejected with %d but was %d", http.StatusRequestHeaderFieldsTooLarge, status)
+	}
+}
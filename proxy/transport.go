@@ -0,0 +1,105 @@
+// Copyright 2016 Landonia Ltd. All rights reserved.
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	netproxy "golang.org/x/net/proxy"
+)
+
+// ForwardProxyDirect is the forward proxy value used to connect to the
+// upstreams directly ignoring the environment
+const ForwardProxyDirect = "direct"
+
+// The protocols that can be used to connect to the upstreams
+const (
+	UpstreamHTTP1 = "http1" // HTTP/1.1 only
+	UpstreamHTTP2 = "http2" // HTTP/2 when negotiated using TLS otherwise HTTP/1.1
+	UpstreamH2C   = "h2c"   // HTTP/2 without TLS (prior knowledge)
+)
+
+// newUpstreamTransport will create the transport used to connect to the
+// upstreams of the host. Unless overridden the forward proxy is taken from
+// the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables. When a
+// SOCKS5 proxy is configured every upstream connection is dialed through it.
+// HTTP/2 is used when negotiated using TLS unless a protocol is pinned.
+func newUpstreamTransport(conf HostConfig) (*http.Transport, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	switch conf.ForwardProxy {
+	case "":
+		t.Proxy = http.ProxyFromEnvironment
+	case ForwardProxyDirect:
+		t.Proxy = nil
+	default:
+		u, err := url.Parse(conf.ForwardProxy)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("Invalid forward proxy for %s: %s", conf.Proxy, conf.ForwardProxy)
+		}
+		t.Proxy = http.ProxyURL(u)
+	}
+	if conf.SOCKS5.Addr != "" {
+		if conf.ForwardProxy != "" && conf.ForwardProxy != ForwardProxyDirect {
+			return nil, fmt.Errorf("Both a forward proxy and a SOCKS5 proxy have been provided for: %s", conf.Proxy)
+		}
+		dial, err := newSOCKS5Dialer(conf.SOCKS5)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid SOCKS5 proxy for %s: %s", conf.Proxy, err.Error())
+		}
+		t.Proxy = nil
+		t.DialContext = dial
+	}
+	protocols, err := upstreamProtocols(conf)
+	if err != nil {
+		return nil, err
+	}
+	t.Protocols = protocols
+	return t, nil
+}
+
+// upstreamProtocols will return the protocols the transport can use for the
+// configured upstream protocol (nil to negotiate the default)
+func upstreamProtocols(conf HostConfig) (*http.Protocols, error) {
+	protocols := new(http.Protocols)
+	switch conf.Protocol {
+	case "":
+		return nil, nil
+	case UpstreamHTTP1:
+		protocols.SetHTTP1(true)
+	case UpstreamHTTP2:
+		protocols.SetHTTP1(true)
+		protocols.SetHTTP2(true)
+	case UpstreamH2C:
+		for _, host := range append([]string{conf.Host}, conf.Hosts...) {
+			if host != "" && !strings.HasPrefix(strings.ToLower(host), "http://") {
+				return nil, fmt.Errorf("The h2c protocol requires http upstreams for %s: %s", conf.Proxy, host)
+			}
+		}
+		protocols.SetUnencryptedHTTP2(true)
+	default:
+		return nil, fmt.Errorf("Unknown upstream protocol for %s: %s", conf.Proxy, conf.Protocol)
+	}
+	return protocols, nil
+}
+
+// newSOCKS5Dialer will create the function used to dial the upstreams
+// through the SOCKS5 proxy. The upstream host is resolved by the proxy so
+// that the names only known within the tunnelled network can be used.
+func newSOCKS5Dialer(conf SOCKS5Config) (func(ctx context.Context, network, addr string) (net.Conn, error), error) {
+	var auth *netproxy.Auth
+	if conf.Username != "" {
+		auth = &netproxy.Auth{User: conf.Username, Password: conf.Password}
+	}
+	forward := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	dialer, err := netproxy.SOCKS5("tcp", conf.Addr, auth, forward)
+	if err != nil {
+		return nil, err
+	}
+	return dialer.(netproxy.ContextDialer).DialContext, nil
+}
@@ -0,0 +1,122 @@
+// Copyright 2016 Landonia Ltd. All rights reserved.
+
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	// DefaultWebhookTimeout is the milliseconds to wait for each delivery
+	DefaultWebhookTimeout = 5000
+	// DefaultWebhookRetries is the number of times a failed delivery is retried
+	DefaultWebhookRetries = 3
+)
+
+// webhookFuncs are available within the payload templates
+var webhookFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// webhook will send the events it is subscribed to as a JSON payload
+type webhook struct {
+	*eventWorker
+	conf     WebhookConfig
+	template *template.Template
+	client   *http.Client
+}
+
+// newWebhook will parse the payload template of the webhook
+func newWebhook(conf WebhookConfig, events *Events) (*webhook, error) {
+	if conf.URL == "" {
+		return nil, fmt.Errorf("The webhook url cannot be empty")
+	}
+	w := &webhook{conf: conf}
+	w.eventWorker = newEventWorker(events, conf.Events, func(event Event) {
+		if err := w.deliver(event); err != nil {
+			logger.Warn("Could not deliver %s webhook to %s: %s", event.Type, conf.URL, err.Error())
+		}
+	})
+	if conf.Template != "" {
+		t, err := template.New(conf.URL).Funcs(webhookFuncs).Parse(conf.Template)
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse webhook template: %s", err.Error())
+		}
+		w.template = t
+	}
+	timeout := conf.Timeout
+	if timeout <= 0 {
+		timeout = DefaultWebhookTimeout
+	}
+	w.client = &http.Client{Timeout: time.Duration(timeout) * time.Millisecond}
+	return w, nil
+}
+
+// deliver will send the event retrying with an increasing delay
+func (w *webhook) deliver(event Event) error {
+	payload, err := w.payload(event)
+	if err != nil {
+		return err
+	}
+	retries := w.conf.Retries
+	if retries == 0 {
+		retries = DefaultWebhookRetries
+	} else if retries < 0 {
+		retries = 0
+	}
+	delay := time.Second
+	for attempt := 0; ; attempt++ {
+		if err = w.send(payload); err == nil || attempt >= retries {
+			return err
+		}
+		select {
+		case <-time.After(delay):
+		case <-w.stop:
+			return err
+		}
+		delay *= 2
+	}
+}
+
+// payload will render the template or the event as JSON by default
+func (w *webhook) payload(event Event) ([]byte, error) {
+	if w.template == nil {
+		return json.Marshal(event)
+	}
+	var buf bytes.Buffer
+	if err := w.template.Execute(&buf, event); err != nil {
+		return nil, fmt.Errorf("Could not render webhook template: %s", err.Error())
+	}
+	return buf.Bytes(), nil
+}
+
+// send will post the payload failing on any unsuccessful status
+func (w *webhook) send(payload []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.conf.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "gomost")
+	for name, value := range w.conf.Headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Unexpected status: %s", strings.TrimSpace(resp.Status))
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+// Copyright 2016 Landonia Ltd. All rights reserved.
+
+package proxy
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	// wellKnownPrefix is the prefix of the well-known URIs (RFC 8615)
+	wellKnownPrefix = "/.well-known/"
+
+	// acmeChallengePrefix is the prefix of the ACME HTTP-01 challenges
+	acmeChallengePrefix = wellKnownPrefix + "acme-challenge/"
+)
+
+// wellKnownRoute will handle the /.well-known path for the hosts
+type wellKnownRoute struct {
+	conf    WellKnownConfig
+	handler http.Handler
+}
+
+// wellKnown will route the /.well-known paths explicitly rather than using
+// the generic routing of the host. The ACME challenges are always answered
+// by the proxy.
+type wellKnown struct {
+	gm       *Proxy
+	byHost   map[string][]*wellKnownRoute // The routes by host
+	all      []*wellKnownRoute            // The routes for every host
+	acmeOnce sync.Once
+	acme     http.Handler // Answers the ACME challenges (nil if not enabled)
+}
+
+// newWellKnown will create the routes for the configured paths
+func (gm *Proxy) newWellKnown(confs []WellKnownConfig) (*wellKnown, error) {
+	wk := &wellKnown{gm: gm, byHost: make(map[string][]*wellKnownRoute)}
+	for _, conf := range confs {
+		if !strings.HasPrefix(conf.Path, wellKnownPrefix) {
+			return nil, fmt.Errorf("The well-known path must start with %s: %q", wellKnownPrefix, conf.Path)
+		} else if strings.HasPrefix(conf.Path+"/", acmeChallengePrefix) {
+			return nil, fmt.Errorf("The ACME challenges are answered by the proxy: %q", conf.Path)
+		}
+		route := &wellKnownRoute{conf: conf}
+		switch {
+		case conf.Upstream != "":
+			rp, err := gm.newReverseProxy(HostConfig{Proxy: conf.Path, Host: conf.Upstream})
+			if err != nil {
+				return nil, fmt.Errorf("Could not create well-known upstream: %s", err.Error())
+			}
+			route.handler = rp
+		case conf.Dir != "":
+			route.handler = http.HandlerFunc(route.serveDir)
+		default:
+			return nil, fmt.Errorf("Either the upstream or dir must be provided for %s", conf.Path)
+		}
+		if len(conf.Hosts) == 0 {
+			wk.all = append(wk.all, route)
+		}
+		for _, host := range conf.Hosts {
+			host = strings.ToLower(host)
+			wk.byHost[host] = append(wk.byHost[host], route)
+		}
+	}
+	return wk, nil
+}
+
+// middleware will handle the /.well-known paths that have been configured
+// otherwise the request is passed on
+func (wk *wellKnown) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if !strings.HasPrefix(req.URL.Path, wellKnownPrefix) {
+			next.ServeHTTP(resp, req)
+			return
+		}
+		host := canonicalHost(req)
+		if strings.HasPrefix(req.URL.Path, acmeChallengePrefix) {
+			if acme := wk.acmeHandler(); acme != nil {
+				wk.gm.dispatch(resp, req, "wellknown", "*", "ACME challenges are answered by the proxy", acme)
+				return
+			}
+		}
+		name := host
+		route := matchWellKnown(wk.byHost[host], req.URL.Path)
+		if route == nil {
+			name = "*"
+			route = matchWellKnown(wk.all, req.URL.Path)
+		}
+		if route == nil {
+			next.ServeHTTP(resp, req)
+			return
+		}
+		wk.gm.dispatch(resp, req, "wellknown", name, fmt.Sprintf("the %s path is configured", route.conf.Path), route.handler)
+	})
+}
+
+// acmeHandler will return the handler for the ACME challenges once the
+// certificate managers have been created
+func (wk *wellKnown) acmeHandler() http.Handler {
+	if wk.gm.acme == nil {
+		return nil
+	}
+	wk.acmeOnce.Do(func() {
+		wk.acme = wk.gm.acme.httpHandler(http.NotFoundHandler())
+	})
+	return wk.acme
+}
+
+// matchWellKnown will return the route with the longest path matching the
+// request
+func matchWellKnown(routes []*wellKnownRoute, p string) *wellKnownRoute {
+	var best *wellKnownRoute
+	longest := 0
+	for _, route := range routes {
+		prefix := strings.TrimSuffix(route.conf.Path, "/")
+		if (p == prefix || strings.HasPrefix(p, prefix+"/")) && len(prefix) > longest {
+			best, longest = route, len(prefix)
+		}
+	}
+	return best
+}
+
+// serveDir will serve the file from the directory (directory listings are
+// not provided)
+func (route *wellKnownRoute) serveDir(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// The files are found relative to /.well-known within the directory so
+	// that the same directory can be used for every path
+	name := path.Clean("/" + strings.TrimPrefix(req.URL.Path, wellKnownPrefix))
+	file := filepath.Join(route.conf.Dir, filepath.FromSlash(name))
+	if info, err := os.Stat(file); err != nil || info.IsDir() {
+		http.NotFound(resp, req)
+		return
+	}
+	contentType := route.conf.ContentType
+	if contentType == "" {
+
+		// Files such as apple-app-site-association have no extension but
+		// must be served as JSON
+		if contentType = mime.TypeByExtension(path.Ext(name)); contentType == "" {
+			contentType = "application/json"
+		}
+	}
+	resp.Header().Set("Content-Type", contentType)
+	http.ServeFile(resp, req, file)
+}
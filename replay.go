@@ -0,0 +1,368 @@
+// Copyright 2016 Landonia Ltd. All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/landonia/gomost/proxy"
+)
+
+// replayRequest is a recorded request to replay
+type replayRequest struct {
+	method string
+	host   string // The recorded host (empty if unknown)
+	uri    string
+	header http.Header
+	body   []byte
+	status int    // The recorded status (0 if unknown)
+	skip   string // Why the request cannot be replayed as recorded (empty if it can)
+}
+
+// replayResult is the outcome of replaying a request
+type replayResult struct {
+	status   int
+	latency  time.Duration
+	err      error
+	mismatch bool // True if the status differs from the recorded status
+}
+
+// accessLogLine matches the combined log format written to the access log
+var accessLogLine = regexp.MustCompile(`^\S+ \S+ \S+ \[[^\]]+\] ("(?:[^"\\]|\\.)*") (\d{3}) \S+ ("(?:[^"\\]|\\.)*") ("(?:[^"\\]|\\.)*")`)
+
+// hopHeaders are not replayed as they only applied to the recorded connection
+var hopHeaders = map[string]bool{
+	"Connection":        true,
+	"Keep-Alive":        true,
+	"Proxy-Connection":  true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+	"Te":                true,
+	"Trailer":           true,
+	"Content-Length":    true,
+	"Host":              true,
+}
+
+// runReplay will replay the requests recorded within the HAR files or access
+// logs against the target at the configured rate
+func runReplay(args []string) {
+	replayFlags := flag.NewFlagSet("replay", flag.ExitOnError)
+	target := replayFlags.String("target", "", "The URL of the gomost instance or upstream to replay against (e.g. https://10.0.0.5:8443)")
+	host := replayFlags.String("host", "", "The host to use for the requests (the recorded host by default)")
+	rate := replayFlags.Float64("rate", 10, "The requests per second (0 for as fast as possible)")
+	concurrency := replayFlags.Int("concurrency", 10, "The maximum requests in flight")
+	timeout := replayFlags.Duration("timeout", 30*time.Second, "The timeout of each request")
+	insecure := replayFlags.Bool("insecure", false, "Do not verify the certificate of the target")
+	loop := replayFlags.Int("loop", 1, "The number of times the recorded requests are replayed")
+	replayFlags.Usage = func() {
+		fmt.Fprintln(replayFlags.Output(), "Usage: gomost replay -target URL [flags] FILE...")
+		fmt.Fprintln(replayFlags.Output(), "The files can be HAR files (e.g. from the admin captures) or access logs")
+		replayFlags.PrintDefaults()
+	}
+	replayFlags.Parse(args)
+	if *target == "" || replayFlags.NArg() == 0 {
+		replayFlags.Usage()
+		os.Exit(2)
+	}
+	t, err := url.Parse(*target)
+	if err != nil || t.Host == "" || (t.Scheme != "http" && t.Scheme != "https") {
+		logger.Fatal("The target must be a http or https URL: %s", *target)
+	}
+	var requests []replayRequest
+	skipped := make(map[string]int)
+	for _, file := range replayFlags.Args() {
+		recorded, err := readRecorded(file)
+		if err != nil {
+			logger.Fatal("Could not read %s: %s", file, err.Error())
+		}
+		for _, r := range recorded {
+			if r.skip != "" {
+				skipped[r.skip]++
+			} else {
+				requests = append(requests, r)
+			}
+		}
+	}
+	for reason, n := range skipped {
+		logger.Warn("Skipping %d requests as %s", n, reason)
+	}
+	if len(requests) == 0 {
+		logger.Fatal("No requests were found to replay")
+	}
+
+	// Every request is sent to the target whatever the host so that the
+	// host and server name are the same as when recorded
+	addr := t.Host
+	if t.Port() == "" {
+		addr = net.JoinHostPort(t.Hostname(), map[string]string{"http": "80", "https": "443"}[t.Scheme])
+	}
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	client := &http.Client{
+		Timeout: *timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, addr)
+			},
+			TLSClientConfig:     &tls.Config{InsecureSkipVerify: *insecure},
+			MaxIdleConnsPerHost: *concurrency,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	var ticker *time.Ticker
+	if *rate > 0 {
+		ticker = time.NewTicker(time.Duration(float64(time.Second) / *rate))
+		defer ticker.Stop()
+	}
+	sem := make(chan struct{}, *concurrency)
+	results := make([]replayResult, 0, len(requests)*(*loop))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < *loop; i++ {
+		for _, r := range requests {
+			if ticker != nil {
+				<-ticker.C
+			}
+			sem <- struct{}{}
+			wg.Add(1)
+			go func(r replayRequest) {
+				defer func() { <-sem; wg.Done() }()
+				result := replay(client, t, *host, r)
+				mu.Lock()
+				results = append(results, result)
+				mu.Unlock()
+			}(r)
+		}
+	}
+	wg.Wait()
+	printReplay(results, skipped, time.Since(start))
+}
+
+// replay will send the request to the target
+func replay(client *http.Client, target *url.URL, host string, r replayRequest) replayResult {
+	if host == "" {
+		if host = r.host; host == "" {
+			host = target.Host
+		}
+	}
+	req, err := http.NewRequest(r.method, target.Scheme+"://"+host+r.uri, bytes.NewReader(r.body))
+	if err != nil {
+		return replayResult{err: err}
+	}
+	for name, values := range r.header {
+		if !hopHeaders[http.CanonicalHeaderKey(name)] {
+			req.Header[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return replayResult{err: err, latency: time.Since(start)}
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return replayResult{
+		status:   resp.StatusCode,
+		latency:  time.Since(start),
+		mismatch: r.status != 0 && r.status != resp.StatusCode,
+	}
+}
+
+// printReplay will write the summary of the results and the number of
+// requests skipped for each reason to stdout
+func printReplay(results []replayResult, skipped map[string]int, elapsed time.Duration) {
+	statuses := make(map[int]int)
+	errors := make(map[string]int)
+	var latencies []time.Duration
+	mismatches := 0
+	for _, r := range results {
+		if r.err != nil {
+			errors[r.err.Error()]++
+			continue
+		}
+		statuses[r.status]++
+		latencies = append(latencies, r.latency)
+		if r.mismatch {
+			mismatches++
+		}
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p float64) time.Duration {
+		if len(latencies) == 0 {
+			return 0
+		}
+		return latencies[int(float64(len(latencies)-1)*p)]
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Requests\t%d\n", len(results))
+	fmt.Fprintf(w, "Duration\t%s\n", elapsed.Round(time.Millisecond))
+	fmt.Fprintf(w, "Rate\t%.1f/s\n", float64(len(results))/elapsed.Seconds())
+	fmt.Fprintf(w, "Latency\tp50 %s  p95 %s  p99 %s\n", percentile(0.5).Round(time.Microsecond),
+		percentile(0.95).Round(time.Microsecond), percentile(0.99).Round(time.Microsecond))
+	fmt.Fprintf(w, "Status mismatches\t%d\n", mismatches)
+	for reason, n := range skipped {
+		fmt.Fprintf(w, "Skipped (%s)\t%d\n", reason, n)
+	}
+	var codes []int
+	for code := range statuses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Fprintf(w, "Status %d\t%d\n", code, statuses[code])
+	}
+	for err, n := range errors {
+		fmt.Fprintf(w, "Error %s\t%d\n", err, n)
+	}
+	w.Flush()
+}
+
+// readRecorded will read the requests from the HAR file or access log
+func readRecorded(file string) ([]replayRequest, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if trimmed := bytes.TrimSpace(b); len(trimmed) > 0 && trimmed[0] == '{' {
+		return readHAR(trimmed)
+	}
+	return readAccessLog(b)
+}
+
+// readHAR will read the requests from the HAR file. Any redacted headers are
+// not replayed while the requests with redacted query values or truncated
+// bodies are skipped as they would not be sent as recorded.
+func readHAR(b []byte) ([]replayRequest, error) {
+	var har struct {
+		Log struct {
+			Entries []struct {
+				Request struct {
+					Method  string `json:"method"`
+					URL     string `json:"url"`
+					Headers []struct {
+						Name  string `json:"name"`
+						Value string `json:"value"`
+					} `json:"headers"`
+					PostData *struct {
+						Text     string `json:"text"`
+						Encoding string `json:"encoding"`
+						Comment  string `json:"comment"`
+					} `json:"postData"`
+				} `json:"request"`
+				Response struct {
+					Status int `json:"status"`
+				} `json:"response"`
+			} `json:"entries"`
+		} `json:"log"`
+	}
+	if err := json.Unmarshal(b, &har); err != nil {
+		return nil, fmt.Errorf("Could not decode HAR: %s", err.Error())
+	}
+	var requests []replayRequest
+	for _, entry := range har.Log.Entries {
+		u, err := url.Parse(entry.Request.URL)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid URL %s: %s", entry.Request.URL, err.Error())
+		}
+		r := replayRequest{
+			method: entry.Request.Method,
+			host:   u.Host,
+			uri:    u.RequestURI(),
+			header: make(http.Header),
+			status: entry.Response.Status,
+		}
+		for _, values := range u.Query() {
+			for _, value := range values {
+				if value == proxy.RedactedValue {
+					r.skip = "the query has redacted values"
+				}
+			}
+		}
+		for _, h := range entry.Request.Headers {
+
+			// HTTP/2 pseudo headers cannot be replayed and the redacted
+			// values are no longer known
+			if !strings.HasPrefix(h.Name, ":") && h.Value != proxy.RedactedValue {
+				r.header.Add(h.Name, h.Value)
+			}
+		}
+		if pd := entry.Request.PostData; pd != nil {
+			if pd.Comment != "" {
+
+				// The only comment is added when the body was truncated
+				r.skip = "the body was truncated"
+			}
+			r.body = []byte(pd.Text)
+			if pd.Encoding == "base64" {
+				if r.body, err = base64.StdEncoding.DecodeString(pd.Text); err != nil {
+					return nil, fmt.Errorf("Invalid body for %s: %s", entry.Request.URL, err.Error())
+				}
+			}
+		}
+		requests = append(requests, r)
+	}
+	return requests, nil
+}
+
+// readAccessLog will read the requests from the access log. As the host and
+// bodies are not logged the requests are replayed without a body to the
+// host provided (or the target).
+func readAccessLog(b []byte) ([]replayRequest, error) {
+	var requests []replayRequest
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		m := accessLogLine.FindStringSubmatch(line)
+		if m == nil {
+			return nil, fmt.Errorf("Line %d is not in the access log format", n)
+		}
+		request := strings.Fields(unquote(m[1]))
+		if len(request) < 2 {
+			return nil, fmt.Errorf("Line %d does not have a valid request", n)
+		}
+		status, _ := strconv.Atoi(m[2])
+		r := replayRequest{method: request[0], uri: request[1], header: make(http.Header), status: status}
+		if referer := unquote(m[3]); referer != "" && referer != "-" {
+			r.header.Set("Referer", referer)
+		}
+		if agent := unquote(m[4]); agent != "" && agent != "-" {
+			r.header.Set("User-Agent", agent)
+		}
+		requests = append(requests, r)
+	}
+	return requests, scanner.Err()
+}
+
+// unquote will return the quoted access log value
+func unquote(quoted string) string {
+	if s, err := strconv.Unquote(quoted); err == nil {
+		return s
+	}
+	return quoted[1 : len(quoted)-1]
+}
@@ -0,0 +1,119 @@
+// Copyright 2016 Landonia Ltd. All rights reserved.
+
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/landonia/gomost/proxy"
+)
+
+const (
+	// launchdLabel is the label the daemon is registered with
+	launchdLabel = "com.landonia.gomost"
+	// launchdPlist is the location of the daemon definition
+	launchdPlist = "/Library/LaunchDaemons/" + launchdLabel + ".plist"
+)
+
+// plistTemplate is the launchd daemon definition which restarts gomost
+// unless it exited cleanly (the values are escaped as the paths can contain
+// characters such as & or <)
+var plistTemplate = template.Must(template.New("plist").Funcs(template.FuncMap{"xml": xmlEscape}).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>{{xml .Label}}</string>
+	<key>ProgramArguments</key>
+	<array>{{range .Args}}
+		<string>{{xml .}}</string>{{end}}
+	</array>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<dict>
+		<key>SuccessfulExit</key>
+		<false/>
+	</dict>
+	<key>StandardOutPath</key>
+	<string>/usr/local/var/log/gomost.log</string>
+	<key>StandardErrorPath</key>
+	<string>/usr/local/var/log/gomost.log</string>
+</dict>
+</plist>
+`))
+
+// xmlEscape will escape the value for the plist
+func xmlEscape(value string) (string, error) {
+	var b strings.Builder
+	err := xml.EscapeText(&b, []byte(value))
+	return b.String(), err
+}
+
+// isService is always false as launchd runs gomost as a normal process
+func isService() bool {
+	return false
+}
+
+// runService is not used with launchd
+func runService(p *proxy.Proxy) error {
+	return p.Service()
+}
+
+// controlService will install, uninstall, start or stop the launchd daemon
+func controlService(cmd, configPath string) error {
+	switch cmd {
+	case "install":
+		exe, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		args := []string{exe}
+		if configPath != "" {
+			if configPath, err = filepath.Abs(configPath); err != nil {
+				return err
+			}
+			args = append(args, "-c", configPath)
+		}
+		args = append(args, "run")
+		f, err := os.OpenFile(launchdPlist, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		err = plistTemplate.Execute(f, struct {
+			Label string
+			Args  []string
+		}{launchdLabel, args})
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		return launchctl("load", "-w", launchdPlist)
+	case "uninstall":
+		if err := launchctl("unload", "-w", launchdPlist); err != nil {
+			return err
+		}
+		return os.Remove(launchdPlist)
+	case "start":
+		return launchctl("start", launchdLabel)
+	case "stop":
+		return launchctl("stop", launchdLabel)
+	}
+	return fmt.Errorf("Unknown service command %q (install, uninstall, start or stop)", cmd)
+}
+
+// launchctl will run the launchctl command
+func launchctl(args ...string) error {
+	if out, err := exec.Command("launchctl", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("launchctl %s: %s", strings.Join(args, " "), strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+// Copyright 2016 Landonia Ltd. All rights reserved.
+
+//go:build !windows && !darwin
+// +build !windows,!darwin
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/landonia/gomost/proxy"
+)
+
+// isService is always false as the init system (e.g. systemd) runs gomost as
+// a normal process
+func isService() bool {
+	return false
+}
+
+// runService is not used outside of windows
+func runService(p *proxy.Proxy) error {
+	return p.Service()
+}
+
+// controlService is not supported as the init system should be used instead
+func controlService(cmd, configPath string) error {
+	return fmt.Errorf("Service management is only supported on windows and macOS (use the init system, e.g. systemd)")
+}
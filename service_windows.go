@@ -0,0 +1,162 @@
+// Copyright 2016 Landonia Ltd. All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/landonia/gomost/proxy"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const (
+	// serviceName is the name the service is registered with
+	serviceName = "gomost"
+)
+
+// isService will return true if the process was started by the service
+// control manager
+func isService() bool {
+	is, err := svc.IsWindowsService()
+	return err == nil && is
+}
+
+// runService will serve the requests until the service control manager
+// requests the service to stop, writing the lifecycle to the event log
+func runService(p *proxy.Proxy) error {
+	elog, err := eventlog.Open(serviceName)
+	if err != nil {
+		return fmt.Errorf("Could not open event log: %s", err.Error())
+	}
+	defer elog.Close()
+	elog.Info(1, "Starting gomost service")
+	if err := svc.Run(serviceName, &service{p: p, elog: elog}); err != nil {
+		elog.Error(1, fmt.Sprintf("Service failed: %s", err.Error()))
+		return err
+	}
+	elog.Info(1, "Stopped gomost service")
+	return nil
+}
+
+// service handles the requests from the service control manager
+type service struct {
+	p    *proxy.Proxy
+	elog *eventlog.Log
+}
+
+// Execute will run the proxy until a stop or shutdown request is received
+func (s *service) Execute(args []string, requests <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	changes <- svc.Status{State: svc.StartPending}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.p.Service()
+	}()
+	select {
+	case <-s.p.Ready():
+	case err := <-errs:
+		s.elog.Error(1, fmt.Sprintf("Could not start gomost: %v", err))
+		return false, 1
+	}
+	changes <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				changes <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				changes <- svc.Status{State: svc.StopPending}
+				s.p.Shutdown()
+				if err := <-errs; err != nil {
+					s.elog.Error(1, fmt.Sprintf("Error shutting down gomost: %s", err.Error()))
+					return false, 1
+				}
+				return false, 0
+			}
+		case err := <-errs:
+			if err != nil {
+				s.elog.Error(1, fmt.Sprintf("Gomost stopped unexpectedly: %s", err.Error()))
+				return false, 1
+			}
+			return false, 0
+		}
+	}
+}
+
+// controlService will install, uninstall, start or stop the windows service
+func controlService(cmd, configPath string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	if cmd == "install" {
+		return installService(m, configPath)
+	}
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("Service %s is not installed: %s", serviceName, err.Error())
+	}
+	defer s.Close()
+	switch cmd {
+	case "uninstall":
+		if err := s.Delete(); err != nil {
+			return err
+		}
+		return eventlog.Remove(serviceName)
+	case "start":
+		return s.Start()
+	case "stop":
+		status, err := s.Control(svc.Stop)
+		if err != nil {
+			return err
+		}
+		for timeout := time.Now().Add(time.Minute); status.State != svc.Stopped; {
+			if time.Now().After(timeout) {
+				return fmt.Errorf("Timed out waiting for the service to stop")
+			}
+			time.Sleep(300 * time.Millisecond)
+			if status, err = s.Query(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("Unknown service command %q (install, uninstall, start or stop)", cmd)
+}
+
+// installService will register the service to start automatically using the
+// configuration file along with the event log source
+func installService(m *mgr.Mgr, configPath string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	var args []string
+	if configPath != "" {
+		if configPath, err = filepath.Abs(configPath); err != nil {
+			return err
+		}
+		args = append(args, "-c", configPath)
+	}
+	args = append(args, "run")
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "Gomost",
+		Description: "Hosts multiple sites from the one server",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if err := eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		s.Delete()
+		return fmt.Errorf("Could not install event log source: %s", err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+// Copyright 2016 Landonia Ltd. All rights reserved.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/landonia/gomost/proxy"
+	"golang.org/x/sys/unix"
+)
+
+// notifyLogLevel will toggle between the trace and the configured log level
+// (or the default level when none was configured) each time a SIGUSR2
+// signal is received
+func notifyLogLevel(p *proxy.Proxy, level string) {
+	if level = strings.ToLower(level); level == "" {
+		level = proxy.DefaultLogLevel
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR2)
+	go func() {
+		for range sigs {
+			next := "trace"
+			if p.Config().LogLevel == next {
+				next = level
+			}
+			if err := p.SetLogLevel(next); err != nil {
+				logger.Error("Could not change log level: %s", err.Error())
+			}
+		}
+	}()
+}
+
+// notifyReopen will reopen the log file and the proxy log files each time a
+// SIGUSR1 signal is received allowing them to be rotated using logrotate
+func notifyReopen(p *proxy.Proxy, logFile string) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1)
+	go func() {
+		for range sigs {
+			if logFile != "" {
+				if err := redirectLog(logFile); err != nil {
+					logger.Error("Could not reopen log file: %s", err.Error())
+				}
+			}
+			if err := p.ReopenLogs(); err != nil {
+				logger.Error("Could not reopen logs: %s", err.Error())
+			}
+			logger.Info("Reopened log files")
+		}
+	}()
+}
+
+// redirectLog will (re)open the log file and replace stdout and stderr with
+// it so that everything written by the loggers is kept
+func redirectLog(logFile string) error {
+	f, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := unix.Dup2(int(f.Fd()), int(os.Stdout.Fd())); err != nil {
+		return err
+	}
+	return unix.Dup2(int(f.Fd()), int(os.Stderr.Fd()))
+}
@@ -0,0 +1,20 @@
+// Copyright 2016 Landonia Ltd. All rights reserved.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/landonia/gomost/proxy"
+)
+
+// notifyLogLevel is not supported on windows as there is no user signal
+func notifyLogLevel(p *proxy.Proxy, level string) {}
+
+// notifyReopen is not supported on windows as there is no user signal
+func notifyReopen(p *proxy.Proxy, logFile string) {}
+
+// redirectLog is not supported on windows
+func redirectLog(logFile string) error {
+	return fmt.Errorf("A log file is not supported on windows")
+}
@@ -0,0 +1,179 @@
+// Copyright 2016 Landonia Ltd. All rights reserved.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/landonia/gomost/proxy"
+)
+
+// runTop will display the live route counters from the admin server until
+// interrupted
+func runTop(config proxy.Configuration, args []string) {
+	topFlags := flag.NewFlagSet("top", flag.ExitOnError)
+	admin := topFlags.String("admin", config.Admin.Addr, "The admin server address")
+	interval := topFlags.Duration("interval", 2*time.Second, "The refresh interval")
+	token := topFlags.String("token", "", "The admin bearer token")
+	username := topFlags.String("username", "", "The admin basic auth username")
+	password := topFlags.String("password", "", "The admin basic auth password (GOMOST_ADMIN_PASSWORD by default)")
+	caFile := topFlags.String("cacert", config.Admin.TLS.CertFile, "The CA certificates used to verify the admin server (the system roots if empty)")
+	certFile := topFlags.String("cert", "", "The client certificate sent to the admin server")
+	keyFile := topFlags.String("key", "", "The key of the client certificate")
+	serverName := topFlags.String("servername", "", "The server name expected within the admin server certificate (the admin host by default)")
+	topFlags.Parse(args)
+	if *admin == "" {
+		logger.Fatal("The admin server address must be configured or provided using -admin")
+	}
+
+	// Use the configured credentials unless they have been provided
+	if *password == "" {
+		*password = os.Getenv("GOMOST_ADMIN_PASSWORD")
+	}
+	if *token == "" && *username == "" {
+		cred := topCredential(config)
+		*token, *username = cred.Token, cred.Username
+		if cred.Username != "" {
+			*password = cred.Password
+		}
+	}
+
+	// The admin server is reached using HTTPS when it has TLS configured
+	url := *admin
+	if !strings.Contains(url, "://") {
+		if strings.HasPrefix(url, ":") {
+			url = "127.0.0.1" + url
+		}
+		scheme := "http://"
+		if config.Admin.TLS.CertFile != "" || config.Admin.TLS.Reuse {
+			scheme = "https://"
+		}
+		url = scheme + url
+	}
+	url = strings.TrimSuffix(url, "/") + "/routes"
+	tlsConfig, err := topTLSConfig(*caFile, *certFile, *keyFile, *serverName)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	client := &http.Client{Timeout: *interval, Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	previous := make(map[string]int64)
+	last := time.Now()
+	for {
+		routes, err := fetchRoutes(client, url, *token, *username, *password)
+		now := time.Now()
+		elapsed := now.Sub(last).Seconds()
+		last = now
+
+		// Clear the screen and move to the top left
+		fmt.Print("\033[H\033[2J")
+		fmt.Printf("gomost top - %s - %s\n\n", url, now.Format("15:04:05"))
+		if err != nil {
+			fmt.Printf("Could not fetch routes: %s\n", err.Error())
+		} else {
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+			fmt.Fprintln(w, "HOST\tMATCH\tREQ/S\tLATENCY\tERRORS\tINFLIGHT\tHEALTH\t")
+			for _, r := range routes {
+				if r.Stats == nil {
+					continue
+				}
+				key := r.Match + "|" + r.Host + "|" + r.Path
+				rate := 0.0
+				if prev, exists := previous[key]; exists && elapsed > 0 {
+					rate = float64(r.Stats.Requests-prev) / elapsed
+				}
+				previous[key] = r.Stats.Requests
+				errorRate := 0.0
+				if r.Stats.Requests > 0 {
+					errorRate = float64(r.Stats.Errors) / float64(r.Stats.Requests) * 100
+				}
+				host := r.Host
+				if r.Match == "rule" {
+					host = r.Path
+				}
+				fmt.Fprintf(w, "%s\t%s\t%.1f\t%.1fms\t%.1f%%\t%d\t%s\t\n", host, r.Match, rate,
+					r.Stats.LatencyMS, errorRate, r.Stats.InFlight, r.Stats.Health)
+			}
+			w.Flush()
+		}
+		time.Sleep(*interval)
+	}
+}
+
+// topTLSConfig will return the TLS configuration used to verify the admin
+// server and present the client certificate
+func topTLSConfig(caFile, certFile, keyFile, serverName string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{ServerName: serverName}
+	if caFile != "" {
+		b, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read the admin CA file: %s", err.Error())
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("No certificates found in the admin CA file: %s", caFile)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not load the client certificate: %s", err.Error())
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// topCredential will return the first configured admin credential that can
+// view the routes and be sent by top (the basic auth passwords stored as a
+// bcrypt hash cannot be sent)
+func topCredential(config proxy.Configuration) proxy.AdminCredential {
+	for _, cred := range config.Admin.Credentials {
+		canView := false
+		for _, scope := range cred.Scopes {
+			canView = canView || scope == "*" || scope == "routes"
+		}
+		if !canView {
+			continue
+		} else if cred.Token != "" {
+			return proxy.AdminCredential{Token: cred.Token}
+		} else if cred.Username != "" && !strings.HasPrefix(cred.Password, "$2") {
+			return proxy.AdminCredential{Username: cred.Username, Password: cred.Password}
+		}
+	}
+	return proxy.AdminCredential{}
+}
+
+// fetchRoutes will request the routes from the admin server
+func fetchRoutes(client *http.Client, url, token, username, password string) ([]proxy.Route, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if username != "" {
+		req.SetBasicAuth(username, password)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected status: %s", resp.Status)
+	}
+	var routes []proxy.Route
+	if err := json.NewDecoder(resp.Body).Decode(&routes); err != nil {
+		return nil, err
+	}
+	return routes, nil
+}